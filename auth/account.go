@@ -0,0 +1,415 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/patdeg/go-appengine/common"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/mail"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Sender of the account emails, must be an authorized App Engine sender
+	EmailSender = "myemail@gmail.com"
+
+	// Cost of the bcrypt password hashes
+	PasswordHashCost = 12
+
+	MinPasswordLength = 5
+
+	// Lifetime of the code sent to verify a new account
+	VerificationCodeExpiration = time.Hour * 24
+)
+
+var (
+	ERROR_ACCOUNT_EXISTS       = errors.New("Account already exists")
+	ERROR_ACCOUNT_NOT_VERIFIED = errors.New("Account not verified")
+	ERROR_BAD_CREDENTIALS      = errors.New("Bad email or password")
+	ERROR_PASSWORD_TOO_SHORT   = errors.New("Password too short")
+	ERROR_PASSWORD_TOO_LONG    = errors.New("Password too long")
+	ERROR_INVALID_CODE         = errors.New("Invalid or expired code")
+)
+
+// Purposes of a verification code
+const (
+	CODE_VERIFY_EMAIL   = "verify_email"
+	CODE_RESET_PASSWORD = "reset_password"
+)
+
+// Local credentials of the built-in identity server, stored in datastore
+// under the kind "LocalAccounts" keyed by the lowercase email.
+type LocalAccount struct {
+	Email               string    `json:"email,omitempty"`
+	Name                string    `json:"name,omitempty"`
+	PasswordHash        []byte    `json:"-" datastore:",noindex"`
+	Verified            bool      `json:"verified,omitempty"`
+	CreatedTime         time.Time `json:"created_time,omitempty"`
+	UpdatedTime         time.Time `json:"updated_time,omitempty"`
+	VerifiedTime        time.Time `json:"verified_time,omitempty"`
+	PasswordChangedTime time.Time `json:"password_changed_time,omitempty"`
+	// Time the last password reset code was sent, part of its purpose
+	PasswordResetTime time.Time `json:"-" datastore:",noindex"`
+}
+
+// Single-use code sent by email, stored in datastore under the kind
+// "VerificationCodes" keyed by the SHA-256 of the code so that the code
+// itself is never persisted.
+type VerificationCode struct {
+	Email       string    `json:"email,omitempty"`
+	Purpose     string    `json:"purpose,omitempty"`
+	CreatedTime time.Time `json:"created_time,omitempty"`
+	ExpiresTime time.Time `json:"expires_time,omitempty"`
+}
+
+// Hash compared against when the account doesn't exist, so that unknown
+// and known emails take the same time to be rejected. Generated at first
+// use with PasswordHashCost, which the application may set at startup.
+var (
+	dummyPasswordHash     []byte
+	dummyPasswordHashOnce sync.Once
+)
+
+func getDummyPasswordHash() []byte {
+	dummyPasswordHashOnce.Do(func() {
+		dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), PasswordHashCost)
+	})
+	return dummyPasswordHash
+}
+
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func localAccountKey(c context.Context, email string) *datastore.Key {
+	return datastore.NewKey(c, "LocalAccounts", NormalizeEmail(email), 0, nil)
+}
+
+func CheckPasswordLength(password string) error {
+	if len(password) < MinPasswordLength {
+		return ERROR_PASSWORD_TOO_SHORT
+	}
+	// bcrypt ignores everything after 72 bytes
+	if len(password) > 72 {
+		return ERROR_PASSWORD_TOO_LONG
+	}
+	return nil
+}
+
+func HashPassword(password string) ([]byte, error) {
+	if err := CheckPasswordLength(password); err != nil {
+		return nil, err
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), PasswordHashCost)
+}
+
+func GetLocalAccount(c context.Context, email string) (*LocalAccount, error) {
+	var account LocalAccount
+	err := datastore.Get(c, localAccountKey(c, email), &account)
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// Whether the email is the one of a verified local account
+func IsLocalAccountVerified(c context.Context, email string) bool {
+	account, err := GetLocalAccount(c, NormalizeEmail(email))
+	return (err == nil) && account.Verified
+}
+
+// Create an unverified account. An existing unverified account is replaced,
+// so that signing up again resends a working link. ERROR_ACCOUNT_EXISTS is
+// returned if the email is already verified.
+func CreateLocalAccount(c context.Context, email, name, password string) (*LocalAccount, error) {
+	log.Infof(c, ">>>> CreateLocalAccount")
+
+	email = NormalizeEmail(email)
+	if email == "" {
+		return nil, ERROR_NO_EMAIL
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	account := &LocalAccount{
+		Email:        email,
+		Name:         strings.TrimSpace(name),
+		PasswordHash: hash,
+		CreatedTime:  time.Now(),
+		UpdatedTime:  time.Now(),
+	}
+
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		key := localAccountKey(tc, email)
+		var existing LocalAccount
+		err := datastore.Get(tc, key, &existing)
+		if err == nil && existing.Verified {
+			return ERROR_ACCOUNT_EXISTS
+		} else if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err = datastore.Put(tc, key, account)
+		return err
+	}, nil)
+	if err != nil {
+		if err != ERROR_ACCOUNT_EXISTS {
+			log.Errorf(c, "CreateLocalAccount: Error storing account: %v", err)
+		}
+		return nil, err
+	}
+
+	return account, nil
+}
+
+// Check the password of a verified account
+func CheckLocalPassword(c context.Context, email, password string) (*LocalAccount, error) {
+	account, err := GetLocalAccount(c, email)
+	if err == datastore.ErrNoSuchEntity {
+		bcrypt.CompareHashAndPassword(getDummyPasswordHash(), []byte(password))
+		return nil, ERROR_BAD_CREDENTIALS
+	} else if err != nil {
+		log.Errorf(c, "CheckLocalPassword: Error getting account: %v", err)
+		return nil, err
+	}
+
+	if bcrypt.CompareHashAndPassword(account.PasswordHash, []byte(password)) != nil {
+		return nil, ERROR_BAD_CREDENTIALS
+	}
+
+	if !account.Verified {
+		return nil, ERROR_ACCOUNT_NOT_VERIFIED
+	}
+
+	return account, nil
+}
+
+func hashCode(code string) string {
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
+
+// Generate a random code for the email and purpose, valid for ttl
+func NewVerificationCode(c context.Context, email, purpose string, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := base64.RawURLEncoding.EncodeToString(b)
+
+	vc := &VerificationCode{
+		Email:       NormalizeEmail(email),
+		Purpose:     purpose,
+		CreatedTime: time.Now(),
+		ExpiresTime: time.Now().Add(ttl),
+	}
+	key := datastore.NewKey(c, "VerificationCodes", hashCode(code), 0, nil)
+	if _, err := datastore.Put(c, key, vc); err != nil {
+		log.Errorf(c, "NewVerificationCode: Error storing code: %v", err)
+		return "", err
+	}
+	return code, nil
+}
+
+// Check and delete a code. The code can only be used once, and only for the
+// email and purpose it was issued for. A code presented with the wrong email
+// or purpose is deleted too.
+func ConsumeVerificationCode(c context.Context, email, code, purpose string) error {
+	if code == "" {
+		return ERROR_INVALID_CODE
+	}
+	var vc VerificationCode
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		key := datastore.NewKey(tc, "VerificationCodes", hashCode(code), 0, nil)
+		err := datastore.Get(tc, key, &vc)
+		if err == datastore.ErrNoSuchEntity {
+			return ERROR_INVALID_CODE
+		} else if err != nil {
+			return err
+		}
+		return datastore.Delete(tc, key)
+	}, nil)
+	if err != nil {
+		return err
+	}
+	// Checked once the delete is committed, an error in the transaction
+	// would roll it back
+	if (vc.Email != NormalizeEmail(email)) || (vc.Purpose != purpose) || time.Now().After(vc.ExpiresTime) {
+		return ERROR_INVALID_CODE
+	}
+	return nil
+}
+
+// Binding of a pending account, part of the purpose of its verification
+// code. Signing up again replaces the password and the binding, so that
+// the links sent for the previous password can't verify the new one.
+func accountBinding(account *LocalAccount) string {
+	return hashCode(string(account.PasswordHash))
+}
+
+func verifyEmailPurpose(account *LocalAccount) string {
+	return CODE_VERIFY_EMAIL + " " + accountBinding(account)
+}
+
+// Mark the account as verified and create the matching Users entity. The
+// account must still have the binding the code was checked against,
+// ERROR_INVALID_CODE is returned if it was replaced in between.
+func VerifyLocalAccount(c context.Context, email, binding string) (*LocalAccount, error) {
+	var account LocalAccount
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		key := localAccountKey(tc, email)
+		if err := datastore.Get(tc, key, &account); err != nil {
+			return err
+		}
+		if accountBinding(&account) != binding {
+			return ERROR_INVALID_CODE
+		}
+		account.Verified = true
+		account.VerifiedTime = time.Now()
+		account.UpdatedTime = time.Now()
+		_, err := datastore.Put(tc, key, &account)
+		return err
+	}, nil)
+	if err == ERROR_INVALID_CODE {
+		log.Infof(c, "VerifyLocalAccount: Account replaced since the code was issued")
+		return nil, err
+	} else if err != nil {
+		log.Errorf(c, "VerifyLocalAccount: Error verifying account: %v", err)
+		return nil, err
+	}
+
+	legacyId := common.Encrypt(c, "", "D-"+account.Email)
+	userId, err := ResolveIdentity(c, "", "Deglon", account.Email, account.Email, true, legacyId)
+	if err != nil {
+		log.Errorf(c, "VerifyLocalAccount: Error resolving identity: %v", err)
+		return nil, err
+	}
+
+	key := datastore.NewKey(c, "Users", account.Email, 0, nil)
+	var u User
+	err = datastore.Get(c, key, &u)
+	if err == datastore.ErrNoSuchEntity {
+		u = User{
+			GlobalUserId:  userId,
+			LoginProvider: "Deglon",
+			UserName:      account.Name,
+			UserEmail:     account.Email,
+			CreatedTime:   time.Now(),
+			UpdatedTime:   time.Now(),
+			MailingOptIn:  true,
+		}
+		if _, err := datastore.Put(c, key, &u); err != nil {
+			log.Errorf(c, "VerifyLocalAccount: Error storing user: %v", err)
+			return nil, err
+		}
+	} else if err != nil {
+		log.Errorf(c, "VerifyLocalAccount: Error getting user: %v", err)
+		return nil, err
+	}
+
+	return &account, nil
+}
+
+// Render emailTemplate and send it
+func sendAccountEmail(c context.Context, email, name, service, subject, message, link string) error {
+	buf := new(bytes.Buffer)
+	if err := emailTemplate.Execute(buf, template.FuncMap{
+		"Email":   email,
+		"Name":    name,
+		"Service": service,
+		"Message": message,
+		"URL":     link,
+	}); err != nil {
+		log.Errorf(c, "emailTemplate: %v", err)
+		return err
+	}
+
+	msg := &mail.Message{
+		Sender:   EmailSender,
+		To:       []string{email},
+		Subject:  subject,
+		HTMLBody: buf.String(),
+	}
+	if err := mail.Send(c, msg); err != nil {
+		log.Errorf(c, "Couldn't send email: %v", err)
+		return err
+	}
+	log.Infof(c, "Email sent to %v", email)
+	return nil
+}
+
+// Create the account and email the verification link. When the email already
+// has a verified account, the owner is notified instead, and the caller shows
+// the same page in both cases so that registered emails are not disclosed.
+func SignUpLocalAccount(c context.Context, email, name, password, service string) error {
+	account, err := CreateLocalAccount(c, email, name, password)
+	if err == ERROR_ACCOUNT_EXISTS {
+		log.Infof(c, "SignUpLocalAccount: Account already exists")
+		return sendAccountEmail(c, email, name, service,
+			"Your account for "+service,
+			"Someone just tried to create an account for "+service+" with your email. You already have an account, if you forgot your password you can reset it below.",
+			OIDCIssuer+"/oauth2/forgot")
+	} else if err != nil {
+		return err
+	}
+
+	code, err := NewVerificationCode(c, email, verifyEmailPurpose(account), VerificationCodeExpiration)
+	if err != nil {
+		return err
+	}
+
+	v := url.Values{}
+	v.Set("email", NormalizeEmail(email))
+	v.Set("code", code)
+	return sendAccountEmail(c, email, name, service,
+		"Please verify your email for "+service,
+		"You just tried to login to "+service+" and requested to create an account. To finalize this process, we need to verify your email "+email+". Please click on the link bellow to finish the process:",
+		OIDCIssuer+"/oauth2/validate?"+v.Encode())
+}
+
+// Verification link sent by email, for /oauth2/validate
+func ValidateHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> ValidateHandler")
+
+	email := r.FormValue("email")
+	binding := ""
+	account, err := GetLocalAccount(c, email)
+	if err == nil {
+		binding = accountBinding(account)
+		err = ConsumeVerificationCode(c, email, r.FormValue("code"), CODE_VERIFY_EMAIL+" "+binding)
+	} else if err == datastore.ErrNoSuchEntity {
+		err = ERROR_INVALID_CODE
+	}
+	if err == nil {
+		_, err = VerifyLocalAccount(c, email, binding)
+	}
+	if err == ERROR_INVALID_CODE {
+		log.Infof(c, "ValidateHandler: Invalid code")
+		common.MessageHandler(c, w, "This link is invalid or has expired. Please create your account again.", "/", 10)
+		return
+	} else if err != nil {
+		log.Errorf(c, "ValidateHandler: Error verifying account: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof(c, "ValidateHandler: Account verified")
+	Audit(r, &AuditEvent{Action: AUDIT_ACCOUNT_VERIFIED, Outcome: AUDIT_SUCCESS, Actor: email, Provider: "Deglon"})
+	common.MessageHandler(c, w, "Thanks, your email is verified. You can now sign in.", "/", 5)
+}
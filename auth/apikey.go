@@ -0,0 +1,522 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/patdeg/go-appengine/common"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Permission to issue and revoke the API keys of services and other users
+const (
+	PERM_MANAGE_API_KEYS = "apikeys.manage"
+)
+
+// Header carrying the API key. "Authorization: ApiKey <key>" is accepted too.
+const (
+	API_KEY_HEADER = "X-API-Key"
+	API_KEY_PREFIX = "dk_"
+)
+
+var (
+	ERROR_INVALID_API_KEY = errors.New("Invalid API key")
+	ERROR_API_KEY_EXPIRED = errors.New("API key expired")
+	ERROR_INVALID_SCOPES  = errors.New("Invalid scopes")
+)
+
+// Scopes that can be given to API keys. Apps add their own.
+var APIKeyScopes = []string{"read", "write"}
+
+// Scope an API key needs to use a permission of its owner. Permissions not
+// listed need DefaultPermissionScope. Apps add their own.
+var (
+	PermissionScopes = map[string]string{
+		PERM_ACCESS: "read",
+	}
+	DefaultPermissionScope = "write"
+)
+
+// Longest and default lifetime of a new key
+var (
+	APIKeyMaxLifetime     = 365 * 24 * time.Hour
+	APIKeyDefaultLifetime = 90 * 24 * time.Hour
+)
+
+// Last used time is only saved when older than this, to avoid a datastore
+// write on every call
+var APIKeyLastUsedResolution = time.Minute
+
+// API key of a user or a service, stored in datastore under the kind
+// "APIKeys" keyed by KeyId. The key given to the client is
+// API_KEY_PREFIX + KeyId + "_" + secret, only the hash of the secret is
+// kept. Owner is the email of the user, or the name of the service.
+type APIKey struct {
+	KeyId        string    `json:"id,omitempty"`
+	Name         string    `json:"name,omitempty"`
+	Owner        string    `json:"owner,omitempty"`
+	Service      bool      `json:"service,omitempty"`
+	SecretHash   string    `json:"-" datastore:",noindex"`
+	Scopes       []string  `json:"scopes,omitempty"`
+	CreatedBy    string    `json:"created_by,omitempty"`
+	CreatedTime  time.Time `json:"created_time,omitempty"`
+	ExpiresTime  time.Time `json:"expires_time,omitempty"`
+	LastUsedTime time.Time `json:"last_used_time,omitempty"`
+	LastUsedIP   string    `json:"last_used_ip,omitempty" datastore:",noindex"`
+	Revoked      bool      `json:"revoked,omitempty"`
+	RevokedTime  time.Time `json:"revoked_time,omitempty"`
+}
+
+type apiKeyContextKey struct{}
+
+// User and key of a request authenticated by APIKeyMiddleware
+type apiKeyAuth struct {
+	Key  *APIKey
+	User *User
+}
+
+func apiKeyKey(c context.Context, keyId string) *datastore.Key {
+	return datastore.NewKey(c, "APIKeys", keyId, 0, nil)
+}
+
+// Whether the key has the scope
+func (k *APIKey) HasScope(scope string) bool {
+	return common.StringInSlice(scope, k.Scopes)
+}
+
+// Scope needed to use the permission with an API key
+func PermissionScope(perm string) string {
+	if scope, ok := PermissionScopes[perm]; ok {
+		return scope
+	}
+	return DefaultPermissionScope
+}
+
+// Whether the API key of the request, if any, has the scope of the
+// permission. Cookie sessions and access tokens are not limited by scopes.
+func apiKeyAllowsPermission(r *http.Request, perm string) bool {
+	k := RequestAPIKey(r)
+	return (k == nil) || k.HasScope(PermissionScope(perm))
+}
+
+// Split a key in its id and secret
+func parseAPIKey(key string) (string, string, error) {
+	if !strings.HasPrefix(key, API_KEY_PREFIX) {
+		return "", "", ERROR_INVALID_API_KEY
+	}
+	parts := strings.SplitN(key[len(API_KEY_PREFIX):], "_", 2)
+	if (len(parts) != 2) || (parts[0] == "") || (parts[1] == "") {
+		return "", "", ERROR_INVALID_API_KEY
+	}
+	return parts[0], parts[1], nil
+}
+
+// Check that all the scopes are known, and remove duplicates
+func checkAPIKeyScopes(scopes []string) ([]string, error) {
+	var checked []string
+	for _, s := range scopes {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !common.StringInSlice(s, APIKeyScopes) {
+			return nil, ERROR_INVALID_SCOPES
+		}
+		if !common.StringInSlice(s, checked) {
+			checked = append(checked, s)
+		}
+	}
+	if len(checked) == 0 {
+		return nil, ERROR_INVALID_SCOPES
+	}
+	return checked, nil
+}
+
+// Create a key for the owner, a user email or a service name. Returns the
+// key and the secret to give to the client, which can't be read again.
+func CreateAPIKey(c context.Context, owner string, service bool, name string, scopes []string, lifetime time.Duration, createdBy string) (*APIKey, string, error) {
+	log.Infof(c, ">>>> CreateAPIKey")
+
+	if !service {
+		owner = NormalizeEmail(owner)
+	}
+	if owner == "" {
+		return nil, "", ERROR_INVALID_PRINCIPAL
+	}
+	scopes, err := checkAPIKeyScopes(scopes)
+	if err != nil {
+		return nil, "", err
+	}
+	if (lifetime <= 0) || (lifetime > APIKeyMaxLifetime) {
+		lifetime = APIKeyDefaultLifetime
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	secretString := base64.RawURLEncoding.EncodeToString(secret)
+
+	k := &APIKey{
+		KeyId:       hex.EncodeToString(id),
+		Name:        name,
+		Owner:       owner,
+		Service:     service,
+		SecretHash:  hashCode(secretString),
+		Scopes:      scopes,
+		CreatedBy:   NormalizeEmail(createdBy),
+		CreatedTime: time.Now(),
+		ExpiresTime: time.Now().Add(lifetime),
+	}
+	if _, err := datastore.Put(c, apiKeyKey(c, k.KeyId), k); err != nil {
+		log.Errorf(c, "CreateAPIKey: Error storing key: %v", err)
+		return nil, "", err
+	}
+	return k, API_KEY_PREFIX + k.KeyId + "_" + secretString, nil
+}
+
+// Get a key by id, from memcache or datastore
+func GetAPIKey(c context.Context, keyId string) (*APIKey, error) {
+	var k APIKey
+	err := common.GetObjMemCache(c, "apikey-"+keyId, &k)
+	if err == nil {
+		return &k, nil
+	} else if err != memcache.ErrCacheMiss {
+		log.Errorf(c, "GetAPIKey: Error reading memcache: %v", err)
+	}
+
+	if err := datastore.Get(c, apiKeyKey(c, keyId), &k); err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			log.Errorf(c, "GetAPIKey: Error getting key: %v", err)
+		}
+		return nil, err
+	}
+	common.SetObjMemCache(c, "apikey-"+keyId, &k, 1)
+	return &k, nil
+}
+
+// List the keys of an owner, or all the keys if the owner is empty
+func GetAPIKeys(c context.Context, owner string) ([]APIKey, error) {
+	q := datastore.NewQuery("APIKeys")
+	if owner != "" {
+		q = q.Filter("Owner =", owner)
+	}
+	var keys []APIKey
+	if _, err := q.GetAll(c, &keys); err != nil {
+		log.Errorf(c, "GetAPIKeys: Error querying keys: %v", err)
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Revoke a key. The entity is kept so that the key still shows in the list.
+func RevokeAPIKey(c context.Context, keyId string) error {
+	log.Infof(c, ">>>> RevokeAPIKey")
+
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		var k APIKey
+		if err := datastore.Get(tc, apiKeyKey(tc, keyId), &k); err != nil {
+			return err
+		}
+		if k.Revoked {
+			return nil
+		}
+		k.Revoked = true
+		k.RevokedTime = time.Now()
+		_, err := datastore.Put(tc, apiKeyKey(tc, keyId), &k)
+		return err
+	}, nil)
+	if err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			log.Errorf(c, "RevokeAPIKey: Error revoking key: %v", err)
+		}
+		return err
+	}
+	common.DeleteMemCache(c, "apikey-"+keyId)
+	return nil
+}
+
+// Check a key given by a client and save when it was used
+func VerifyAPIKey(c context.Context, key, ip string) (*APIKey, error) {
+	keyId, secret, err := parseAPIKey(key)
+	if err != nil {
+		return nil, err
+	}
+	k, err := GetAPIKey(c, keyId)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ERROR_INVALID_API_KEY
+	} else if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashCode(secret)), []byte(k.SecretHash)) != 1 || k.Revoked {
+		return nil, ERROR_INVALID_API_KEY
+	}
+	if time.Now().After(k.ExpiresTime) {
+		return nil, ERROR_API_KEY_EXPIRED
+	}
+
+	if time.Since(k.LastUsedTime) > APIKeyLastUsedResolution {
+		// Read again in the transaction, the key may have been revoked
+		var current APIKey
+		err := datastore.RunInTransaction(c, func(tc context.Context) error {
+			if err := datastore.Get(tc, apiKeyKey(tc, keyId), &current); err != nil {
+				return err
+			}
+			current.LastUsedTime = time.Now()
+			current.LastUsedIP = ip
+			_, err := datastore.Put(tc, apiKeyKey(tc, keyId), &current)
+			return err
+		}, nil)
+		if err != nil {
+			log.Errorf(c, "VerifyAPIKey: Error saving last use: %v", err)
+			return k, nil
+		}
+		if current.Revoked {
+			return nil, ERROR_INVALID_API_KEY
+		}
+		common.SetObjMemCache(c, "apikey-"+keyId, &current, 1)
+		return &current, nil
+	}
+	return k, nil
+}
+
+// User of a key. Keys of users get the stored user, keys of services a
+// user named after the service, without email.
+func apiKeyUser(c context.Context, k *APIKey) (*User, error) {
+	u := &User{
+		LoginProvider: "APIKey",
+		UserName:      k.Owner,
+		UserId:        "apikey:" + k.KeyId,
+	}
+	if k.Service {
+		return u, nil
+	}
+	stored, err := GetUserByEmail(c, k.Owner)
+	if err == nil {
+		u = stored
+		u.AccessToken = ""
+		u.LoginProvider = "APIKey"
+	} else if err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	u.UserEmail = k.Owner
+	return u, nil
+}
+
+// Key sent in the headers of the request
+func apiKeyFromHeader(r *http.Request) string {
+	if key := r.Header.Get(API_KEY_HEADER); key != "" {
+		return key
+	}
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "ApiKey ") {
+		return strings.TrimSpace(h[len("ApiKey "):])
+	}
+	return ""
+}
+
+// Key of a request authenticated by APIKeyMiddleware, nil for the others
+func RequestAPIKey(r *http.Request) *APIKey {
+	if a, ok := r.Context().Value(apiKeyContextKey{}).(*apiKeyAuth); ok {
+		return a.Key
+	}
+	return nil
+}
+
+// User of a request authenticated by APIKeyMiddleware, nil for the others
+func requestAPIKeyUser(r *http.Request) *User {
+	if a, ok := r.Context().Value(apiKeyContextKey{}).(*apiKeyAuth); ok {
+		return a.User
+	}
+	return nil
+}
+
+// Wrap a handler so that requests with an API key in the headers are
+// authenticated by the key. GetUser then returns the user of the key, like
+// for a cookie session. Requests without a key go through unchanged, a
+// wrong key is answered with 401.
+func APIKeyMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := apiKeyFromHeader(r)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		c := appengine.NewContext(r)
+
+		k, err := VerifyAPIKey(c, key, r.RemoteAddr)
+		if err == ERROR_INVALID_API_KEY || err == ERROR_API_KEY_EXPIRED {
+			log.Warningf(c, "APIKeyMiddleware: %v", err)
+			Audit(r, &AuditEvent{Action: AUDIT_LOGIN, Outcome: AUDIT_FAILURE, Provider: "APIKey", Details: err.Error()})
+			w.Header().Set("WWW-Authenticate", `ApiKey realm="api"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		u, err := apiKeyUser(c, k)
+		if err != nil {
+			log.Errorf(c, "APIKeyMiddleware: Error getting user: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, &apiKeyAuth{Key: k, User: u})))
+	}
+}
+
+// Wrap a handler so that requests authenticated by an API key need the
+// scope. Cookie sessions are not limited by scopes. To use inside
+// APIKeyMiddleware.
+func RequireAPIKeyScope(scope string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if k := RequestAPIKey(r); (k != nil) && !k.HasScope(scope) {
+				log.Warningf(appengine.NewContext(r), "RequireAPIKeyScope: Key %v without scope %v", k.KeyId, scope)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// Manage the API keys of the logged in user, at /apikeys. GET lists the
+// keys. POST with name, scopes (comma separated) and expires_in_days creates
+// a key and returns it, the only time the secret is shown, and needs the
+// csrf_token. Users allowed to manage API keys can pass owner, and
+// service=1 for the key of a service. Keys can't be managed with an API key
+// or an access token, only from a cookie session.
+func APIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> APIKeysHandler")
+
+	if (RequestAPIKey(r) != nil) || (RequestTokenClaims(r) != nil) {
+		http.Error(w, "API keys and access tokens can't manage API keys", http.StatusForbidden)
+		return
+	}
+	u, cookieID := GetUserAndCookieID(w, r)
+	if (u == nil) || (u.UserEmail == "") {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
+
+	owner := u.UserEmail
+	service := r.FormValue("service") == "1"
+	if (r.FormValue("owner") != "") || service {
+		if !SessionHasPermission(c, r, u, cookieID, PERM_MANAGE_API_KEYS) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		owner = r.FormValue("owner")
+	}
+
+	if r.Method == "GET" {
+		if !service {
+			owner = NormalizeEmail(owner)
+		}
+		keys, err := GetAPIKeys(c, owner)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if keys == nil {
+			keys = []APIKey{}
+		}
+		common.WriteJSON(w, keys)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !CheckCSRFToken(c, r, cookieID) {
+		log.Warningf(c, "APIKeysHandler: Invalid CSRF token")
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+	// The key passes SessionSecondFactorOK on its own, the session must have
+	// entered the second factor to create one
+	if !SessionSecondFactorOK(c, r, u, cookieID) {
+		log.Warningf(c, "APIKeysHandler: Key denied to %v without second factor", u.UserEmail)
+		http.Error(w, "Second factor required", http.StatusForbidden)
+		return
+	}
+
+	lifetime := time.Duration(0)
+	if days, err := strconv.Atoi(r.FormValue("expires_in_days")); err == nil {
+		lifetime = time.Duration(days) * 24 * time.Hour
+	}
+	k, secret, err := CreateAPIKey(c, owner, service, r.FormValue("name"), strings.Split(r.FormValue("scopes"), ","), lifetime, u.UserEmail)
+	if err == ERROR_INVALID_SCOPES || err == ERROR_INVALID_PRINCIPAL {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	Audit(r, &AuditEvent{Action: AUDIT_API_KEY_CREATED, Outcome: AUDIT_SUCCESS, Actor: u.UserEmail, Target: k.Owner, Details: k.KeyId + " " + strings.Join(k.Scopes, ",")})
+
+	common.WriteJSON(w, map[string]interface{}{
+		"key":     secret,
+		"api_key": k,
+	})
+}
+
+// Revoke an API key, for POST /apikeys/revoke with the id, and the
+// csrf_token for cookie sessions. Users revoke their keys, users allowed to
+// manage API keys any key.
+func RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> RevokeAPIKeyHandler")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u, cookieID := GetUserAndCookieID(w, r)
+	if (u == nil) || (u.UserEmail == "") {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
+	// API keys and bearer tokens are not sent by the browsers on their own
+	if (requestAPIKeyUser(r) == nil) && (requestJWTUser(r) == nil) && !CheckCSRFToken(c, r, cookieID) {
+		log.Warningf(c, "RevokeAPIKeyHandler: Invalid CSRF token")
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	k, err := GetAPIKey(c, r.FormValue("id"))
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if (k.Service || (k.Owner != u.UserEmail)) && !SessionHasPermission(c, r, u, cookieID, PERM_MANAGE_API_KEYS) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if err := RevokeAPIKey(c, k.KeyId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	Audit(r, &AuditEvent{Action: AUDIT_API_KEY_REVOKED, Outcome: AUDIT_SUCCESS, Actor: u.UserEmail, Target: k.Owner, Details: k.KeyId})
+	common.WriteJSON(w, map[string]string{"status": "ok"})
+}
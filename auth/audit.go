@@ -0,0 +1,287 @@
+package auth
+
+import (
+	"github.com/patdeg/go-appengine/common"
+	"golang.org/x/net/context"
+	bigquery "google.golang.org/api/bigquery/v2"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Permission to read the audit log
+const (
+	PERM_VIEW_AUDIT = "audit.view"
+)
+
+// Actions recorded in the audit log
+const (
+	AUDIT_LOGIN             = "login"
+	AUDIT_LOGIN_MFA         = "login_mfa"
+	AUDIT_LOGOUT            = "logout"
+	AUDIT_CALLBACK          = "provider_callback"
+	AUDIT_TOKEN_EXCHANGE    = "token_exchange"
+	AUDIT_CONSENT           = "consent"
+	AUDIT_APP_REVOKED       = "app_revoked"
+	AUDIT_ACCOUNT_CREATED   = "account_created"
+	AUDIT_ACCOUNT_VERIFIED  = "account_verified"
+	AUDIT_PASSWORD_RESET    = "password_reset"
+	AUDIT_PASSWORD_CHANGED  = "password_changed"
+	AUDIT_TOTP_ENROLLED     = "totp_enrolled"
+	AUDIT_TOTP_DISABLED     = "totp_disabled"
+	AUDIT_IDENTITY_LINKED   = "identity_linked"
+	AUDIT_IDENTITY_UNLINKED = "identity_unlinked"
+	AUDIT_ROLES_CHANGED     = "roles_changed"
+	AUDIT_KEY_ROTATED       = "signing_key_rotated"
+	AUDIT_DATA_EXPORTED     = "data_exported"
+	AUDIT_DATA_ERASED       = "data_erased"
+	AUDIT_API_KEY_CREATED   = "api_key_created"
+	AUDIT_API_KEY_REVOKED   = "api_key_revoked"
+)
+
+// Outcomes of an audited action
+const (
+	AUDIT_SUCCESS = "success"
+	AUDIT_FAILURE = "failure"
+	AUDIT_DENIED  = "denied"
+)
+
+// Entry of the audit log
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action,omitempty"`
+	Outcome   string    `json:"outcome,omitempty"`
+	Actor     string    `json:"actor,omitempty"`
+	Target    string    `json:"target,omitempty"`
+	Provider  string    `json:"provider,omitempty"`
+	ClientId  string    `json:"client_id,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty" datastore:",noindex"`
+	Details   string    `json:"details,omitempty" datastore:",noindex"`
+}
+
+// Filter of the audit log. Empty fields match everything.
+type AuditQuery struct {
+	Actor  string
+	Action string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// Destination of the audit events
+type AuditSink interface {
+	WriteAuditEvent(c context.Context, e *AuditEvent) error
+}
+
+// Sink that can also be searched, used by AuditLogHandler
+type AuditQuerier interface {
+	QueryAuditEvents(c context.Context, q *AuditQuery) ([]AuditEvent, error)
+}
+
+// Sinks every audit event is written to. The first one implementing
+// AuditQuerier answers AuditLogHandler.
+var AuditSinks = []AuditSink{&DatastoreAuditSink{}}
+
+// Audit events stored in datastore under the kind "AuditEvents". Queries
+// on the actor or the action need the composite indexes (Actor, -Time),
+// (Action, -Time) and, for both, (Actor, Action, -Time) in index.yaml.
+type DatastoreAuditSink struct{}
+
+func (s *DatastoreAuditSink) WriteAuditEvent(c context.Context, e *AuditEvent) error {
+	_, err := datastore.Put(c, datastore.NewIncompleteKey(c, "AuditEvents", nil), e)
+	return err
+}
+
+func (s *DatastoreAuditSink) QueryAuditEvents(c context.Context, aq *AuditQuery) ([]AuditEvent, error) {
+	q := datastore.NewQuery("AuditEvents")
+	if aq.Actor != "" {
+		q = q.Filter("Actor =", aq.Actor)
+	}
+	if aq.Action != "" {
+		q = q.Filter("Action =", aq.Action)
+	}
+	if !aq.Since.IsZero() {
+		q = q.Filter("Time >=", aq.Since)
+	}
+	if !aq.Until.IsZero() {
+		q = q.Filter("Time <", aq.Until)
+	}
+	q = q.Order("-Time").Limit(aq.Limit)
+
+	var events []AuditEvent
+	if _, err := q.GetAll(c, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Audit events streamed to a BigQuery table with the columns of AuditEvent
+type BigQueryAuditSink struct {
+	ProjectId string
+	DatasetId string
+	TableId   string
+}
+
+func (s *BigQueryAuditSink) WriteAuditEvent(c context.Context, e *AuditEvent) error {
+	req := &bigquery.TableDataInsertAllRequest{
+		Kind: "bigquery#tableDataInsertAllRequest",
+		Rows: []*bigquery.TableDataInsertAllRequestRows{
+			{
+				InsertId: strconv.FormatInt(e.Time.UnixNano(), 10) + "-" + e.Action,
+				Json: map[string]bigquery.JsonValue{
+					"Time":      e.Time,
+					"Action":    e.Action,
+					"Outcome":   e.Outcome,
+					"Actor":     e.Actor,
+					"Target":    e.Target,
+					"Provider":  e.Provider,
+					"ClientId":  e.ClientId,
+					"IP":        e.IP,
+					"UserAgent": e.UserAgent,
+					"Details":   e.Details,
+				},
+			},
+		},
+	}
+	return common.StreamDataInBigquery(c, s.ProjectId, s.DatasetId, s.TableId, req)
+}
+
+func (s *BigQueryAuditSink) QueryAuditEvents(c context.Context, aq *AuditQuery) ([]AuditEvent, error) {
+	query := "SELECT * FROM `" + s.ProjectId + "." + s.DatasetId + "." + s.TableId + "` WHERE TRUE"
+	var params []*bigquery.QueryParameter
+	stringParam := func(name, value string) {
+		query += " AND " + name + " = @" + name
+		params = append(params, &bigquery.QueryParameter{
+			Name:           name,
+			ParameterType:  &bigquery.QueryParameterType{Type: "STRING"},
+			ParameterValue: &bigquery.QueryParameterValue{Value: value},
+		})
+	}
+	timeParam := func(name, op string, value time.Time) {
+		query += " AND Time " + op + " @" + name
+		params = append(params, &bigquery.QueryParameter{
+			Name:           name,
+			ParameterType:  &bigquery.QueryParameterType{Type: "TIMESTAMP"},
+			ParameterValue: &bigquery.QueryParameterValue{Value: value.UTC().Format("2006-01-02 15:04:05.999999")},
+		})
+	}
+	if aq.Actor != "" {
+		stringParam("Actor", aq.Actor)
+	}
+	if aq.Action != "" {
+		stringParam("Action", aq.Action)
+	}
+	if !aq.Since.IsZero() {
+		timeParam("Since", ">=", aq.Since)
+	}
+	if !aq.Until.IsZero() {
+		timeParam("Until", "<", aq.Until)
+	}
+	query += " ORDER BY Time DESC LIMIT " + strconv.Itoa(aq.Limit)
+
+	rows, _, err := common.RunQueryInBigQuery(c, s.ProjectId, query, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []AuditEvent
+	for _, row := range rows {
+		get := func(name string) string {
+			v, _ := row[name].(string)
+			return v
+		}
+		seconds, _ := strconv.ParseFloat(get("Time"), 64)
+		events = append(events, AuditEvent{
+			Time:      time.Unix(0, int64(seconds*1e9)),
+			Action:    get("Action"),
+			Outcome:   get("Outcome"),
+			Actor:     get("Actor"),
+			Target:    get("Target"),
+			Provider:  get("Provider"),
+			ClientId:  get("ClientId"),
+			IP:        get("IP"),
+			UserAgent: get("UserAgent"),
+			Details:   get("Details"),
+		})
+	}
+	return events, nil
+}
+
+// Record an audit event for the request, adding the time, IP and user agent.
+// Errors of the sinks are logged, they don't fail the request.
+func Audit(r *http.Request, e *AuditEvent) {
+	c := appengine.NewContext(r)
+	e.Time = time.Now()
+	e.Actor = NormalizeEmail(e.Actor)
+	e.Target = NormalizeEmail(e.Target)
+	e.IP = r.RemoteAddr
+	e.UserAgent = common.Trunc500(r.Header.Get("User-Agent"))
+	log.Infof(c, "Audit: %v %v actor=%v target=%v", e.Action, e.Outcome, e.Actor, e.Target)
+	for _, s := range AuditSinks {
+		if err := s.WriteAuditEvent(c, e); err != nil {
+			log.Errorf(c, "Audit: Error writing event: %v", err)
+		}
+	}
+}
+
+// Success or failure outcome
+func auditOutcome(success bool) string {
+	if success {
+		return AUDIT_SUCCESS
+	}
+	return AUDIT_FAILURE
+}
+
+// Search the audit log, for GET /admin/audit with optional actor, action,
+// since and until (RFC 3339) and limit. To wrap in
+// RequirePermission(PERM_VIEW_AUDIT).
+func AuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> AuditLogHandler")
+
+	var querier AuditQuerier
+	for _, s := range AuditSinks {
+		if q, ok := s.(AuditQuerier); ok {
+			querier = q
+			break
+		}
+	}
+	if querier == nil {
+		http.Error(w, "No searchable audit sink", http.StatusNotImplemented)
+		return
+	}
+
+	aq := &AuditQuery{
+		Actor:  NormalizeEmail(r.FormValue("actor")),
+		Action: r.FormValue("action"),
+		Limit:  100,
+	}
+	if limit, err := strconv.Atoi(r.FormValue("limit")); err == nil && limit > 0 && limit <= 1000 {
+		aq.Limit = limit
+	}
+	for name, t := range map[string]*time.Time{"since": &aq.Since, "until": &aq.Until} {
+		if v := r.FormValue(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, name+" must be RFC 3339", http.StatusBadRequest)
+				return
+			}
+			*t = parsed
+		}
+	}
+
+	events, err := querier.QueryAuditEvents(c, aq)
+	if err != nil {
+		log.Errorf(c, "AuditLogHandler: Error querying events: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []AuditEvent{}
+	}
+	common.WriteJSON(w, events)
+}
@@ -14,10 +14,12 @@ import (
 	"google.golang.org/appengine/memcache"
 	"google.golang.org/appengine/urlfetch"
 	"net/http"
-	"strings"
 	"time"
 )
 
+// Default Google and Facebook configurations of the tenants, see
+// RegisterTenant. The handlers never modify them, the callback URL is set
+// on the copies of each tenant.
 var GoogleConfig = &oauth2.Config{
 	ClientID:     "myclientid",
 	ClientSecret: "myclientsecret",
@@ -48,22 +50,6 @@ var (
 	ERROR_NO_EMAIL = errors.New("No Email")
 )
 
-var AdminUsers = []string{
-	"myemail@gmail.com",
-}
-
-var WhiteListUsers = []string{
-	"myemail@gmail.com",
-}
-
-func IsUserAdmin(c context.Context, email string) bool {
-	return common.StringInSlice(strings.ToLower(email), AdminUsers)
-}
-
-func IsUserWhiteListed(c context.Context, email string) bool {
-	return common.StringInSlice(strings.ToLower(email), WhiteListUsers)
-}
-
 func GetServiceAccountClient(c context.Context) *http.Client {
 	return &http.Client{
 		Transport: &oauth2.Transport{
@@ -81,23 +67,27 @@ func RedirectIfNotLoggedIn(w http.ResponseWriter, r *http.Request) bool {
 	log.Infof(c, ">>>> RedirectIfNotLoggedIn")
 	cookie, provider := GetCookieToken(r)
 	if cookie == "" {
+		tenant, err := GetTenant(r)
+		if err != nil {
+			log.Warningf(c, "%v: %v", r.Host, err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return true
+		}
 		if provider == "Google" {
 			state := r.URL.Path
-			GoogleConfig.RedirectURL = "http://" + r.Host + "/goog_callback"
 			w.Header().Add("Access-Control-Allow-Origin", "*")
 			w.Header().Add("Access-Control-Allow-Methods", "PUT")
 			w.Header().Add("Access-Control-Allow-Headers", "Content-Type")
-			url := GoogleConfig.AuthCodeURL(state)
+			url := tenant.Google.AuthCodeURL(state)
 			log.Infof(c, "Redirect to %v", url)
 			http.Redirect(w, r, url, http.StatusFound)
 			return true
 		} else if provider == "Facebook" {
 			state := r.URL.Path
-			FacebookConfig.RedirectURL = "http://" + r.Host + "/fb_callback"
 			w.Header().Add("Access-Control-Allow-Origin", "*")
 			w.Header().Add("Access-Control-Allow-Methods", "PUT")
 			w.Header().Add("Access-Control-Allow-Headers", "Content-Type")
-			url := FacebookConfig.AuthCodeURL(state)
+			url := tenant.Facebook.AuthCodeURL(state)
 			log.Infof(c, "Redirect to %v", url)
 			http.Redirect(w, r, url, http.StatusFound)
 			return true
@@ -113,6 +103,9 @@ func RedirectIfNotLoggedIn(w http.ResponseWriter, r *http.Request) bool {
 func RedirectIfNotLoggedInAPI(w http.ResponseWriter, r *http.Request) bool {
 	c := appengine.NewContext(r)
 	log.Infof(c, ">>>> RedirectIfNotLoggedInAPI")
+	if (RequestAPIKey(r) != nil) || (RequestTokenClaims(r) != nil) {
+		return false
+	}
 	cookie, _ := GetCookieToken(r)
 	if cookie == "" {
 		log.Infof(c, "Cookie is null, requesting new login")
@@ -123,6 +116,9 @@ func RedirectIfNotLoggedInAPI(w http.ResponseWriter, r *http.Request) bool {
 }
 
 func IsLoggedIn(r *http.Request) bool {
+	if (RequestAPIKey(r) != nil) || (RequestTokenClaims(r) != nil) {
+		return true
+	}
 	cookie, _ := GetCookieToken(r)
 	if cookie == "" {
 		return false
@@ -137,18 +133,24 @@ func ClearHandler(w http.ResponseWriter, r *http.Request) {
 	log.Infof(c, "New request Path:%v RemoteAddr:%v Method:%v Host:%v", r.URL.Path, r.RemoteAddr, r.Method, r.Host)
 	log.Infof(c, "RequstURI:%v", r.RequestURI)
 
+	tenant, err := GetTenant(r)
+	if err != nil {
+		log.Warningf(c, "%v: %v", r.Host, err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
 	http.SetCookie(w,
 		&http.Cookie{
 			Name:    "token",
 			Value:   "",
 			Secure:  true,
 			Path:    "/",
-			Expires: time.Now(),
-			//MaxAge: 3600,
+			Expires: time.Unix(0, 0),
+			MaxAge:  -1,
 		})
-	time.Sleep(time.Second * 5)
 
-	url := "http://" + r.Host
+	url := tenant.URL("/")
 	log.Infof(c, "Redirect to %v", url)
 	http.Redirect(w, r, url, http.StatusFound)
 }
@@ -161,8 +163,13 @@ func GoogleLoginHandler(w http.ResponseWriter, r *http.Request) {
 	if state == "" {
 		state = "/"
 	}
-	GoogleConfig.RedirectURL = "http://" + r.Host + "/goog_callback"
-	url := GoogleConfig.AuthCodeURL(state)
+	tenant, err := GetTenant(r)
+	if err != nil {
+		log.Warningf(c, "%v: %v", r.Host, err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	url := tenant.Google.AuthCodeURL(state)
 
 	track.TrackEventDetails(w, r, common.GetCookieID(w, r), "Google Login", state, "", 0.0)
 
@@ -178,46 +185,77 @@ func GoogleLoginOfflineAccessHandler(w http.ResponseWriter, r *http.Request) {
 	if state == "" {
 		state = "/"
 	}
-	GoogleConfig.RedirectURL = "http://" + r.Host + "/goog_callback"
-	url := GoogleConfig.AuthCodeURL(state, oauth2.AccessTypeOffline)
+	tenant, err := GetTenant(r)
+	if err != nil {
+		log.Warningf(c, "%v: %v", r.Host, err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	url := tenant.Google.AuthCodeURL(state, oauth2.AccessTypeOffline)
 	log.Infof(c, "Redirect to %v", url)
 	http.Redirect(w, r, url, http.StatusFound)
 }
 
+// Log out, revoking the provider token of the session. With everywhere=1,
+// only in a POST with the CSRF token of the session, all the sessions of
+// the user are ended, in every browser. A POST always needs the token, a
+// GET ends the current session only. The user is sent to the local redirect
+// path, or to the logout page of the provider with provider_logout=1 if one
+// is set in ProviderLogoutURLs.
 func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 	log.Infof(c, ">>>>>>>> LogoutHandler")
 
-	http.SetCookie(w, &http.Cookie{
-		Name:  "fb-token",
-		Value: "",
-		//Secure:  true,
-		Path:    "/",
-		Domain:  r.Host,
-		Expires: time.Now(),
-	})
-	time.Sleep(time.Millisecond * 100)
-
-	http.SetCookie(w, &http.Cookie{
-		Name:  "g-token",
-		Value: "",
-		//Secure:  true,
-		Path:    "/",
-		Domain:  r.Host,
-		Expires: time.Now(),
-	})
-	time.Sleep(time.Millisecond * 100)
+	everywhere := r.FormValue("everywhere") == "1"
+	if everywhere && (r.Method != "POST") {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if (r.Method == "POST") && !CheckCSRFToken(c, r, common.GetCookieID(w, r)) {
+		log.Warningf(c, "LogoutHandler: Invalid CSRF token")
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
 
-	cookieID := common.GetCookieID(w, r)
-	if cookieID != "" {
-		common.DeleteMemCache(c, "user-"+cookieID)
+	tenant, err := GetTenant(r)
+	if err != nil {
+		log.Warningf(c, "%v: %v", r.Host, err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
 	}
 
-	url := "http://" + r.Host
+	u := logout(c, w, r, everywhere)
+
+	url := tenant.URL(localRedirect(r.FormValue("redirect")))
+	if (u != nil) && (r.FormValue("provider_logout") == "1") {
+		if providerURL, ok := ProviderLogoutURLs[u.LoginProvider]; ok {
+			url = providerURL
+		}
+	}
 	log.Infof(c, "Redirect to %v", url)
 	http.Redirect(w, r, url, http.StatusFound)
 }
 
+// Remove the Google and Facebook token cookies
+func clearTokenCookies(w http.ResponseWriter, r *http.Request) {
+	tenant, err := GetTenant(r)
+	if err != nil {
+		// No token cookie can have been set for the host
+		return
+	}
+	for _, name := range []string{"fb-token", "g-token"} {
+		http.SetCookie(w, &http.Cookie{
+			Name:  name,
+			Value: "",
+			//Secure:  true,
+			Path:    "/",
+			Domain:  tenant.Host,
+			Expires: time.Unix(0, 0),
+			MaxAge:  -1,
+		})
+	}
+}
+
 func GoogleCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 	log.Infof(c, ">>>>>>>> Google Callback Handler")
@@ -228,35 +266,48 @@ func GoogleCallbackHandler(w http.ResponseWriter, r *http.Request) {
 
 	track.TrackEventDetails(w, r, common.GetCookieID(w, r), "Google Callback", state, errorMessage, 0.0)
 
-	log.Infof(c, "code: %v", code)
+	tenant, err := GetTenant(r)
+	if err != nil {
+		log.Warningf(c, "%v: %v", r.Host, err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
 	log.Infof(c, "state: %v", state)
 	if errorMessage != "" {
 		log.Errorf(c, "Error while authentification: %v", errorMessage)
-		url := "http://" + r.Host
+		Audit(r, &AuditEvent{Action: AUDIT_CALLBACK, Outcome: AUDIT_FAILURE, Provider: "Google", Details: errorMessage})
+		url := tenant.URL("/")
 		log.Infof(c, "Redirect to %v", url)
 		http.Redirect(w, r, url, http.StatusFound)
 		return
 	}
 
-	GoogleConfig.RedirectURL = "http://" + r.Host + "/goog_callback"
+	cookieID := common.GetCookieID(w, r)
+	redirect, err := checkCallbackState(c, cookieID, "Google", state)
+	if err != nil {
+		log.Warningf(c, "Error checking state: %v", err)
+		Audit(r, &AuditEvent{Action: AUDIT_CALLBACK, Outcome: AUDIT_FAILURE, Provider: "Google", Details: err.Error()})
+		http.Error(w, "Invalid state", http.StatusBadRequest)
+		return
+	}
 
-	tok, err := GoogleConfig.Exchange(c, code)
+	tok, err := tenant.Google.Exchange(c, code)
 	if err != nil {
 		log.Errorf(c, "Error exchanging code for token: %v", err)
+		Audit(r, &AuditEvent{Action: AUDIT_CALLBACK, Outcome: AUDIT_FAILURE, Provider: "Google", Details: err.Error()})
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	token := tok.AccessToken
 	log.Infof(c, "Token Exchanged:")
-	log.Infof(c, "  - AccessToken: %v", tok.AccessToken)
-	log.Infof(c, "  - RefreshToken: %v", tok.RefreshToken)
+	log.Infof(c, "  - HasRefreshToken: %v", tok.RefreshToken != "")
 	log.Infof(c, "  - Expiry: %v", tok.Expiry)
 
 	cookieValue := common.Encrypt(c, r.RemoteAddr, token)
-	log.Debugf(c, "cookie value = %v", cookieValue)
 
-	SetCookieToken(c, w, "Google", r.Host, cookieValue, 1, false)
+	SetCookieToken(c, w, "Google", tenant.Host, cookieValue, 1, tenant.SecureCookies())
 
 	err = common.SetObjMemCache(c, "g-token-"+tok.AccessToken, &tok, 24)
 	if err != nil {
@@ -264,7 +315,6 @@ func GoogleCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Switch LoginProvider to Facebook in user memcache
-	cookieID := common.GetCookieID(w, r)
 	if cookieID != "" {
 		var u User
 		err = common.GetObjMemCache(c, "user-"+cookieID, &u)
@@ -285,7 +335,11 @@ func GoogleCallbackHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	url := "http://" + r.Host + state
+	identifyLogin(w, r, cookieID, "Google", token)
+
+	Audit(r, &AuditEvent{Action: AUDIT_CALLBACK, Outcome: AUDIT_SUCCESS, Provider: "Google"})
+
+	url := tenant.URL(localRedirect(redirect))
 
 	log.Infof(c, "Redirect to %v", url)
 	http.Redirect(w, r, url, http.StatusFound)
@@ -302,35 +356,48 @@ func GoogleCallbackDatastoreHandler(w http.ResponseWriter, r *http.Request) {
 
 	track.TrackEventDetails(w, r, common.GetCookieID(w, r), "Google Callback", state, errorMessage, 0.0)
 
-	log.Infof(c, "code: %v", code)
+	tenant, err := GetTenant(r)
+	if err != nil {
+		log.Warningf(c, "%v: %v", r.Host, err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
 	log.Infof(c, "state: %v", state)
 	if errorMessage != "" {
 		log.Errorf(c, "Error while authentification: %v", errorMessage)
-		url := "http://" + r.Host
+		Audit(r, &AuditEvent{Action: AUDIT_CALLBACK, Outcome: AUDIT_FAILURE, Provider: "Google", Details: errorMessage})
+		url := tenant.URL("/")
 		log.Infof(c, "Redirect to %v", url)
 		http.Redirect(w, r, url, http.StatusFound)
 		return
 	}
 
-	GoogleConfig.RedirectURL = "http://" + r.Host + "/goog_callback"
+	cookieID := common.GetCookieID(w, r)
+	redirect, err := checkCallbackState(c, cookieID, "Google", state)
+	if err != nil {
+		log.Warningf(c, "Error checking state: %v", err)
+		Audit(r, &AuditEvent{Action: AUDIT_CALLBACK, Outcome: AUDIT_FAILURE, Provider: "Google", Details: err.Error()})
+		http.Error(w, "Invalid state", http.StatusBadRequest)
+		return
+	}
 
-	tok, err := GoogleConfig.Exchange(c, code)
+	tok, err := tenant.Google.Exchange(c, code)
 	if err != nil {
 		log.Errorf(c, "Error exchanging code for token: %v", err)
+		Audit(r, &AuditEvent{Action: AUDIT_CALLBACK, Outcome: AUDIT_FAILURE, Provider: "Google", Details: err.Error()})
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	token := tok.AccessToken
 	log.Infof(c, "Token Exchanged:")
-	log.Infof(c, "  - AccessToken: %v", tok.AccessToken)
-	log.Infof(c, "  - RefreshToken: %v", tok.RefreshToken)
+	log.Infof(c, "  - HasRefreshToken: %v", tok.RefreshToken != "")
 	log.Infof(c, "  - Expiry: %v", tok.Expiry)
 
 	cookieValue := common.Encrypt(c, r.RemoteAddr, token)
-	log.Debugf(c, "cookie value = %v", cookieValue)
 
-	SetCookieToken(c, w, "Google", r.Host, cookieValue, 1, false)
+	SetCookieToken(c, w, "Google", tenant.Host, cookieValue, 1, tenant.SecureCookies())
 
 	err = common.SetObjMemCache(c, "g-token-"+tok.AccessToken, &tok, 24)
 	if err != nil {
@@ -338,7 +405,6 @@ func GoogleCallbackDatastoreHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Switch LoginProvider to Facebook in user memcache
-	cookieID := common.GetCookieID(w, r)
 	if cookieID != "" {
 		var u User
 		err = common.GetObjMemCache(c, "user-"+cookieID, &u)
@@ -365,7 +431,11 @@ func GoogleCallbackDatastoreHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	url := "http://" + r.Host + state
+	identifyLogin(w, r, cookieID, "Google", token)
+
+	Audit(r, &AuditEvent{Action: AUDIT_CALLBACK, Outcome: AUDIT_SUCCESS, Provider: "Google"})
+
+	url := tenant.URL(localRedirect(redirect))
 
 	log.Infof(c, "Redirect to %v", url)
 	http.Redirect(w, r, url, http.StatusFound)
@@ -380,8 +450,13 @@ func FacebookLoginHandler(w http.ResponseWriter, r *http.Request) {
 	if state == "" {
 		state = "/"
 	}
-	FacebookConfig.RedirectURL = "http://" + r.Host + "/fb_callback"
-	url := FacebookConfig.AuthCodeURL(state)
+	tenant, err := GetTenant(r)
+	if err != nil {
+		log.Warningf(c, "%v: %v", r.Host, err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	url := tenant.Facebook.AuthCodeURL(state)
 
 	track.TrackEventDetails(w, r, common.GetCookieID(w, r), "Facebook Login", state, "", 0.0)
 
@@ -399,35 +474,48 @@ func FacebookCallbackHandler(w http.ResponseWriter, r *http.Request) {
 
 	track.TrackEventDetails(w, r, common.GetCookieID(w, r), "Facebook Callback", state, errorMessage, 0.0)
 
-	log.Infof(c, "code: %v", code)
+	tenant, err := GetTenant(r)
+	if err != nil {
+		log.Warningf(c, "%v: %v", r.Host, err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
 	log.Infof(c, "state: %v", state)
 	if errorMessage != "" {
 		log.Errorf(c, "Error while authentification: %v", errorMessage)
-		url := "http://" + r.Host
+		Audit(r, &AuditEvent{Action: AUDIT_CALLBACK, Outcome: AUDIT_FAILURE, Provider: "Facebook", Details: errorMessage})
+		url := tenant.URL("/")
 		log.Infof(c, "Redirect to %v", url)
 		http.Redirect(w, r, url, http.StatusFound)
 		return
 	}
 
-	FacebookConfig.RedirectURL = "http://" + r.Host + "/fb_callback"
+	cookieID := common.GetCookieID(w, r)
+	redirect, err := checkCallbackState(c, cookieID, "Facebook", state)
+	if err != nil {
+		log.Warningf(c, "Error checking state: %v", err)
+		Audit(r, &AuditEvent{Action: AUDIT_CALLBACK, Outcome: AUDIT_FAILURE, Provider: "Facebook", Details: err.Error()})
+		http.Error(w, "Invalid state", http.StatusBadRequest)
+		return
+	}
 
-	tok, err := FacebookConfig.Exchange(c, code)
+	tok, err := tenant.Facebook.Exchange(c, code)
 	if err != nil {
 		log.Errorf(c, "Error exchanging code for token: %v", err)
+		Audit(r, &AuditEvent{Action: AUDIT_CALLBACK, Outcome: AUDIT_FAILURE, Provider: "Facebook", Details: err.Error()})
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	token := tok.AccessToken
 	log.Infof(c, "Token Exchanged:")
-	log.Infof(c, "  - AccessToken: %v", tok.AccessToken)
-	log.Infof(c, "  - RefreshToken: %v", tok.RefreshToken)
+	log.Infof(c, "  - HasRefreshToken: %v", tok.RefreshToken != "")
 	log.Infof(c, "  - Expiry: %v", tok.Expiry)
 
 	cookieValue := common.Encrypt(c, r.RemoteAddr, token)
-	log.Debugf(c, "cookie value = %v", cookieValue)
 
-	SetCookieToken(c, w, "Facebook", r.Host, cookieValue, 1, false)
+	SetCookieToken(c, w, "Facebook", tenant.Host, cookieValue, 1, tenant.SecureCookies())
 
 	err = common.SetObjMemCache(c, "fb-token-"+tok.AccessToken, &tok, 24)
 	if err != nil {
@@ -435,7 +523,6 @@ func FacebookCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Switch LoginProvider to Facebook in user memcache
-	cookieID := common.GetCookieID(w, r)
 	if cookieID != "" {
 		var u User
 		err = common.GetObjMemCache(c, "user-"+cookieID, &u)
@@ -456,7 +543,11 @@ func FacebookCallbackHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	url := "http://" + r.Host + state
+	identifyLogin(w, r, cookieID, "Facebook", token)
+
+	Audit(r, &AuditEvent{Action: AUDIT_CALLBACK, Outcome: AUDIT_SUCCESS, Provider: "Facebook"})
+
+	url := tenant.URL(localRedirect(redirect))
 
 	log.Infof(c, "Redirect to %v", url)
 	http.Redirect(w, r, url, http.StatusFound)
@@ -473,35 +564,48 @@ func FacebookCallbackDatastoreHandler(w http.ResponseWriter, r *http.Request) {
 
 	track.TrackEventDetails(w, r, common.GetCookieID(w, r), "Facebook Callback", state, errorMessage, 0.0)
 
-	log.Infof(c, "code: %v", code)
+	tenant, err := GetTenant(r)
+	if err != nil {
+		log.Warningf(c, "%v: %v", r.Host, err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
 	log.Infof(c, "state: %v", state)
 	if errorMessage != "" {
 		log.Errorf(c, "Error while authentification: %v", errorMessage)
-		url := "http://" + r.Host
+		Audit(r, &AuditEvent{Action: AUDIT_CALLBACK, Outcome: AUDIT_FAILURE, Provider: "Facebook", Details: errorMessage})
+		url := tenant.URL("/")
 		log.Infof(c, "Redirect to %v", url)
 		http.Redirect(w, r, url, http.StatusFound)
 		return
 	}
 
-	FacebookConfig.RedirectURL = "http://" + r.Host + "/fb_callback"
+	cookieID := common.GetCookieID(w, r)
+	redirect, err := checkCallbackState(c, cookieID, "Facebook", state)
+	if err != nil {
+		log.Warningf(c, "Error checking state: %v", err)
+		Audit(r, &AuditEvent{Action: AUDIT_CALLBACK, Outcome: AUDIT_FAILURE, Provider: "Facebook", Details: err.Error()})
+		http.Error(w, "Invalid state", http.StatusBadRequest)
+		return
+	}
 
-	tok, err := FacebookConfig.Exchange(c, code)
+	tok, err := tenant.Facebook.Exchange(c, code)
 	if err != nil {
 		log.Errorf(c, "Error exchanging code for token: %v", err)
+		Audit(r, &AuditEvent{Action: AUDIT_CALLBACK, Outcome: AUDIT_FAILURE, Provider: "Facebook", Details: err.Error()})
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	token := tok.AccessToken
 	log.Infof(c, "Token Exchanged:")
-	log.Infof(c, "  - AccessToken: %v", tok.AccessToken)
-	log.Infof(c, "  - RefreshToken: %v", tok.RefreshToken)
+	log.Infof(c, "  - HasRefreshToken: %v", tok.RefreshToken != "")
 	log.Infof(c, "  - Expiry: %v", tok.Expiry)
 
 	cookieValue := common.Encrypt(c, r.RemoteAddr, token)
-	log.Debugf(c, "cookie value = %v", cookieValue)
 
-	SetCookieToken(c, w, "Facebook", r.Host, cookieValue, 1, false)
+	SetCookieToken(c, w, "Facebook", tenant.Host, cookieValue, 1, tenant.SecureCookies())
 
 	err = common.SetObjMemCache(c, "fb-token-"+tok.AccessToken, &tok, 24)
 	if err != nil {
@@ -509,7 +613,6 @@ func FacebookCallbackDatastoreHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Switch LoginProvider to Facebook in user memcache
-	cookieID := common.GetCookieID(w, r)
 	if cookieID != "" {
 		var u User
 		err = common.GetObjMemCache(c, "user-"+cookieID, &u)
@@ -535,7 +638,11 @@ func FacebookCallbackDatastoreHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	url := "http://" + r.Host + state
+	identifyLogin(w, r, cookieID, "Facebook", token)
+
+	Audit(r, &AuditEvent{Action: AUDIT_CALLBACK, Outcome: AUDIT_SUCCESS, Provider: "Facebook"})
+
+	url := tenant.URL(localRedirect(redirect))
 
 	log.Infof(c, "Redirect to %v", url)
 	http.Redirect(w, r, url, http.StatusFound)
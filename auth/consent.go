@@ -0,0 +1,363 @@
+package auth
+
+import (
+	"errors"
+	"github.com/RangelReale/osin"
+	"github.com/patdeg/go-appengine/common"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Scope that clients of the authorization server can request, with the
+// text shown to the user on the consent page
+type OAuth2Scope struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Scopes supported by the authorization server, in the order they are shown
+var SupportedScopes = []OAuth2Scope{
+	{"openid", "Sign you in with your account"},
+	{"email", "See your email address"},
+	{"profile", "See your name and profile picture"},
+}
+
+var (
+	// Time given to the user to answer the consent page
+	ConsentExpiration = time.Minute * 10
+)
+
+var (
+	ERROR_INVALID_SCOPE = errors.New("Invalid scope")
+)
+
+// Purpose of the code passed from the login to the consent page
+const (
+	CODE_CONSENT = "consent"
+)
+
+// Registration details of a client, kept in the UserData of its osin.Client.
+// Trusted clients are our own applications and skip the consent page.
+// AllowedScopes restricts the scopes the client can request, any supported
+// scope when empty.
+type ClientInfo struct {
+	Name          string   `json:"name,omitempty"`
+	Trusted       bool     `json:"trusted,omitempty"`
+	AllowedScopes []string `json:"allowed_scopes,omitempty"`
+}
+
+// Scopes granted by a user to a client, stored in datastore under the kind
+// "ConsentGrants" keyed by the email and the client id.
+type ConsentGrant struct {
+	Email       string    `json:"email,omitempty"`
+	ClientId    string    `json:"client_id,omitempty"`
+	ClientName  string    `json:"client_name,omitempty" datastore:",noindex"`
+	Scopes      []string  `json:"scopes,omitempty" datastore:",noindex"`
+	CreatedTime time.Time `json:"created_time,omitempty"`
+	UpdatedTime time.Time `json:"updated_time,omitempty"`
+}
+
+func consentGrantKey(c context.Context, email, clientId string) *datastore.Key {
+	return datastore.NewKey(c, "ConsentGrants", NormalizeEmail(email)+" "+clientId, 0, nil)
+}
+
+func GetClientInfo(client osin.Client) *ClientInfo {
+	if info, ok := client.GetUserData().(*ClientInfo); ok && info != nil {
+		return info
+	}
+	return &ClientInfo{Name: client.GetId()}
+}
+
+func getScope(name string) *OAuth2Scope {
+	for i := range SupportedScopes {
+		if SupportedScopes[i].Name == name {
+			return &SupportedScopes[i]
+		}
+	}
+	return nil
+}
+
+// Check that every requested scope is supported and allowed for the client
+func ValidateScopes(client osin.Client, scope string) error {
+	info := GetClientInfo(client)
+	for _, s := range strings.Fields(scope) {
+		if getScope(s) == nil {
+			return ERROR_INVALID_SCOPE
+		}
+		if (len(info.AllowedScopes) > 0) && !common.StringInSlice(s, info.AllowedScopes) {
+			return ERROR_INVALID_SCOPE
+		}
+	}
+	return nil
+}
+
+// Return the grant of the user to the client, datastore.ErrNoSuchEntity if
+// there is none
+func GetConsentGrant(c context.Context, email, clientId string) (*ConsentGrant, error) {
+	var g ConsentGrant
+	if err := datastore.Get(c, consentGrantKey(c, email, clientId), &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// True if the user has to be asked before the client gets these scopes
+func IsConsentRequired(c context.Context, email string, client osin.Client, scope string) (bool, error) {
+	if GetClientInfo(client).Trusted {
+		return false, nil
+	}
+	g, err := GetConsentGrant(c, email, client.GetId())
+	if err == datastore.ErrNoSuchEntity {
+		return true, nil
+	} else if err != nil {
+		log.Errorf(c, "IsConsentRequired: Error getting grant: %v", err)
+		return true, err
+	}
+	for _, s := range strings.Fields(scope) {
+		if !common.StringInSlice(s, g.Scopes) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Remember that the user granted these scopes to the client, in addition to
+// the ones granted before
+func SaveConsentGrant(c context.Context, email string, client osin.Client, scope string) error {
+	log.Infof(c, ">>>> SaveConsentGrant")
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		key := consentGrantKey(tc, email, client.GetId())
+		var g ConsentGrant
+		err := datastore.Get(tc, key, &g)
+		if err == datastore.ErrNoSuchEntity {
+			g = ConsentGrant{
+				Email:       NormalizeEmail(email),
+				ClientId:    client.GetId(),
+				CreatedTime: time.Now(),
+			}
+		} else if err != nil {
+			return err
+		}
+		g.ClientName = GetClientInfo(client).Name
+		for _, s := range strings.Fields(scope) {
+			if !common.StringInSlice(s, g.Scopes) {
+				g.Scopes = append(g.Scopes, s)
+			}
+		}
+		g.UpdatedTime = time.Now()
+		_, err = datastore.Put(tc, key, &g)
+		return err
+	}, nil)
+}
+
+// Delete the grant of the user to the client and the tokens it was given
+func RevokeConsentGrant(c context.Context, email, clientId string) error {
+	log.Infof(c, ">>>> RevokeConsentGrant")
+	err := datastore.Delete(c, consentGrantKey(c, email, clientId))
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		log.Errorf(c, "RevokeConsentGrant: Error deleting grant: %v", err)
+		return err
+	}
+	if oauth2Server == nil {
+		start(c)
+	}
+	if s, ok := oauth2Server.server.Storage.(*MyStorage); ok {
+		s.RemoveClientUserData(NormalizeEmail(email), clientId)
+	}
+	return nil
+}
+
+// List the clients the user granted access to
+func GetConsentGrants(c context.Context, email string) ([]ConsentGrant, error) {
+	var grants []ConsentGrant
+	q := datastore.NewQuery("ConsentGrants").Filter("Email =", NormalizeEmail(email))
+	if _, err := q.GetAll(c, &grants); err != nil {
+		log.Errorf(c, "GetConsentGrants: Error querying grants: %v", err)
+		return nil, err
+	}
+	return grants, nil
+}
+
+// True if the grant the access was issued under was revoked since. Tokens
+// of trusted clients don't depend on a grant.
+func isConsentRevoked(c context.Context, email string, access *osin.AccessData) bool {
+	if GetClientInfo(access.Client).Trusted {
+		return false
+	}
+	g, err := GetConsentGrant(c, email, access.Client.GetId())
+	if err == datastore.ErrNoSuchEntity {
+		return true
+	} else if err != nil {
+		log.Errorf(c, "isConsentRevoked: Error getting grant: %v", err)
+		return false
+	}
+	return access.CreatedAt.Before(g.CreatedTime)
+}
+
+var consentHTML = `<html>
+	<head>
+		<meta name="viewport" content="width=device-width, initial-scale=1">
+		<link href="/lib/bootstrap-3.3.4/css/bootstrap.min.css" rel="stylesheet">
+		<link href="/lib/bootstrap-3.3.4/css/bootstrap-theme.min.css" rel="stylesheet">
+		<style>
+			html {
+		   		height:100%;
+			}
+
+			body {
+				min-height:100%;
+				min-height:100vh;
+				display:flex;
+				align-items:center;
+			}
+		</style>
+	</head>
+	<body>
+		<div class="container">
+			<div class="row">
+				<div class="col-xs-12 col-sm-offset-1 col-sm-10 col-md-offset-2 col-lg-offset-3 col-md-8 col-lg-6">
+					<p style="text-align:center">
+						<img src="/img/logo.png" height="40" alt="Deglon Consulting" />
+					</p>
+					<h2>[[.ClientName]] wants to access your account</h2>
+					<p>Signed in as <b>[[.Email]]</b>. If you allow it, [[.ClientName]] will be able to:</p>
+					<ul class="list-group">
+						[[range .Scopes]]<li class="list-group-item">[[.Description]]</li>
+						[[end]]
+					</ul>
+					<p class="help-block">You can remove this access at any time from your connected apps.</p>
+					<form method="POST" action="https://[[.Server]]/oauth2/auth?response_type=[[.Type]]&client_id=[[.ClientId]]&state=[[.State]]&redirect_uri=[[.Redirect]]&scope=[[.Scope]]&nonce=[[.Nonce]]">
+						<input type="hidden" name="email" value="[[.Email]]">
+						<input type="hidden" name="consent_ticket" value="[[.Ticket]]">
+						<p style="text-align:center">
+							<button type="submit" name="consent" value="deny" class="btn btn-default" style="width:150px">Deny</button>
+							<button type="submit" name="consent" value="allow" class="btn btn-primary" style="width:150px">Allow</button>
+						</p>
+					</form>
+				</div>
+			</div>
+		</div>
+	</body>
+</html>`
+
+var consentTemplate = template.Must(template.New("consent.html").Delims("[[", "]]").Parse(consentHTML))
+
+func renderConsentPage(c context.Context, ar *osin.AuthorizeRequest, w http.ResponseWriter, r *http.Request, email string) {
+	ticket, err := NewVerificationCode(c, email, CODE_CONSENT+" "+ar.Client.GetId(), ConsentExpiration)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	var scopes []OAuth2Scope
+	for _, s := range strings.Fields(ar.Scope) {
+		if scope := getScope(s); scope != nil {
+			scopes = append(scopes, *scope)
+		}
+	}
+
+	data := loginFormData(ar, r)
+	data["Email"] = NormalizeEmail(email)
+	data["Ticket"] = ticket
+	data["ClientName"] = GetClientInfo(ar.Client).Name
+	data["Scopes"] = scopes
+	if err := consentTemplate.Execute(w, data); err != nil {
+		log.Infof(c, "Error with consentTemplate: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// Answer of the consent page. Returns the email of the user and whether the
+// access was allowed, or an empty email if the page has expired.
+func handleConsent(c context.Context, ar *osin.AuthorizeRequest, w http.ResponseWriter, r *http.Request) (string, bool) {
+	log.Infof(c, ">>>> handleConsent")
+
+	email := NormalizeEmail(r.FormValue("email"))
+	err := ConsumeVerificationCode(c, email, r.FormValue("consent_ticket"), CODE_CONSENT+" "+ar.Client.GetId())
+	if err != nil {
+		renderLoginPage(c, ar, w, r, "Your sign in has expired, please sign in again.")
+		return "", false
+	}
+
+	if r.FormValue("consent") != "allow" {
+		log.Infof(c, "handleConsent: Access denied by the user")
+		Audit(r, &AuditEvent{Action: AUDIT_CONSENT, Outcome: AUDIT_DENIED, Actor: email, ClientId: ar.Client.GetId(), Details: ar.Scope})
+		return email, false
+	}
+
+	if err := SaveConsentGrant(c, email, ar.Client, ar.Scope); err != nil {
+		log.Errorf(c, "handleConsent: Error saving grant: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return "", false
+	}
+	Audit(r, &AuditEvent{Action: AUDIT_CONSENT, Outcome: AUDIT_SUCCESS, Actor: email, ClientId: ar.Client.GetId(), Details: ar.Scope})
+	return email, true
+}
+
+// List the apps the logged in user granted access to, for GET /oauth2/apps
+func ConnectedAppsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> ConnectedAppsHandler")
+
+	if RedirectIfNotLoggedInAPI(w, r) {
+		return
+	}
+	u := GetUser(w, r)
+	if (u == nil) || (u.UserEmail == "") {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
+
+	grants, err := GetConsentGrants(c, u.UserEmail)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if grants == nil {
+		grants = []ConsentGrant{}
+	}
+	common.WriteJSON(w, grants)
+}
+
+// Remove the access of an app for the logged in user, for POST
+// /oauth2/apps/revoke with the client_id and the CSRF token of the session
+func RevokeConnectedAppHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> RevokeConnectedAppHandler")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if RedirectIfNotLoggedInAPI(w, r) {
+		return
+	}
+	u, cookieID := GetUserAndCookieID(w, r)
+	if (u == nil) || (u.UserEmail == "") {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
+	if (requestAPIKeyUser(r) == nil) && (requestJWTUser(r) == nil) && !CheckCSRFToken(c, r, cookieID) {
+		log.Warningf(c, "RevokeConnectedAppHandler: Invalid CSRF token")
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	clientId := r.FormValue("client_id")
+	if clientId == "" {
+		http.Error(w, "client_id required", http.StatusBadRequest)
+		return
+	}
+	if err := RevokeConsentGrant(c, u.UserEmail, clientId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	Audit(r, &AuditEvent{Action: AUDIT_APP_REVOKED, Outcome: AUDIT_SUCCESS, Actor: u.UserEmail, ClientId: clientId})
+	common.WriteJSON(w, map[string]string{"status": "ok"})
+}
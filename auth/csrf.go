@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/patdeg/go-appengine/common"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"net/http"
+	"time"
+)
+
+// Random token of a session, stored in datastore under the kind
+// "CSRFTokens" keyed by cookie id. The state changing forms post it back in
+// csrf_token, or the scripts in the X-CSRF-Token header, which a hostile
+// page can't read.
+type CSRFToken struct {
+	Token       string    `json:"token,omitempty" datastore:",noindex"`
+	CreatedTime time.Time `json:"created_time,omitempty"`
+}
+
+func csrfTokenKey(c context.Context, cookieID string) *datastore.Key {
+	return datastore.NewKey(c, "CSRFTokens", cookieID, 0, nil)
+}
+
+// Token of the session, created at first use
+func GetCSRFToken(c context.Context, cookieID string) (string, error) {
+	var t CSRFToken
+	if common.GetObjMemCache(c, "csrf-"+cookieID, &t) == nil {
+		return t.Token, nil
+	}
+	err := datastore.Get(c, csrfTokenKey(c, cookieID), &t)
+	if err == datastore.ErrNoSuchEntity {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		t = CSRFToken{
+			Token:       base64.RawURLEncoding.EncodeToString(b),
+			CreatedTime: time.Now(),
+		}
+		if _, err := datastore.Put(c, csrfTokenKey(c, cookieID), &t); err != nil {
+			log.Errorf(c, "GetCSRFToken: Error storing token: %v", err)
+			return "", err
+		}
+	} else if err != nil {
+		log.Errorf(c, "GetCSRFToken: Error getting token: %v", err)
+		return "", err
+	}
+	common.SetObjMemCache(c, "csrf-"+cookieID, &t, 24)
+	return t.Token, nil
+}
+
+// True if the request carries the token of its session
+func CheckCSRFToken(c context.Context, r *http.Request, cookieID string) bool {
+	if cookieID == "" {
+		return false
+	}
+	sent := r.Header.Get("X-CSRF-Token")
+	if sent == "" {
+		sent = r.FormValue("csrf_token")
+	}
+	if sent == "" {
+		return false
+	}
+	token, err := GetCSRFToken(c, cookieID)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(sent), []byte(token)) == 1
+}
+
+// Token of the session of the logged in user, for GET /csrf_token. Pages
+// read it before posting a state changing form.
+func CSRFTokenHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> CSRFTokenHandler")
+
+	u, cookieID := GetUserAndCookieID(w, r)
+	if (u == nil) || (u.UserEmail == "") || (cookieID == "") {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
+	token, err := GetCSRFToken(c, cookieID)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	common.WriteJSON(w, map[string]string{"csrf_token": token})
+}
@@ -0,0 +1,390 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"github.com/patdeg/go-appengine/common"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	ERROR_EMAIL_NOT_VERIFIED = errors.New("Email not verified by the provider")
+	ERROR_LAST_IDENTITY      = errors.New("Can't unlink the last identity")
+	ERROR_UNKNOWN_PROVIDER   = errors.New("Unknown provider")
+	ERROR_INVALID_STATE      = errors.New("Invalid OAuth state")
+)
+
+// Prefix of the OAuth state of a link, followed by the nonce of the link
+const LINK_STATE_PREFIX = "link:"
+
+// Login of a person with one provider, stored in datastore under the kind
+// "Identities" keyed by provider and subject. UserId is the stable internal
+// id of the person, saved as GlobalUserId in the Users entity, so that all
+// the identities of a person lead to the same user.
+type Identity struct {
+	Provider      string    `json:"provider,omitempty"`
+	Subject       string    `json:"-"`
+	UserId        string    `json:"-"`
+	Email         string    `json:"email,omitempty"`
+	EmailVerified bool      `json:"email_verified,omitempty"`
+	CreatedTime   time.Time `json:"created_time,omitempty"`
+	LastLoginTime time.Time `json:"last_login_time,omitempty"`
+}
+
+// Link started by a logged in user, kept in memcache for the session until
+// the user comes back from the provider. It is only used by ResolveIdentity
+// once the callback brought back the nonce, so that the code of another
+// account can't be linked.
+type pendingLink struct {
+	UserId    string `json:"user_id"`
+	Provider  string `json:"provider"`
+	Nonce     string `json:"nonce"`
+	Redirect  string `json:"redirect"`
+	Confirmed bool   `json:"confirmed"`
+}
+
+func identityKey(c context.Context, provider, subject string) *datastore.Key {
+	return datastore.NewKey(c, "Identities", provider+":"+subject, 0, nil)
+}
+
+// Id of the identity, used by the unlink API
+func (i *Identity) Id() string {
+	return i.Provider + ":" + i.Subject
+}
+
+// Random id for a new user
+func NewUserId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "U-" + hex.EncodeToString(b), nil
+}
+
+// Return the internal user id of a provider login, creating the identity
+// the first time. A new identity joins, in order: the user who started a
+// link from this session, the user with the same email if the provider
+// verified it (or if the user was created by this identity before the
+// Identities kind existed, legacyId being the id it had then), or a new
+// user. ERROR_EMAIL_NOT_VERIFIED is returned when the email belongs to
+// another user and can't be trusted, the caller must not use the email.
+func ResolveIdentity(c context.Context, cookieID, provider, subject, email string, emailVerified bool, legacyId string) (string, error) {
+	log.Infof(c, ">>>> ResolveIdentity")
+
+	email = NormalizeEmail(email)
+	key := identityKey(c, provider, subject)
+
+	var identity Identity
+	err := datastore.Get(c, key, &identity)
+	if err == nil {
+		if link := getPendingLink(c, cookieID); (link != nil) && (link.UserId != identity.UserId) {
+			log.Warningf(c, "ResolveIdentity: Link refused, %v identity already belongs to another user", provider)
+			deletePendingLink(c, cookieID)
+		}
+		identity.LastLoginTime = time.Now()
+		if email != "" {
+			identity.Email = email
+			identity.EmailVerified = emailVerified
+		}
+		if _, err := datastore.Put(c, key, &identity); err != nil {
+			log.Errorf(c, "ResolveIdentity: Error updating identity: %v", err)
+		}
+		return identity.UserId, nil
+	} else if err != datastore.ErrNoSuchEntity {
+		log.Errorf(c, "ResolveIdentity: Error getting identity: %v", err)
+		return "", err
+	}
+
+	userId := ""
+	if link := getPendingLink(c, cookieID); (link != nil) && link.Confirmed && (link.Provider == provider) {
+		log.Infof(c, "ResolveIdentity: Linking %v identity to the logged in user", provider)
+		userId = link.UserId
+	} else if email != "" {
+		existing, err := GetUserByEmail(c, email)
+		if err == nil && existing.GlobalUserId != "" {
+			if emailVerified || (existing.GlobalUserId == legacyId) {
+				log.Infof(c, "ResolveIdentity: Merging %v identity with the user of the same email", provider)
+				userId = existing.GlobalUserId
+			} else {
+				log.Warningf(c, "ResolveIdentity: Unverified email of a %v identity matches another user", provider)
+				return "", ERROR_EMAIL_NOT_VERIFIED
+			}
+		} else if err != nil && err != datastore.ErrNoSuchEntity {
+			log.Errorf(c, "ResolveIdentity: Error getting user: %v", err)
+			return "", err
+		}
+	}
+	if userId == "" {
+		if userId, err = NewUserId(); err != nil {
+			return "", err
+		}
+	}
+
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		var existing Identity
+		err := datastore.Get(tc, key, &existing)
+		if err == nil {
+			// Created by a concurrent login
+			userId = existing.UserId
+			return nil
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err = datastore.Put(tc, key, &Identity{
+			Provider:      provider,
+			Subject:       subject,
+			UserId:        userId,
+			Email:         email,
+			EmailVerified: emailVerified,
+			CreatedTime:   time.Now(),
+			LastLoginTime: time.Now(),
+		})
+		return err
+	}, nil)
+	if err != nil {
+		log.Errorf(c, "ResolveIdentity: Error storing identity: %v", err)
+		return "", err
+	}
+	deletePendingLink(c, cookieID)
+	return userId, nil
+}
+
+// List the identities of a user
+func GetUserIdentities(c context.Context, userId string) ([]Identity, error) {
+	var identities []Identity
+	q := datastore.NewQuery("Identities").Filter("UserId =", userId)
+	if _, err := q.GetAll(c, &identities); err != nil {
+		log.Errorf(c, "GetUserIdentities: Error querying identities: %v", err)
+		return nil, err
+	}
+	return identities, nil
+}
+
+// Remove an identity from a user. The last identity of a user can't be
+// removed, the user would have no way to log in.
+func UnlinkIdentity(c context.Context, userId, provider, subject string) error {
+	log.Infof(c, ">>>> UnlinkIdentity")
+
+	identities, err := GetUserIdentities(c, userId)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, i := range identities {
+		if (i.Provider == provider) && (i.Subject == subject) {
+			found = true
+		}
+	}
+	if !found {
+		return datastore.ErrNoSuchEntity
+	}
+	if len(identities) < 2 {
+		return ERROR_LAST_IDENTITY
+	}
+
+	if err := datastore.Delete(c, identityKey(c, provider, subject)); err != nil {
+		log.Errorf(c, "UnlinkIdentity: Error deleting identity: %v", err)
+		return err
+	}
+	return nil
+}
+
+func getPendingLink(c context.Context, cookieID string) *pendingLink {
+	if cookieID == "" {
+		return nil
+	}
+	var link pendingLink
+	err := common.GetObjMemCache(c, "link-"+cookieID, &link)
+	if err != nil {
+		if err != memcache.ErrCacheMiss {
+			log.Errorf(c, "getPendingLink: Error reading memcache: %v", err)
+		}
+		return nil
+	}
+	return &link
+}
+
+func deletePendingLink(c context.Context, cookieID string) {
+	if cookieID != "" {
+		common.DeleteMemCache(c, "link-"+cookieID)
+	}
+}
+
+// Check the state of a provider callback and return the path to redirect
+// to. A link state must carry the nonce of the link started by the session,
+// which is then confirmed for ResolveIdentity. Any other state is a login,
+// and drops the link of the session so that this identity isn't linked.
+func checkCallbackState(c context.Context, cookieID, provider, state string) (string, error) {
+	if !strings.HasPrefix(state, LINK_STATE_PREFIX) {
+		deletePendingLink(c, cookieID)
+		return state, nil
+	}
+	link := getPendingLink(c, cookieID)
+	if (link == nil) || (link.Provider != provider) || (link.Nonce == "") ||
+		(subtle.ConstantTimeCompare([]byte(link.Nonce), []byte(state[len(LINK_STATE_PREFIX):])) != 1) {
+		deletePendingLink(c, cookieID)
+		return "", ERROR_INVALID_STATE
+	}
+	link.Confirmed = true
+	if err := common.SetObjMemCache(c, "link-"+cookieID, link, 1); err != nil {
+		log.Errorf(c, "checkCallbackState: Error setting memcache: %v", err)
+		return "", err
+	}
+	return link.Redirect, nil
+}
+
+// Start linking another provider to the logged in user, for POST /link with
+// the csrf_token and provider=Google|Facebook. The user logs in with the
+// provider and the new identity joins the current user.
+func LinkIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> LinkIdentityHandler")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u, cookieID := GetUserAndCookieID(w, r)
+	if (u == nil) || (u.GlobalUserId == "") || (cookieID == "") {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
+	if !CheckCSRFToken(c, r, cookieID) {
+		log.Warningf(c, "LinkIdentityHandler: Invalid CSRF token")
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	provider := r.FormValue("provider")
+	tenant, err := GetTenant(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	config := tenant.OAuthConfig(provider)
+	if config == nil {
+		http.Error(w, ERROR_UNKNOWN_PROVIDER.Error(), http.StatusBadRequest)
+		return
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	link := &pendingLink{
+		UserId:   u.GlobalUserId,
+		Provider: provider,
+		Nonce:    hex.EncodeToString(nonce),
+		Redirect: localRedirect(r.FormValue("redirect")),
+	}
+	// The link is valid for an hour, the shortest memcache expiration here
+	err = common.SetObjMemCache(c, "link-"+cookieID, link, 1)
+	if err != nil {
+		log.Errorf(c, "LinkIdentityHandler: Error setting memcache: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	Audit(r, &AuditEvent{Action: AUDIT_IDENTITY_LINKED, Outcome: AUDIT_SUCCESS, Actor: u.UserEmail, Provider: provider, Details: "link started"})
+
+	// The user is read again from the new provider after the login
+	common.DeleteMemCache(c, "user-"+cookieID)
+
+	// The redirect path is kept in the link, the state only carries the nonce
+	http.Redirect(w, r, config.AuthCodeURL(LINK_STATE_PREFIX+link.Nonce), http.StatusFound)
+}
+
+// List the identities of the logged in user, for GET /identities
+func IdentitiesHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> IdentitiesHandler")
+
+	u := GetUser(w, r)
+	if (u == nil) || (u.GlobalUserId == "") {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
+
+	identities, err := GetUserIdentities(c, u.GlobalUserId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	var list []map[string]interface{}
+	for _, i := range identities {
+		list = append(list, map[string]interface{}{
+			"id":              i.Id(),
+			"provider":        i.Provider,
+			"email":           i.Email,
+			"email_verified":  i.EmailVerified,
+			"created_time":    i.CreatedTime,
+			"last_login_time": i.LastLoginTime,
+		})
+	}
+	if list == nil {
+		list = []map[string]interface{}{}
+	}
+	common.WriteJSON(w, list)
+}
+
+// Remove an identity of the logged in user, for POST /identities/unlink
+// with the csrf_token, the provider and the id returned by
+// IdentitiesHandler
+func UnlinkIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> UnlinkIdentityHandler")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u, cookieID := GetUserAndCookieID(w, r)
+	if (u == nil) || (u.GlobalUserId == "") {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
+	if (requestAPIKeyUser(r) == nil) && (requestJWTUser(r) == nil) && !CheckCSRFToken(c, r, cookieID) {
+		log.Warningf(c, "UnlinkIdentityHandler: Invalid CSRF token")
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	provider := r.FormValue("provider")
+	id := r.FormValue("id")
+	if (provider == "") || (len(id) <= len(provider)+1) || (id[:len(provider)+1] != provider+":") {
+		http.Error(w, "provider and id required", http.StatusBadRequest)
+		return
+	}
+
+	// The session would be read again from the identity, and recreate it
+	if provider == u.LoginProvider {
+		http.Error(w, "Can't unlink the identity of the current session", http.StatusConflict)
+		return
+	}
+
+	err := UnlinkIdentity(c, u.GlobalUserId, provider, id[len(provider)+1:])
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	} else if err == ERROR_LAST_IDENTITY {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	common.DeleteMemCache(c, "user-"+cookieID)
+	Audit(r, &AuditEvent{Action: AUDIT_IDENTITY_UNLINKED, Outcome: AUDIT_SUCCESS, Actor: u.UserEmail, Provider: provider})
+	common.WriteJSON(w, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,343 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/patdeg/go-appengine/common"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/jws"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Lifetime of the access tokens of the first party APIs. There is no
+	// revocation, keep it short.
+	AccessTokenExpiration = 5 * time.Minute
+
+	// Audience of the access tokens, so that id_tokens are not accepted.
+	// OIDCIssuer + "/api" when empty.
+	AccessTokenAudience = ""
+
+	// Clock difference allowed when checking the expiration
+	AccessTokenLeeway = 30 * time.Second
+
+	// How often the verification keys kept in memory are read again
+	VerificationKeysRefresh = time.Hour
+)
+
+var (
+	ERROR_INVALID_TOKEN = errors.New("Invalid token")
+	ERROR_TOKEN_EXPIRED = errors.New("Token expired")
+)
+
+// Claims of a first party access token
+type AccessTokenClaims struct {
+	Iss      string   `json:"iss"`
+	Sub      string   `json:"sub"`
+	Aud      string   `json:"aud"`
+	Exp      int64    `json:"exp"`
+	Iat      int64    `json:"iat"`
+	Email    string   `json:"email,omitempty"`
+	Name     string   `json:"name,omitempty"`
+	Provider string   `json:"provider,omitempty"`
+	Roles    []string `json:"roles,omitempty"`
+}
+
+type jwtContextKey struct{}
+
+// User and claims of a request authenticated by JWTMiddleware
+type jwtAuth struct {
+	Claims *AccessTokenClaims
+	User   *User
+}
+
+func accessTokenAudience() string {
+	if AccessTokenAudience != "" {
+		return AccessTokenAudience
+	}
+	return OIDCIssuer + "/api"
+}
+
+// Public keys of the signing keys, kept in memory by the instance so that
+// tokens are verified without reading memcache or datastore
+var verificationKeys = struct {
+	sync.RWMutex
+	keys     map[string]crypto.PublicKey
+	loadTime time.Time
+}{}
+
+// Read the public keys again from GetSigningKeys
+func loadVerificationKeys(c context.Context) error {
+	log.Infof(c, ">>>> loadVerificationKeys")
+
+	signingKeys, err := GetSigningKeys(c)
+	if err != nil {
+		return err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for i := range signingKeys {
+		signer, err := signingKeys[i].signer()
+		if err != nil {
+			log.Errorf(c, "loadVerificationKeys: Error with key %v: %v", signingKeys[i].Kid, err)
+			continue
+		}
+		keys[signingKeys[i].Kid] = signer.Public()
+	}
+
+	verificationKeys.Lock()
+	verificationKeys.keys = keys
+	verificationKeys.loadTime = time.Now()
+	verificationKeys.Unlock()
+	return nil
+}
+
+// Public key of a kid. The keys are read again when they are too old, or
+// when the kid is unknown, at most once a minute, to follow rotations.
+func getVerificationKey(c context.Context, kid string) (crypto.PublicKey, error) {
+	verificationKeys.RLock()
+	key, ok := verificationKeys.keys[kid]
+	age := time.Since(verificationKeys.loadTime)
+	verificationKeys.RUnlock()
+
+	if (ok && (age < VerificationKeysRefresh)) || (!ok && (age < time.Minute)) {
+		if !ok {
+			return nil, ERROR_INVALID_TOKEN
+		}
+		return key, nil
+	}
+
+	if err := loadVerificationKeys(c); err != nil {
+		if ok {
+			// Better a key a bit old than no API
+			return key, nil
+		}
+		return nil, err
+	}
+
+	verificationKeys.RLock()
+	key, ok = verificationKeys.keys[kid]
+	verificationKeys.RUnlock()
+	if !ok {
+		return nil, ERROR_INVALID_TOKEN
+	}
+	return key, nil
+}
+
+// Check the signature of a compact JWT made by SignJWT and return its payload
+func VerifyJWT(c context.Context, token string) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ERROR_INVALID_TOKEN
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ERROR_INVALID_TOKEN
+	}
+	var header jws.Header
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, ERROR_INVALID_TOKEN
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ERROR_INVALID_TOKEN
+	}
+
+	key, err := getVerificationKey(c, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Algorithm != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], sig) != nil {
+			return nil, ERROR_INVALID_TOKEN
+		}
+	case *ecdsa.PublicKey:
+		if header.Algorithm != "ES256" || len(sig) != 64 {
+			return nil, ERROR_INVALID_TOKEN
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, hash[:], r, s) {
+			return nil, ERROR_INVALID_TOKEN
+		}
+	default:
+		return nil, ERROR_UNKNOWN_ALGORITHM
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ERROR_INVALID_TOKEN
+	}
+	return payload, nil
+}
+
+// Sign a short lived access token with the id, email and roles of the user
+func MintAccessToken(c context.Context, u *User) (string, int64, error) {
+	log.Infof(c, ">>>> MintAccessToken")
+
+	roles, err := GetUserRoles(c, u.UserEmail)
+	if err != nil {
+		return "", 0, err
+	}
+	now := time.Now()
+	claims := &jws.ClaimSet{
+		Iss: OIDCIssuer,
+		Sub: OIDCSubject(c, u),
+		Aud: accessTokenAudience(),
+		Iat: now.Unix(),
+		Exp: now.Add(AccessTokenExpiration).Unix(),
+		PrivateClaims: map[string]interface{}{
+			"email":    u.UserEmail,
+			"provider": u.LoginProvider,
+		},
+	}
+	if u.UserName != "" {
+		claims.PrivateClaims["name"] = u.UserName
+	}
+	if len(roles) > 0 {
+		claims.PrivateClaims["roles"] = roles
+	}
+	token, err := SignJWT(c, claims)
+	if err != nil {
+		return "", 0, err
+	}
+	return token, claims.Exp - claims.Iat, nil
+}
+
+// Check an access token made by MintAccessToken
+func VerifyAccessToken(c context.Context, token string) (*AccessTokenClaims, error) {
+	payload, err := VerifyJWT(c, token)
+	if err != nil {
+		return nil, err
+	}
+	var claims AccessTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ERROR_INVALID_TOKEN
+	}
+	if (claims.Iss != OIDCIssuer) || (claims.Aud != accessTokenAudience()) || (claims.Sub == "") {
+		return nil, ERROR_INVALID_TOKEN
+	}
+	if time.Now().Add(-AccessTokenLeeway).Unix() > claims.Exp {
+		return nil, ERROR_TOKEN_EXPIRED
+	}
+	return &claims, nil
+}
+
+// Claims of a request authenticated by JWTMiddleware, nil for the others
+func RequestTokenClaims(r *http.Request) *AccessTokenClaims {
+	if a, ok := r.Context().Value(jwtContextKey{}).(*jwtAuth); ok {
+		return a.Claims
+	}
+	return nil
+}
+
+// User of a request authenticated by JWTMiddleware, nil for the others
+func requestJWTUser(r *http.Request) *User {
+	if a, ok := r.Context().Value(jwtContextKey{}).(*jwtAuth); ok {
+		return a.User
+	}
+	return nil
+}
+
+// Wrap a handler so that requests with "Authorization: Bearer <jwt>" are
+// authenticated by the access token, without memcache or datastore.
+// GetUser then returns a user built from the claims. Requests without a
+// bearer token go through unchanged, a wrong token is answered with 401.
+func JWTMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := r.Header.Get("Authorization")
+		if !strings.HasPrefix(h, "Bearer ") {
+			next(w, r)
+			return
+		}
+		c := appengine.NewContext(r)
+
+		claims, err := VerifyAccessToken(c, strings.TrimSpace(h[len("Bearer "):]))
+		if err != nil {
+			log.Infof(c, "JWTMiddleware: %v", err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		u := &User{
+			GlobalUserId:  claims.Sub,
+			UserEmail:     claims.Email,
+			UserName:      claims.Name,
+			LoginProvider: claims.Provider,
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), jwtContextKey{}, &jwtAuth{Claims: claims, User: u})))
+	}
+}
+
+// Whether the roles of the access token give the permission. Unlike
+// HasPermission, only the roles are read, from memcache.
+func (t *AccessTokenClaims) HasPermission(c context.Context, perm string) (bool, error) {
+	roles, err := GetRoles(c)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range roles {
+		if common.StringInSlice(r.Name, t.Roles) && (common.StringInSlice(PERM_ALL, r.Permissions) || common.StringInSlice(perm, r.Permissions)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Mint an access token for the user of the cookie session, for POST
+// /auth/token. Clients call it again before the token expires, as long as
+// the session is valid.
+func AccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> AccessTokenHandler")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// A token must not renew itself, the session has to be checked
+	if (RequestTokenClaims(r) != nil) || (RequestAPIKey(r) != nil) || !IsLoggedIn(r) {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
+	u, cookieID := GetUserAndCookieID(w, r)
+	if (u == nil) || (u.UserEmail == "") {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
+	// The token passes SessionSecondFactorOK on its own, the session must
+	// have entered the second factor to get one
+	if !SessionSecondFactorOK(c, r, u, cookieID) {
+		log.Warningf(c, "AccessTokenHandler: Token denied to %v without second factor", u.UserEmail)
+		http.Error(w, "Second factor required", http.StatusForbidden)
+		return
+	}
+
+	token, expiresIn, err := MintAccessToken(c, u)
+	if err != nil {
+		log.Errorf(c, "AccessTokenHandler: Error minting token: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	common.WriteJSON(w, map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   expiresIn,
+	})
+}
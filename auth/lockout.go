@@ -0,0 +1,291 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/patdeg/go-appengine/common"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/mail"
+	"google.golang.org/appengine/memcache"
+	"strings"
+	"time"
+)
+
+var (
+	// Failed passwords allowed for one account before it is locked
+	MaxLoginFailuresPerAccount = 5
+
+	// Failed passwords allowed from one IP before it is locked
+	MaxLoginFailuresPerIP = 20
+
+	// Failures older than this are forgotten
+	LoginFailureWindow = time.Minute * 15
+
+	// How long an account or an IP stays locked
+	LoginLockoutDuration = time.Minute * 15
+
+	// Number of distinct accounts failing from one IP within the window that
+	// raises a credential stuffing alert
+	CredentialStuffingThreshold = 10
+
+	// Password reset emails allowed for one account, and from one IP, within
+	// PasswordResetWindow
+	MaxPasswordResetsPerAccount = 3
+	MaxPasswordResetsPerIP      = 10
+	PasswordResetWindow         = time.Hour
+)
+
+var (
+	ERROR_TOO_MANY_ATTEMPTS = errors.New("Too many login attempts")
+)
+
+// Failed login counter for an account or an IP, stored in memcache and in
+// datastore under the kind "LoginAttempts" in case memcache is flushed.
+// Updated in a datastore transaction so that parallel failures are all
+// counted.
+type LoginAttempts struct {
+	Failures    int       `json:"failures,omitempty"`
+	FirstTime   time.Time `json:"first_time,omitempty"`
+	LastTime    time.Time `json:"last_time,omitempty"`
+	LockedUntil time.Time `json:"locked_until,omitempty"`
+	Accounts    []string  `json:"accounts,omitempty" datastore:",noindex"`
+	Alerted     bool      `json:"alerted,omitempty"`
+}
+
+func accountAttemptsKey(email string) string {
+	// Emails are hashed so that they don't appear in memcache keys
+	return "login-account-" + common.MD5(NormalizeEmail(email))
+}
+
+func ipAttemptsKey(ip string) string {
+	return "login-ip-" + ip
+}
+
+func accountResetsKey(email string) string {
+	return "reset-account-" + common.MD5(NormalizeEmail(email))
+}
+
+func ipResetsKey(ip string) string {
+	return "reset-ip-" + ip
+}
+
+func getLoginAttempts(c context.Context, key string) *LoginAttempts {
+	var a LoginAttempts
+	err := common.GetObjMemCache(c, key, &a)
+	if err == nil {
+		return &a
+	} else if err != memcache.ErrCacheMiss {
+		log.Errorf(c, "getLoginAttempts: Error reading memcache: %v", err)
+	}
+
+	err = datastore.Get(c, datastore.NewKey(c, "LoginAttempts", key, 0, nil), &a)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		log.Errorf(c, "getLoginAttempts: Error reading datastore: %v", err)
+	}
+	return &a
+}
+
+// Apply update to the counter in a transaction, and cache the result
+func updateLoginAttempts(c context.Context, key string, update func(a *LoginAttempts)) *LoginAttempts {
+	var a LoginAttempts
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		dsKey := datastore.NewKey(tc, "LoginAttempts", key, 0, nil)
+		a = LoginAttempts{}
+		if err := datastore.Get(tc, dsKey, &a); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		update(&a)
+		_, err := datastore.Put(tc, dsKey, &a)
+		return err
+	}, nil)
+	if err != nil {
+		log.Errorf(c, "updateLoginAttempts: Error storing in datastore: %v", err)
+		return nil
+	}
+	if err := common.SetObjMemCache(c, key, &a, 1); err != nil {
+		log.Errorf(c, "updateLoginAttempts: Error setting memcache: %v", err)
+	}
+	return &a
+}
+
+// Count an attempt in the memcache counter of the key, shared by the
+// parallel requests, and return the incremented value. The counter is
+// created for LoginFailureWindow.
+func incrementLoginTries(c context.Context, key string) (uint64, error) {
+	memcache.Add(c, &memcache.Item{Key: key + "-tries", Value: []byte("0"), Expiration: LoginFailureWindow})
+	return memcache.Increment(c, key+"-tries", 1, 0)
+}
+
+func deleteLoginAttempts(c context.Context, key string) {
+	common.DeleteMemCache(c, key)
+	common.DeleteMemCache(c, key+"-tries")
+	if err := datastore.Delete(c, datastore.NewKey(c, "LoginAttempts", key, 0, nil)); err != nil && err != datastore.ErrNoSuchEntity {
+		log.Errorf(c, "deleteLoginAttempts: Error deleting from datastore: %v", err)
+	}
+}
+
+// Minimum time between two attempts after n failures: none for the first two
+// failures, then 1s, 2s, 4s... up to 30s
+func loginDelay(failures int) time.Duration {
+	if failures < 3 {
+		return 0
+	}
+	if failures > 8 {
+		return time.Second * 30
+	}
+	return time.Second << uint(failures-3)
+}
+
+// Time to wait before the next attempt, zero if the attempt is allowed
+func (a *LoginAttempts) retryAfter(now time.Time) time.Duration {
+	if now.Before(a.LockedUntil) {
+		return a.LockedUntil.Sub(now)
+	}
+	if next := a.LastTime.Add(loginDelay(a.Failures)); now.Before(next) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+// Start a new window when the previous one is over
+func (a *LoginAttempts) reset(now time.Time) {
+	if now.Sub(a.FirstTime) > LoginFailureWindow && now.After(a.LockedUntil) {
+		*a = LoginAttempts{}
+	}
+}
+
+// Check whether a password can be tried for this email from this IP. Returns
+// ERROR_TOO_MANY_ATTEMPTS and the time to wait if the account or the IP is
+// locked or if the attempt comes too soon after the previous failure.
+// Each allowed call counts as an attempt until the window is over or the
+// login succeeds, so that parallel requests can't try more passwords than
+// the limits while their failures are not recorded yet.
+func CheckLoginAllowed(c context.Context, email, ip string) (time.Duration, error) {
+	now := time.Now()
+	wait := getLoginAttempts(c, accountAttemptsKey(email)).retryAfter(now)
+	if ipWait := getLoginAttempts(c, ipAttemptsKey(ip)).retryAfter(now); ipWait > wait {
+		wait = ipWait
+	}
+	if wait == 0 {
+		if n, err := incrementLoginTries(c, accountAttemptsKey(email)); err != nil {
+			log.Errorf(c, "CheckLoginAllowed: Error counting attempt: %v", err)
+		} else if n > uint64(MaxLoginFailuresPerAccount) {
+			wait = LoginFailureWindow
+		}
+		if n, err := incrementLoginTries(c, ipAttemptsKey(ip)); err != nil {
+			log.Errorf(c, "CheckLoginAllowed: Error counting attempt: %v", err)
+		} else if n > uint64(MaxLoginFailuresPerIP) {
+			wait = LoginFailureWindow
+		}
+	}
+	if wait > 0 {
+		log.Warningf(c, "CheckLoginAllowed: Attempt from %v rejected, retry after %v", ip, wait)
+		return wait, ERROR_TOO_MANY_ATTEMPTS
+	}
+	return 0, nil
+}
+
+// Count a password reset request for the email and the IP, whether the
+// account exists or not. Returns ERROR_TOO_MANY_ATTEMPTS and the time to
+// wait once MaxPasswordResetsPerAccount or MaxPasswordResetsPerIP requests
+// were made within PasswordResetWindow.
+func CheckPasswordResetAllowed(c context.Context, email, ip string) (time.Duration, error) {
+	now := time.Now()
+	wait := time.Duration(0)
+	count := func(key string, max int) {
+		a := updateLoginAttempts(c, key, func(a *LoginAttempts) {
+			if now.Sub(a.FirstTime) > PasswordResetWindow {
+				*a = LoginAttempts{FirstTime: now}
+			}
+			a.Failures++
+			a.LastTime = now
+		})
+		if (a != nil) && (a.Failures > max) {
+			if w := a.FirstTime.Add(PasswordResetWindow).Sub(now); w > wait {
+				wait = w
+			}
+		}
+	}
+	count(accountResetsKey(email), MaxPasswordResetsPerAccount)
+	count(ipResetsKey(ip), MaxPasswordResetsPerIP)
+	if wait > 0 {
+		log.Warningf(c, "CheckPasswordResetAllowed: Reset from %v rejected, retry after %v", ip, wait)
+		return wait, ERROR_TOO_MANY_ATTEMPTS
+	}
+	return 0, nil
+}
+
+// Count a failed password for the account and the IP
+func RecordLoginFailure(c context.Context, email, ip string) {
+	now := time.Now()
+	email = NormalizeEmail(email)
+
+	account := updateLoginAttempts(c, accountAttemptsKey(email), func(a *LoginAttempts) {
+		a.reset(now)
+		if a.Failures == 0 {
+			a.FirstTime = now
+		}
+		a.Failures++
+		a.LastTime = now
+		if a.Failures >= MaxLoginFailuresPerAccount {
+			a.LockedUntil = now.Add(LoginLockoutDuration)
+		}
+	})
+	if account != nil && account.LockedUntil.After(now) {
+		log.Warningf(c, "RecordLoginFailure: Account locked after %v failures", account.Failures)
+	}
+
+	hash := common.MD5(email)
+	alert := false
+	a := updateLoginAttempts(c, ipAttemptsKey(ip), func(a *LoginAttempts) {
+		a.reset(now)
+		if a.Failures == 0 {
+			a.FirstTime = now
+		}
+		a.Failures++
+		a.LastTime = now
+		if !common.StringInSlice(hash, a.Accounts) {
+			a.Accounts = append(a.Accounts, hash)
+		}
+		if a.Failures >= MaxLoginFailuresPerIP {
+			a.LockedUntil = now.Add(LoginLockoutDuration)
+		}
+		// The transaction can run more than once
+		alert = (len(a.Accounts) >= CredentialStuffingThreshold) && !a.Alerted
+		if alert {
+			a.Alerted = true
+		}
+	})
+	if a != nil && a.LockedUntil.After(now) {
+		log.Warningf(c, "RecordLoginFailure: IP %v locked after %v failures", ip, a.Failures)
+	}
+	if alert && a != nil {
+		alertCredentialStuffing(c, ip, a)
+	}
+}
+
+// Forget the failures of the account after a successful login, and don't
+// count its attempt against the IP
+func RecordLoginSuccess(c context.Context, email, ip string) {
+	deleteLoginAttempts(c, accountAttemptsKey(email))
+	if _, err := memcache.Increment(c, ipAttemptsKey(ip)+"-tries", -1, 0); err != nil && err != memcache.ErrCacheMiss {
+		log.Errorf(c, "RecordLoginSuccess: Error updating attempts: %v", err)
+	}
+}
+
+func alertCredentialStuffing(c context.Context, ip string, a *LoginAttempts) {
+	log.Criticalf(c, "Possible credential stuffing from %v: %v failures on %v accounts since %v",
+		ip, a.Failures, len(a.Accounts), a.FirstTime)
+
+	msg := &mail.Message{
+		Sender:  EmailSender,
+		Subject: "Possible credential stuffing from " + ip,
+		Body: fmt.Sprintf("There were %v failed logins on %v different accounts from %v between %v and %v.\n\nAccounts (MD5): %v",
+			a.Failures, len(a.Accounts), ip, a.FirstTime, a.LastTime, strings.Join(a.Accounts, ", ")),
+	}
+	if err := mail.SendToAdmins(c, msg); err != nil {
+		log.Errorf(c, "Couldn't send credential stuffing alert: %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/RangelReale/osin"
+	"github.com/patdeg/go-appengine/common"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	// Facebook has no revocation of a single token, the permissions of the
+	// app are removed instead. The user is asked to accept them again at the
+	// next login.
+	RevokeFacebookPermissionsOnLogout = true
+
+	// Logout pages of the providers, to chain to after the local logout
+	// when logout is called with provider_logout=1. For example
+	// "Google": "https://accounts.google.com/Logout". Empty by default,
+	// logging out of the provider logs the user out of all its sites.
+	ProviderLogoutURLs = map[string]string{}
+)
+
+var ERROR_INVALID_LOGOUT_REQUEST = errors.New("Invalid logout request")
+
+// Revoke a token at the provider, so that it can't be used any more even if
+// it was copied
+func RevokeProviderToken(c context.Context, provider, token string) error {
+	log.Infof(c, ">>>> RevokeProviderToken")
+
+	if token == "" {
+		return nil
+	}
+	client := urlfetch.Client(c)
+	var resp *http.Response
+	var err error
+	switch provider {
+	case "Google":
+		// Revoking the refresh token revokes its access tokens too
+		var tok oauth2.Token
+		if common.GetObjMemCache(c, "g-token-"+token, &tok) == nil && tok.RefreshToken != "" {
+			token = tok.RefreshToken
+		}
+		resp, err = client.PostForm("https://oauth2.googleapis.com/revoke", url.Values{"token": {token}})
+	case "Facebook":
+		if !RevokeFacebookPermissionsOnLogout {
+			return nil
+		}
+		req, reqErr := http.NewRequest("DELETE", "https://graph.facebook.com/me/permissions?access_token="+url.QueryEscape(token), nil)
+		if reqErr != nil {
+			return reqErr
+		}
+		resp, err = client.Do(req)
+	default:
+		return nil
+	}
+	if err != nil {
+		log.Errorf(c, "RevokeProviderToken: Error revoking %v token: %v", provider, err)
+		return err
+	}
+	defer resp.Body.Close()
+	// Google answers 400 for a token already expired or revoked
+	if (resp.StatusCode != http.StatusOK) && (resp.StatusCode != http.StatusBadRequest) {
+		log.Errorf(c, "RevokeProviderToken: %v answered %v", provider, resp.Status)
+		return fmt.Errorf("%v answered %v", provider, resp.Status)
+	}
+	return nil
+}
+
+// Revoke the provider token of a session and remove it from memcache
+func endSession(c context.Context, cookieID, provider, token string) {
+	if token != "" {
+		RevokeProviderToken(c, provider, token)
+		common.DeleteMemCache(c, "g-token-"+token)
+		common.DeleteMemCache(c, "fb-token-"+token)
+	}
+	if cookieID != "" {
+		common.DeleteMemCache(c, "user-"+cookieID)
+		forgetCookieToken(c, cookieID)
+		forgetSecondFactorSession(c, cookieID)
+	}
+}
+
+// End all the sessions of a user, in every browser: the tokens recorded
+// with the cookies of the user are revoked at the provider and the cached
+// users removed. Returns the number of sessions ended.
+func LogoutEverywhere(c context.Context, userId string) (int, error) {
+	log.Infof(c, ">>>> LogoutEverywhere")
+
+	if userId == "" {
+		return 0, nil
+	}
+	var cookies []UserCookie
+	_, err := datastore.NewQuery("UserCookies").Filter("UserId =", userId).GetAll(c, &cookies)
+	if err != nil {
+		log.Errorf(c, "LogoutEverywhere: Error querying cookies: %v", err)
+		return 0, err
+	}
+
+	n := 0
+	for _, uc := range cookies {
+		token := ""
+		if uc.AccessToken != "" {
+			token = common.Decrypt(c, "", uc.AccessToken)
+		}
+		// The cached user holds the latest token of the session
+		var u User
+		if common.GetObjMemCache(c, "user-"+uc.Cookie, &u) == nil && u.AccessToken != "" && u.AccessToken != token {
+			endSession(c, "", u.LoginProvider, u.AccessToken)
+		}
+		if (token != "") || (u.AccessToken != "") {
+			n++
+		}
+		endSession(c, uc.Cookie, uc.Provider, token)
+	}
+	return n, nil
+}
+
+// Local path to go to after the logout, "/" for anything else
+func localRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return "/"
+	}
+	return redirect
+}
+
+// Claims of an id_token made by MintIDToken, signature checked. The
+// expiration is not checked, a logout can come long after the login.
+func idTokenHintClaims(c context.Context, idToken string) (map[string]interface{}, error) {
+	payload, err := VerifyJWT(c, idToken)
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ERROR_INVALID_TOKEN
+	}
+	if iss, _ := claims["iss"].(string); iss != OIDCIssuer {
+		return nil, ERROR_INVALID_TOKEN
+	}
+	return claims, nil
+}
+
+// OpenID Connect RP-initiated logout, for /oauth2/logout with
+// id_token_hint, post_logout_redirect_uri and state. The local session is
+// ended and the user sent back to the client, if the redirect uri is one
+// of the client's.
+// https://openid.net/specs/openid-connect-rpinitiated-1_0.html
+func OIDCEndSessionHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> OIDCEndSessionHandler")
+
+	if oauth2Server == nil {
+		start(c)
+	}
+
+	redirect := ""
+	if uri := r.FormValue("post_logout_redirect_uri"); uri != "" {
+		clientId := r.FormValue("client_id")
+		if hint := r.FormValue("id_token_hint"); hint != "" {
+			claims, err := idTokenHintClaims(c, hint)
+			if err != nil {
+				log.Warningf(c, "OIDCEndSessionHandler: Invalid id_token_hint: %v", err)
+				http.Error(w, ERROR_INVALID_LOGOUT_REQUEST.Error(), http.StatusBadRequest)
+				return
+			}
+			aud, _ := claims["aud"].(string)
+			if (clientId != "") && (clientId != aud) {
+				http.Error(w, ERROR_INVALID_LOGOUT_REQUEST.Error(), http.StatusBadRequest)
+				return
+			}
+			clientId = aud
+		}
+		if clientId == "" {
+			http.Error(w, "id_token_hint or client_id required with post_logout_redirect_uri", http.StatusBadRequest)
+			return
+		}
+		client, err := oauth2Server.server.Storage.GetClient(clientId)
+		if err != nil {
+			http.Error(w, ERROR_INVALID_LOGOUT_REQUEST.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := osin.ValidateUriList(client.GetRedirectUri(), uri, oauth2Server.server.Config.RedirectUriSeparator); err != nil {
+			log.Warningf(c, "OIDCEndSessionHandler: Redirect uri not allowed for %v: %v", clientId, uri)
+			http.Error(w, ERROR_INVALID_LOGOUT_REQUEST.Error(), http.StatusBadRequest)
+			return
+		}
+		redirect = uri
+		if state := r.FormValue("state"); state != "" {
+			sep := "?"
+			if strings.Contains(uri, "?") {
+				sep = "&"
+			}
+			redirect += sep + "state=" + url.QueryEscape(state)
+		}
+	}
+
+	logout(c, w, r, false)
+
+	if redirect == "" {
+		common.MessageHandler(c, w, "You are signed out.", "/", 5)
+		return
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// End the session of the request, or all the sessions of the user. Returns
+// the user who was logged in, nil if nobody.
+func logout(c context.Context, w http.ResponseWriter, r *http.Request, everywhere bool) *User {
+	var u *User
+	cookieID := common.GetCookieID(w, r)
+	if cookieID != "" {
+		var cached User
+		if common.GetObjMemCache(c, "user-"+cookieID, &cached) == nil {
+			u = &cached
+		}
+	}
+	token, provider := "", ""
+	if u != nil {
+		token, provider = u.AccessToken, u.LoginProvider
+	} else {
+		token, provider = GetCookieToken(r)
+	}
+
+	if everywhere {
+		if (u == nil) && (token != "") {
+			u = GetUser(w, r)
+		}
+		if u != nil {
+			if n, err := LogoutEverywhere(c, u.GlobalUserId); err == nil {
+				log.Infof(c, "logout: %v sessions ended", n)
+			}
+		}
+	}
+	endSession(c, cookieID, provider, token)
+	clearTokenCookies(w, r)
+
+	actor := ""
+	if u != nil {
+		actor = u.UserEmail
+	}
+	details := ""
+	if everywhere {
+		details = "everywhere"
+	}
+	Audit(r, &AuditEvent{Action: AUDIT_LOGOUT, Outcome: AUDIT_SUCCESS, Actor: actor, Provider: provider, Details: details})
+	return u
+}
@@ -12,8 +12,9 @@ var DeglonConfig = &oauth2.Config{
 	ClientID:     "my_client",
 	ClientSecret: "my_secret",
 	Scopes: []string{
-		"https://www.googleapis.com/auth/userinfo.email",
-		"https://www.googleapis.com/auth/userinfo.profile",
+		"openid",
+		"email",
+		"profile",
 	},
 	RedirectURL: "https://myapp.appspot.com/oauth2/callback",
 	Endpoint: oauth2.Endpoint{
@@ -45,11 +46,17 @@ func OAuth2CallbackTestHandler(w http.ResponseWriter, r *http.Request) {
 	state := r.FormValue("state")
 	errorMessage := r.FormValue("error")
 
-	log.Infof(c, "code: %v", code)
+	tenant, err := GetTenant(r)
+	if err != nil {
+		log.Warningf(c, "%v: %v", r.Host, err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
 	log.Infof(c, "state: %v", state)
 	if errorMessage != "" {
 		log.Errorf(c, "Error while authentification: %v", errorMessage)
-		url := "http://" + r.Host
+		url := tenant.URL("/")
 		log.Infof(c, "Redirect to %v", url)
 		http.Redirect(w, r, url, http.StatusFound)
 		return
@@ -64,14 +71,12 @@ func OAuth2CallbackTestHandler(w http.ResponseWriter, r *http.Request) {
 
 	token := tok.AccessToken
 	log.Infof(c, "Token Exchanged:")
-	log.Infof(c, "  - AccessToken: %v", tok.AccessToken)
-	log.Infof(c, "  - RefreshToken: %v", tok.RefreshToken)
+	log.Infof(c, "  - HasRefreshToken: %v", tok.RefreshToken != "")
 	log.Infof(c, "  - Expiry: %v", tok.Expiry)
 
 	cookieValue := common.Encrypt(c, r.RemoteAddr, token)
-	log.Debugf(c, "cookie value = %v", cookieValue)
 
-	SetCookieToken(c, w, "Deglon", r.Host, cookieValue, 1, false)
+	SetCookieToken(c, w, "Deglon", tenant.Host, cookieValue, 1, tenant.SecureCookies())
 
 	err = common.SetObjMemCache(c, "d-token-"+tok.AccessToken, &tok, 24)
 	if err != nil {
@@ -100,7 +105,7 @@ func OAuth2CallbackTestHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	url := "http://" + r.Host + state
+	url := tenant.URL(localRedirect(state))
 
 	log.Infof(c, "Redirect to %v", url)
 	http.Redirect(w, r, url, http.StatusFound)
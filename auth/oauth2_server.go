@@ -3,7 +3,6 @@ package auth
 // https://github.com/RangelReale/osin
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,10 +10,9 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/mail"
 	"html/template"
 	"net/http"
-	"net/url"
+	"time"
 )
 
 type Oauth2Server struct {
@@ -47,11 +45,12 @@ func start(c context.Context) {
 }
 
 func isPasswordGood(c context.Context, username string, password string) bool {
-
-	if (username == "test") && (password == "test") {
-		return true
+	_, err := CheckLocalPassword(c, username, password)
+	if err != nil {
+		log.Infof(c, "isPasswordGood: %v", err)
+		return false
 	}
-	return false
+	return true
 }
 
 var loginHTML = `<html>
@@ -80,7 +79,8 @@ var loginHTML = `<html>
 						<img src="/img/logo.png" height="40" alt="Deglon Consulting" />						
 					</p>
 					<h2>Sign in to continue to [[.ClientId]]</h2>		
-					<form method="POST" action="https://[[.Server]]/oauth2/auth?response_type=[[.Type]]&client_id=[[.ClientId]]&state=[[.State]]&redirect_uri=[[.Redirect]]">
+					[[if .Error]]<div class="alert alert-danger">[[.Error]]</div>[[end]]
+					<form method="POST" action="https://[[.Server]]/oauth2/auth?response_type=[[.Type]]&client_id=[[.ClientId]]&state=[[.State]]&redirect_uri=[[.Redirect]]&scope=[[.Scope]]&nonce=[[.Nonce]]">
 						<div class="form-group" ng-show="create_account_mode">
 							<label for="name">Your Name</label>							
 	    					<input type="text" class="form-control" id="name" name="name" placeholder="Enter your name" ng-model="user.name">
@@ -123,6 +123,9 @@ var loginHTML = `<html>
 					<p ng-hide="create_account_mode" style="text-align:center">
   						<button class="btn btn-info" style="width:200px" ng-click="create_account_mode=true">Create Account</button>
   					</p>
+					<p ng-hide="create_account_mode" style="text-align:center">
+						<a href="/oauth2/forgot">Forgot your password?</a>
+					</p>
 				</div>
 			</div>
 		</div>
@@ -202,7 +205,7 @@ var emailHTML = `<html>
 					line-height:18px;
 				">
 					Hi [[.Name]]<BR><BR>
-					You just tried to login to [[.Service]] and requested to create an account. To finalize this process, we need to verify your email [[.Email]]. Please click on the link bellow to finish the process:.<BR>
+					[[.Message]]<BR>
 				</p>
 
 				<p style="color:black;
@@ -241,10 +244,6 @@ func HandleLoginPage(ar *osin.AuthorizeRequest, w http.ResponseWriter, r *http.R
 
 	r.ParseForm()
 
-	for k, v := range r.Form {
-		log.Debugf(c, "%v: %v", k, v)
-	}
-
 	email := r.FormValue("email")
 	password := r.FormValue("password")
 	name := r.FormValue("name")
@@ -252,71 +251,90 @@ func HandleLoginPage(ar *osin.AuthorizeRequest, w http.ResponseWriter, r *http.R
 	clientId := ar.Client.GetId()
 
 	log.Infof(c, "Email: %v", email)
-	log.Infof(c, "Password: %v", password)
 	log.Infof(c, "Name: %v", name)
 	log.Infof(c, "NewAccount: %v", newAccount)
 
+	loginError := ""
+
+	if (r.Method == "POST") && (r.FormValue("mfa_ticket") != "") {
+		return handleSecondFactor(c, ar, w, r)
+	}
+
 	if (r.Method == "POST") && (email != "") {
 
 		if newAccount != "" {
 			log.Infof(c, "New Account Mode")
 
-			buf := new(bytes.Buffer)
-			if err := emailTemplate.Execute(buf, template.FuncMap{
-				"Email":   email,
-				"Name":    name,
-				"Service": clientId,
-				"URL":     fmt.Sprintf("https://myapp.appspot.com/oauth2/validate?email=%v&code=%v", email, "12345"),
-			}); err != nil {
-				log.Errorf(c, "emailTemplate: %v", err)
-				http.Error(w, "emailTemplate error:"+err.Error(), http.StatusInternalServerError)
-				return true
+			if password != r.FormValue("password2") {
+				loginError = "The second password doesn't match the first."
+			} else if err := SignUpLocalAccount(c, email, name, password, clientId); err == ERROR_PASSWORD_TOO_SHORT || err == ERROR_PASSWORD_TOO_LONG {
+				loginError = "Use between 5 and 72 characters in your password."
+			} else if err != nil {
+				log.Errorf(c, "Error creating account: %v", err)
+				http.Error(w, "Couldn't create account", http.StatusInternalServerError)
+				return false
+			} else {
+				Audit(r, &AuditEvent{Action: AUDIT_ACCOUNT_CREATED, Outcome: AUDIT_SUCCESS, Actor: email, Provider: "Deglon", ClientId: clientId})
+				if err := validateTemplate.Execute(w, template.FuncMap{
+					"Name":  name,
+					"Email": email,
+				}); err != nil {
+					log.Infof(c, "Error with validateTemplate: %v", err)
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				}
+				return false
 			}
 
-			msg := &mail.Message{
-				Sender: "myemail@gmail.com",
-				To:     []string{email},
-				Subject:  "Please verify your email for " + clientId,
-				HTMLBody: buf.String(),
-			}
-			if err := mail.Send(c, msg); err != nil {
-				log.Errorf(c, "Couldn't send email: %v", err)
-				http.Error(w, "Couldn't send email:"+err.Error(), http.StatusInternalServerError)
-				return true
-			}
-			log.Infof(c, "Email sent to %v", email)
-
-			if err := validateTemplate.Execute(w, template.FuncMap{
-				"Name":  name,
-				"Email": email,
-			}); err != nil {
-				log.Infof(c, "Error with validateTemplate: %v", err)
+		} else if wait, err := CheckLoginAllowed(c, email, r.RemoteAddr); err != nil {
+			Audit(r, &AuditEvent{Action: AUDIT_LOGIN, Outcome: AUDIT_DENIED, Actor: email, Provider: "Deglon", ClientId: clientId, Details: "locked out"})
+			loginError = fmt.Sprintf("Too many failed attempts, please try again in %v.", wait.Truncate(time.Second)+time.Second)
+		} else if isPasswordGood(c, email, password) {
+			log.Infof(c, "Login Correct")
+			// The failures are only forgotten once the second factor is checked
+			if required, err := IsSecondFactorRequired(c, email); err != nil {
 				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-				return true
+				return false
+			} else if required {
+				Audit(r, &AuditEvent{Action: AUDIT_LOGIN, Outcome: AUDIT_SUCCESS, Actor: email, Provider: "Deglon", ClientId: clientId, Details: "second factor required"})
+				renderSecondFactorPage(c, ar, w, r, email, "")
+				return false
 			}
-			return false
-		}
-
-		if isPasswordGood(c, email, password) {
-			log.Infof(c, "Login Correct")
+			RecordLoginSuccess(c, email, r.RemoteAddr)
+			Audit(r, &AuditEvent{Action: AUDIT_LOGIN, Outcome: AUDIT_SUCCESS, Actor: email, Provider: "Deglon", ClientId: clientId})
 			return true
+		} else {
+			RecordLoginFailure(c, email, r.RemoteAddr)
+			Audit(r, &AuditEvent{Action: AUDIT_LOGIN, Outcome: AUDIT_FAILURE, Actor: email, Provider: "Deglon", ClientId: clientId})
+			loginError = "Wrong email or password, or email not verified yet."
 		}
 
 	}
 
-	if err := loginTemplate.Execute(w, template.FuncMap{
+	renderLoginPage(c, ar, w, r, loginError)
+	return false
+}
+
+// Parameters of the authorize request, repeated in the action of the login
+// forms. The values are raw, html/template escapes them in the query.
+func loginFormData(ar *osin.AuthorizeRequest, r *http.Request) template.FuncMap {
+	return template.FuncMap{
 		"ClientId": ar.Client.GetId(),
 		"Type":     ar.Type,
 		"State":    ar.State,
-		"Redirect": url.QueryEscape(ar.RedirectUri),
+		"Redirect": ar.RedirectUri,
+		"Scope":    ar.Scope,
+		"Nonce":    r.FormValue("nonce"),
 		"Server":   "myapp.appspot.com",
-	}); err != nil {
+	}
+}
+
+func renderLoginPage(c context.Context, ar *osin.AuthorizeRequest, w http.ResponseWriter, r *http.Request, loginError string) {
+	data := loginFormData(ar, r)
+	data["Error"] = loginError
+	if err := loginTemplate.Execute(w, data); err != nil {
 		log.Infof(c, "Error with loginTemplate: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return true
 	}
-
-	return false
 }
 
 func DownloadAccessToken(url string, auth *osin.BasicAuth, output map[string]interface{}) error {
@@ -361,13 +379,45 @@ func OAuth2AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
 	if ar := oauth2Server.server.HandleAuthorizeRequest(resp, r); ar != nil {
 		log.Debugf(c, "Finished HandleAuthorizeRequest...")
 
-		if !HandleLoginPage(ar, w, r) {
-			log.Debugf(c, "HandleLoginPage return false, exiting")
+		if err := ValidateScopes(ar.Client, ar.Scope); err != nil {
+			log.Infof(c, "Invalid scope requested: %v", ar.Scope)
+			resp.SetErrorState(osin.E_INVALID_SCOPE, "", ar.State)
+			osin.OutputJSON(resp, w, r)
 			return
 		}
-		log.Debugf(c, "HandleLoginPage return true")
 
-		ar.Authorized = true
+		email := ""
+		allowed := true
+		if (r.Method == "POST") && (r.FormValue("consent_ticket") != "") {
+			email, allowed = handleConsent(c, ar, w, r)
+			if email == "" {
+				return
+			}
+		} else {
+			if !HandleLoginPage(ar, w, r) {
+				log.Debugf(c, "HandleLoginPage return false, exiting")
+				return
+			}
+			log.Debugf(c, "HandleLoginPage return true")
+
+			email = NormalizeEmail(r.FormValue("email"))
+			identifyLocalLogin(w, r, email)
+			if required, err := IsConsentRequired(c, email, ar.Client, ar.Scope); err != nil {
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			} else if required {
+				renderConsentPage(c, ar, w, r, email)
+				return
+			}
+		}
+
+		ar.UserData = &OIDCUserData{
+			Email:         email,
+			EmailVerified: IsLocalAccountVerified(c, email),
+			Nonce:         r.FormValue("nonce"),
+			AuthTime:      time.Now(),
+		}
+		ar.Authorized = allowed
 		oauth2Server.server.FinishAuthorizeRequest(resp, r, ar)
 		log.Debugf(c, "Finished FinishAuthorizeRequest")
 	}
@@ -388,8 +438,33 @@ func OAuth2TokenHandler(w http.ResponseWriter, r *http.Request) {
 	defer resp.Close()
 
 	if ar := oauth2Server.server.HandleAccessRequest(resp, r); ar != nil {
+		// The access of a refresh token may have been revoked on another
+		// instance, by a password change or the removal of the client
 		ar.Authorized = true
+		if (ar.Type == osin.REFRESH_TOKEN) && IsAccessRevoked(c, ar.AccessData) {
+			log.Infof(c, "OAuth2TokenHandler: Refresh token revoked")
+			ar.Authorized = false
+		}
 		oauth2Server.server.FinishAccessRequest(resp, r, ar)
+
+		actor := ""
+		if data, ok := ar.UserData.(*OIDCUserData); ok {
+			actor = data.Email
+		}
+		Audit(r, &AuditEvent{Action: AUDIT_TOKEN_EXCHANGE, Outcome: auditOutcome(!resp.IsError), Actor: actor, ClientId: ar.Client.GetId(), Details: string(ar.Type)})
+
+		if !resp.IsError && hasScope(ar.Scope, "openid") {
+			u, data, err := oidcUserFromData(c, ar.UserData)
+			if err != nil {
+				log.Errorf(c, "OAuth2TokenHandler: Error getting user for id_token: %v", err)
+				resp.SetError(osin.E_SERVER_ERROR, "")
+			} else if idToken, err := MintIDToken(c, u, ar.Client.GetId(), data, ar.Scope); err != nil {
+				log.Errorf(c, "OAuth2TokenHandler: Error signing id_token: %v", err)
+				resp.SetError(osin.E_SERVER_ERROR, "")
+			} else {
+				resp.Output["id_token"] = idToken
+			}
+		}
 	}
 	osin.OutputJSON(resp, w, r)
 }
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/RangelReale/osin"
+	"sync"
 )
 
 var (
@@ -13,7 +14,9 @@ var (
 	REFRESH_NOT_FOUND   = errors.New("Refresh not found")
 )
 
+// In memory storage of the OAuth2 server, shared by the concurrent requests
 type MyStorage struct {
+	mu        sync.RWMutex
 	clients   map[string]osin.Client
 	authorize map[string]*osin.AuthorizeData
 	access    map[string]*osin.AccessData
@@ -32,6 +35,10 @@ func NewMyStorage() *MyStorage {
 		Id:          "test",
 		Secret:      "mysecret",
 		RedirectUri: "https://myapp.appspot.com/oauth2/callback",
+		UserData: &ClientInfo{
+			Name:    "My App",
+			Trusted: true,
+		},
 	}
 
 	return r
@@ -46,6 +53,8 @@ func (s *MyStorage) Close() {
 
 func (s *MyStorage) GetClient(id string) (osin.Client, error) {
 	fmt.Printf("GetClient: %s\n", id)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	if c, ok := s.clients[id]; ok {
 		return c, nil
 	}
@@ -54,18 +63,22 @@ func (s *MyStorage) GetClient(id string) (osin.Client, error) {
 
 func (s *MyStorage) SetClient(id string, client osin.Client) error {
 	fmt.Printf("SetClient: %s\n", id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.clients[id] = client
 	return nil
 }
 
 func (s *MyStorage) SaveAuthorize(data *osin.AuthorizeData) error {
-	fmt.Printf("SaveAuthorize: %s\n", data.Code)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.authorize[data.Code] = data
 	return nil
 }
 
 func (s *MyStorage) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
-	fmt.Printf("LoadAuthorize: %s\n", code)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	if d, ok := s.authorize[code]; ok {
 		return d, nil
 	}
@@ -73,13 +86,15 @@ func (s *MyStorage) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
 }
 
 func (s *MyStorage) RemoveAuthorize(code string) error {
-	fmt.Printf("RemoveAuthorize: %s\n", code)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	delete(s.authorize, code)
 	return nil
 }
 
 func (s *MyStorage) SaveAccess(data *osin.AccessData) error {
-	fmt.Printf("SaveAccess: %s\n", data.AccessToken)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.access[data.AccessToken] = data
 	if data.RefreshToken != "" {
 		s.refresh[data.RefreshToken] = data.AccessToken
@@ -88,7 +103,8 @@ func (s *MyStorage) SaveAccess(data *osin.AccessData) error {
 }
 
 func (s *MyStorage) LoadAccess(code string) (*osin.AccessData, error) {
-	fmt.Printf("LoadAccess: %s\n", code)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	if d, ok := s.access[code]; ok {
 		return d, nil
 	}
@@ -96,21 +112,59 @@ func (s *MyStorage) LoadAccess(code string) (*osin.AccessData, error) {
 }
 
 func (s *MyStorage) RemoveAccess(code string) error {
-	fmt.Printf("RemoveAccess: %s\n", code)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	delete(s.access, code)
 	return nil
 }
 
 func (s *MyStorage) LoadRefresh(code string) (*osin.AccessData, error) {
-	fmt.Printf("LoadRefresh: %s\n", code)
-	if d, ok := s.refresh[code]; ok {
-		return s.LoadAccess(d)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if token, ok := s.refresh[code]; ok {
+		if d, ok := s.access[token]; ok {
+			return d, nil
+		}
+		return nil, ACCESS_NOT_FOUND
 	}
 	return nil, REFRESH_NOT_FOUND
 }
 
 func (s *MyStorage) RemoveRefresh(code string) error {
-	fmt.Printf("RemoveRefresh: %s\n", code)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	delete(s.refresh, code)
 	return nil
 }
+
+// Remove the authorizations and tokens granted to the user with this email
+func (s *MyStorage) RemoveUserData(email string) {
+	s.RemoveClientUserData(email, "")
+}
+
+// Remove the authorizations and tokens granted by the user to one client,
+// to every client if clientId is empty
+func (s *MyStorage) RemoveClientUserData(email string, clientId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	isUser := func(client osin.Client, userData interface{}) bool {
+		if clientId != "" && (client == nil || client.GetId() != clientId) {
+			return false
+		}
+		data, ok := userData.(*OIDCUserData)
+		return ok && data != nil && data.Email == email
+	}
+	for code, d := range s.authorize {
+		if isUser(d.Client, d.UserData) {
+			delete(s.authorize, code)
+		}
+	}
+	for token, d := range s.access {
+		if isUser(d.Client, d.UserData) {
+			delete(s.access, token)
+			if d.RefreshToken != "" {
+				delete(s.refresh, d.RefreshToken)
+			}
+		}
+	}
+}
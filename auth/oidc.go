@@ -0,0 +1,585 @@
+package auth
+
+// OpenID Connect provider on top of the osin OAuth2 server.
+// http://openid.net/specs/openid-connect-core-1_0.html
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"github.com/patdeg/go-appengine/common"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/jws"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// Issuer identifier, must match the host serving /oauth2/auth and /oauth2/token
+	OIDCIssuer = "https://myapp.appspot.com"
+
+	// Algorithm used when a new signing key is generated: "RS256" or "ES256"
+	OIDCSigningAlgorithm = "RS256"
+
+	// Lifetime of the id_token returned by the token endpoint
+	IDTokenExpiration = time.Hour
+
+	// How long a retired key stays published in /jwks.json so that tokens
+	// signed before a rotation can still be verified
+	SigningKeyRetention = time.Hour * 24 * 7
+)
+
+var (
+	ERROR_NO_SIGNING_KEY      = errors.New("No signing key")
+	ERROR_UNKNOWN_ALGORITHM   = errors.New("Unknown signing algorithm")
+	ERROR_INVALID_ACCESS_DATA = errors.New("Invalid access data")
+)
+
+// Data attached to an authorization by OAuth2AuthorizeHandler, carried by
+// osin from the authorize request to the access data.
+type OIDCUserData struct {
+	Email         string
+	EmailVerified bool
+	Nonce         string
+	AuthTime      time.Time
+}
+
+// Key used to sign id_tokens, stored in datastore under the kind "SigningKeys"
+// in the entity group of signingKeysRootKey. RetiredTime is zero for the
+// active key.
+type SigningKey struct {
+	Kid         string    `json:"kid,omitempty"`
+	Algorithm   string    `json:"alg,omitempty"`
+	PrivateKey  []byte    `json:"-" datastore:",noindex"`
+	CreatedTime time.Time `json:"created_time,omitempty"`
+	RetiredTime time.Time `json:"retired_time,omitempty"`
+}
+
+// JSON Web Key as published in /jwks.json
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+type OIDCConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	EndSessionEndpoint                string   `json:"end_session_endpoint"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+func newSigningKey(alg string) (*SigningKey, error) {
+	var privateKey crypto.Signer
+	var err error
+	switch alg {
+	case "RS256":
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, ERROR_UNKNOWN_ALGORITHM
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	publicDer, err := x509.MarshalPKIXPublicKey(privateKey.Public())
+	if err != nil {
+		return nil, err
+	}
+	thumbprint := sha256.Sum256(publicDer)
+
+	return &SigningKey{
+		Kid:         base64.RawURLEncoding.EncodeToString(thumbprint[:12]),
+		Algorithm:   alg,
+		PrivateKey:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+		CreatedTime: time.Now(),
+	}, nil
+}
+
+func (k *SigningKey) signer() (crypto.Signer, error) {
+	block, _ := pem.Decode(k.PrivateKey)
+	if block == nil {
+		return nil, errors.New("Invalid PEM for key " + k.Kid)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, ERROR_UNKNOWN_ALGORITHM
+	}
+	return signer, nil
+}
+
+// Sign data with the key, following the JWS encoding of RS256 and ES256
+func (k *SigningKey) Sign(data []byte) ([]byte, error) {
+	signer, err := k.signer()
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
+	switch key := signer.(type) {
+	case *rsa.PrivateKey:
+		return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+		if err != nil {
+			return nil, err
+		}
+		// JWS expects the raw R || S concatenation, 32 bytes each for P-256
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	}
+	return nil, ERROR_UNKNOWN_ALGORITHM
+}
+
+// Public part of the key, in JWK format
+func (k *SigningKey) JWK() (*JWK, error) {
+	signer, err := k.signer()
+	if err != nil {
+		return nil, err
+	}
+	jwk := &JWK{
+		Use: "sig",
+		Alg: k.Algorithm,
+		Kid: k.Kid,
+	}
+	switch key := signer.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk.Kty = "EC"
+		jwk.Crv = "P-256"
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		key.X.FillBytes(x)
+		key.Y.FillBytes(y)
+		jwk.X = base64.RawURLEncoding.EncodeToString(x)
+		jwk.Y = base64.RawURLEncoding.EncodeToString(y)
+	default:
+		return nil, ERROR_UNKNOWN_ALGORITHM
+	}
+	return jwk, nil
+}
+
+// Parent of the signing keys, so that they are read with strongly
+// consistent ancestor queries and changed in transactions: two instances
+// must not each create their own active key
+func signingKeysRootKey(c context.Context) *datastore.Key {
+	return datastore.NewKey(c, "OIDC", "signing-keys", 0, nil)
+}
+
+func signingKeyKey(c context.Context, kid string) *datastore.Key {
+	return datastore.NewKey(c, "SigningKeys", kid, 0, signingKeysRootKey(c))
+}
+
+// Read the signing keys from datastore, most recent first
+func readSigningKeys(c context.Context) ([]*datastore.Key, []SigningKey, error) {
+	var keys []SigningKey
+	dsKeys, err := datastore.NewQuery("SigningKeys").Ancestor(signingKeysRootKey(c)).GetAll(c, &keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Sort(signingKeysByTime{dsKeys, keys})
+	return dsKeys, keys, nil
+}
+
+type signingKeysByTime struct {
+	dsKeys []*datastore.Key
+	keys   []SigningKey
+}
+
+func (s signingKeysByTime) Len() int { return len(s.keys) }
+func (s signingKeysByTime) Less(i, j int) bool {
+	return s.keys[i].CreatedTime.After(s.keys[j].CreatedTime)
+}
+func (s signingKeysByTime) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.dsKeys[i], s.dsKeys[j] = s.dsKeys[j], s.dsKeys[i]
+}
+
+// Return all signing keys still published, most recent first. A first key is
+// generated if none exists yet.
+func GetSigningKeys(c context.Context) ([]SigningKey, error) {
+	var keys []SigningKey
+	err := common.GetObjMemCache(c, "oidc-signing-keys", &keys)
+	if err == nil && len(keys) > 0 {
+		return keys, nil
+	}
+
+	_, keys, err = readSigningKeys(c)
+	if err != nil {
+		log.Errorf(c, "GetSigningKeys: Error reading signing keys: %v", err)
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		log.Infof(c, "GetSigningKeys: No signing key, creating one")
+		newKey, err := newSigningKey(OIDCSigningAlgorithm)
+		if err != nil {
+			log.Errorf(c, "GetSigningKeys: Error generating key: %v", err)
+			return nil, err
+		}
+		err = datastore.RunInTransaction(c, func(tc context.Context) error {
+			_, existing, err := readSigningKeys(tc)
+			if err != nil {
+				return err
+			}
+			if len(existing) > 0 {
+				// Created by a concurrent request
+				keys = existing
+				return nil
+			}
+			keys = []SigningKey{*newKey}
+			_, err = datastore.Put(tc, signingKeyKey(tc, newKey.Kid), newKey)
+			return err
+		}, nil)
+		if err != nil {
+			log.Errorf(c, "GetSigningKeys: Error storing first key: %v", err)
+			return nil, err
+		}
+	}
+
+	err = common.SetObjMemCache(c, "oidc-signing-keys", &keys, 1)
+	if err != nil {
+		log.Errorf(c, "GetSigningKeys: Error setting keys in memcache: %v", err)
+	}
+	return keys, nil
+}
+
+func GetActiveSigningKey(c context.Context) (*SigningKey, error) {
+	keys, err := GetSigningKeys(c)
+	if err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		if keys[i].RetiredTime.IsZero() {
+			return &keys[i], nil
+		}
+	}
+	return nil, ERROR_NO_SIGNING_KEY
+}
+
+// Generate a new active signing key, retire the current one and delete keys
+// retired for more than SigningKeyRetention.
+func RotateSigningKey(c context.Context, alg string) error {
+	log.Infof(c, ">>>> RotateSigningKey")
+
+	newKey, err := newSigningKey(alg)
+	if err != nil {
+		log.Errorf(c, "RotateSigningKey: Error generating key: %v", err)
+		return err
+	}
+
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		dsKeys, keys, err := readSigningKeys(tc)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for i := range keys {
+			if keys[i].RetiredTime.IsZero() {
+				log.Infof(tc, "RotateSigningKey: Retiring key %v", keys[i].Kid)
+				keys[i].RetiredTime = now
+				if _, err := datastore.Put(tc, dsKeys[i], &keys[i]); err != nil {
+					return err
+				}
+			} else if now.Sub(keys[i].RetiredTime) > SigningKeyRetention {
+				log.Infof(tc, "RotateSigningKey: Deleting key %v", keys[i].Kid)
+				if err := datastore.Delete(tc, dsKeys[i]); err != nil {
+					return err
+				}
+			}
+		}
+		_, err = datastore.Put(tc, signingKeyKey(tc, newKey.Kid), newKey)
+		return err
+	}, nil)
+	if err != nil {
+		log.Errorf(c, "RotateSigningKey: Error storing key %v: %v", newKey.Kid, err)
+		return err
+	}
+	log.Infof(c, "RotateSigningKey: New %v key %v", newKey.Algorithm, newKey.Kid)
+
+	common.DeleteMemCache(c, "oidc-signing-keys")
+	return nil
+}
+
+// Sign the claims with the active key and return the compact JWT
+func SignJWT(c context.Context, claims *jws.ClaimSet) (string, error) {
+	key, err := GetActiveSigningKey(c)
+	if err != nil {
+		log.Errorf(c, "SignJWT: Error getting signing key: %v", err)
+		return "", err
+	}
+	header := &jws.Header{
+		Algorithm: key.Algorithm,
+		Typ:       "JWT",
+		KeyID:     key.Kid,
+	}
+	return jws.EncodeWithSigner(header, claims, key.Sign)
+}
+
+// Stable, non reversible "sub" claim for a user
+func OIDCSubject(c context.Context, u *User) string {
+	if u.GlobalUserId != "" {
+		return u.GlobalUserId
+	}
+	return common.Encrypt(c, "", "D-"+strings.ToLower(u.UserEmail))
+}
+
+func hasScope(scope string, s string) bool {
+	return common.StringInSlice(s, strings.Fields(scope))
+}
+
+// Build the id_token returned by the token endpoint when the "openid" scope was granted
+func MintIDToken(c context.Context, u *User, clientId string, data *OIDCUserData, scope string) (string, error) {
+	now := time.Now()
+	claims := &jws.ClaimSet{
+		Iss: OIDCIssuer,
+		Sub: OIDCSubject(c, u),
+		Aud: clientId,
+		Iat: now.Unix(),
+		Exp: now.Add(IDTokenExpiration).Unix(),
+		PrivateClaims: map[string]interface{}{
+			"auth_time": data.AuthTime.Unix(),
+		},
+	}
+	if data.Nonce != "" {
+		claims.PrivateClaims["nonce"] = data.Nonce
+	}
+	for k, v := range UserClaims(u, data, scope) {
+		claims.PrivateClaims[k] = v
+	}
+	return SignJWT(c, claims)
+}
+
+// Claims released for the granted scope, shared by id_token and /userinfo.
+// email_verified is the state of the email when the user authorized.
+func UserClaims(u *User, data *OIDCUserData, scope string) map[string]interface{} {
+	claims := map[string]interface{}{}
+	if hasScope(scope, "email") {
+		claims["email"] = u.UserEmail
+		claims["email_verified"] = data.EmailVerified
+	}
+	if hasScope(scope, "profile") {
+		if u.UserName != "" {
+			claims["name"] = u.UserName
+		}
+		if u.UserImage != "" {
+			claims["picture"] = u.UserImage
+		}
+		if !u.UpdatedTime.IsZero() {
+			claims["updated_at"] = u.UpdatedTime.Unix()
+		}
+	}
+	return claims
+}
+
+func oidcUserFromData(c context.Context, userData interface{}) (*User, *OIDCUserData, error) {
+	data, ok := userData.(*OIDCUserData)
+	if !ok || data == nil || data.Email == "" {
+		return nil, nil, ERROR_INVALID_ACCESS_DATA
+	}
+	u, err := GetUserByEmail(c, data.Email)
+	if err == datastore.ErrNoSuchEntity {
+		u = &User{UserEmail: data.Email}
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return u, data, nil
+}
+
+// Discovery document, for /.well-known/openid-configuration
+func OIDCDiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> OIDCDiscoveryHandler")
+
+	var scopes []string
+	for _, s := range SupportedScopes {
+		scopes = append(scopes, s.Name)
+	}
+
+	config := OIDCConfiguration{
+		Issuer:                            OIDCIssuer,
+		AuthorizationEndpoint:             OIDCIssuer + "/oauth2/auth",
+		TokenEndpoint:                     OIDCIssuer + "/oauth2/token",
+		UserInfoEndpoint:                  OIDCIssuer + "/userinfo",
+		JWKSURI:                           OIDCIssuer + "/jwks.json",
+		EndSessionEndpoint:                OIDCIssuer + "/oauth2/logout",
+		ResponseTypesSupported:            []string{"code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{"RS256", "ES256"},
+		ScopesSupported:                   scopes,
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic"},
+		ClaimsSupported: []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce",
+			"email", "email_verified", "name", "picture", "updated_at"},
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	if err := common.WriteJSON(w, config); err != nil {
+		log.Errorf(c, "OIDCDiscoveryHandler: Error writing JSON: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// Public signing keys, for /jwks.json
+func OIDCJWKSHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> OIDCJWKSHandler")
+
+	keys, err := GetSigningKeys(c)
+	if err != nil {
+		log.Errorf(c, "OIDCJWKSHandler: Error getting keys: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	set := JWKSet{Keys: []JWK{}}
+	for i := range keys {
+		jwk, err := keys[i].JWK()
+		if err != nil {
+			log.Errorf(c, "OIDCJWKSHandler: Error with key %v: %v", keys[i].Kid, err)
+			continue
+		}
+		set.Keys = append(set.Keys, *jwk)
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	if err := common.WriteJSON(w, set); err != nil {
+		log.Errorf(c, "OIDCJWKSHandler: Error writing JSON: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// Claims of the user owning the bearer access token, for /userinfo
+func OIDCUserInfoHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> OIDCUserInfoHandler")
+
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+
+	token := ""
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	} else {
+		token = r.FormValue("access_token")
+	}
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_request"`)
+		http.Error(w, "Access token required", http.StatusUnauthorized)
+		return
+	}
+
+	if oauth2Server == nil {
+		start(c)
+	}
+
+	access, err := oauth2Server.server.Storage.LoadAccess(token)
+	if err != nil || access == nil || access.IsExpired() || IsAccessRevoked(c, access) {
+		log.Infof(c, "OIDCUserInfoHandler: Invalid or expired access token")
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Invalid access token", http.StatusUnauthorized)
+		return
+	}
+
+	if !hasScope(access.Scope, "openid") {
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+		http.Error(w, "openid scope required", http.StatusForbidden)
+		return
+	}
+
+	u, data, err := oidcUserFromData(c, access.UserData)
+	if err != nil {
+		log.Errorf(c, "OIDCUserInfoHandler: Error getting user: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	claims := UserClaims(u, data, access.Scope)
+	claims["sub"] = OIDCSubject(c, u)
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err := common.WriteJSON(w, claims); err != nil {
+		log.Errorf(c, "OIDCUserInfoHandler: Error writing JSON: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// Cron handler rotating the id_token signing key
+func RotateSigningKeyHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> RotateSigningKeyHandler")
+
+	isAdmin := false
+	if user.Current(c) != nil {
+		isAdmin = user.Current(c).Admin
+	}
+
+	if (r.Header.Get("X-AppEngine-Cron") != "true") && (isAdmin == false) {
+		log.Errorf(c, "Handler called without admin/cron priviledge")
+		http.Error(w, "Handler called without admin/cron priviledge", http.StatusBadRequest)
+		return
+	}
+
+	alg := r.FormValue("alg")
+	if alg == "" {
+		alg = OIDCSigningAlgorithm
+	}
+	actor := "cron"
+	if user.Current(c) != nil {
+		actor = user.Current(c).Email
+	}
+	if err := RotateSigningKey(c, alg); err != nil {
+		Audit(r, &AuditEvent{Action: AUDIT_KEY_ROTATED, Outcome: AUDIT_FAILURE, Actor: actor, Details: alg + " " + err.Error()})
+		http.Error(w, "Error while rotating signing key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	Audit(r, &AuditEvent{Action: AUDIT_KEY_ROTATED, Outcome: AUDIT_SUCCESS, Actor: actor, Details: alg})
+
+	w.Write([]byte("Signing key rotated"))
+}
@@ -0,0 +1,368 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/RangelReale/osin"
+	"github.com/patdeg/go-appengine/common"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	// Lifetime of the link sent to reset a password
+	PasswordResetExpiration = time.Hour
+)
+
+var passwordHTML = `<html>
+	<head>
+		<meta name="viewport" content="width=device-width, initial-scale=1">
+		<link href="/lib/bootstrap-3.3.4/css/bootstrap.min.css" rel="stylesheet">
+		<link href="/lib/bootstrap-3.3.4/css/bootstrap-theme.min.css" rel="stylesheet">
+		<style>
+			html {
+		   		height:100%;
+			}
+
+			body {
+				min-height:100%;
+				min-height:100vh;
+				display:flex;
+				align-items:center;
+			}
+		</style>
+	</head>
+	<body>
+		<div class="container">
+			<div class="row">
+				<div class="col-xs-12 col-sm-offset-1 col-sm-10 col-md-offset-2 col-lg-offset-3 col-md-8 col-lg-6">
+					<p style="text-align:center">
+						<img src="/img/logo.png" height="40" alt="Deglon Consulting" />
+					</p>
+					[[if .Code]]
+					<h2>Choose a new password</h2>
+					[[else]]
+					<h2>Forgot your password?</h2>
+					[[end]]
+					[[if .Error]]<div class="alert alert-danger">[[.Error]]</div>[[end]]
+					[[if .Code]]
+					<form method="POST" action="/oauth2/reset">
+						<input type="hidden" name="email" value="[[.Email]]">
+						<input type="hidden" name="code" value="[[.Code]]">
+						<div class="form-group">
+							<label for="password">New Password</label>
+							<input type="password" class="form-control" id="password" name="password" autofocus placeholder="Password">
+						</div>
+						<div class="form-group">
+							<label for="password2">Enter your Password again</label>
+							<input type="password" class="form-control" id="password2" name="password2" placeholder="Password">
+						</div>
+						<p style="text-align:center">
+							<button type="submit" class="btn btn-primary" style="width:200px">Change Password</button>
+						</p>
+					</form>
+					[[else]]
+					<form method="POST" action="/oauth2/forgot">
+						<div class="form-group">
+							<label for="email">Your Username (Email)</label>
+							<input type="email" class="form-control" id="email" name="email" autofocus placeholder="Enter your email" value="[[.Email]]">
+						</div>
+						<p style="text-align:center">
+							<button type="submit" class="btn btn-primary" style="width:200px">Send Reset Link</button>
+						</p>
+					</form>
+					[[end]]
+				</div>
+			</div>
+		</div>
+	</body>
+</html>`
+
+var passwordTemplate = template.Must(template.New("password.html").Delims("[[", "]]").Parse(passwordHTML))
+
+func renderPasswordPage(c context.Context, w http.ResponseWriter, email, code, errorMessage string) {
+	if err := passwordTemplate.Execute(w, template.FuncMap{
+		"Email": email,
+		"Code":  code,
+		"Error": errorMessage,
+	}); err != nil {
+		log.Infof(c, "Error with passwordTemplate: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// Replace the password of a local account. Tokens issued before the change
+// are rejected from then on, see IsAccessRevoked.
+func SetLocalPassword(c context.Context, email, password string) (*LocalAccount, error) {
+	log.Infof(c, ">>>> SetLocalPassword")
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	var account LocalAccount
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		key := localAccountKey(tc, email)
+		if err := datastore.Get(tc, key, &account); err != nil {
+			return err
+		}
+		account.PasswordHash = hash
+		account.PasswordChangedTime = time.Now()
+		account.UpdatedTime = time.Now()
+		_, err := datastore.Put(tc, key, &account)
+		return err
+	}, nil)
+	if err != nil {
+		log.Errorf(c, "SetLocalPassword: Error updating account: %v", err)
+		return nil, err
+	}
+
+	RevokeUserTokens(c, account.Email)
+
+	return &account, nil
+}
+
+// Remove the tokens of the user from the OAuth2 server storage
+func RevokeUserTokens(c context.Context, email string) {
+	if oauth2Server == nil {
+		start(c)
+	}
+	if s, ok := oauth2Server.server.Storage.(*MyStorage); ok {
+		s.RemoveUserData(NormalizeEmail(email))
+	}
+}
+
+// True if the access was granted before the last password change of the
+// user, or if the user removed the access of the client since
+func IsAccessRevoked(c context.Context, access *osin.AccessData) bool {
+	data, ok := access.UserData.(*OIDCUserData)
+	if !ok || data == nil {
+		return false
+	}
+	account, err := GetLocalAccount(c, data.Email)
+	if err == nil && access.CreatedAt.Before(account.PasswordChangedTime) {
+		return true
+	}
+	return isConsentRevoked(c, data.Email, access)
+}
+
+// Purpose of the reset code of an account. Only the last code sent is
+// valid: sending a new one changes PasswordResetTime, and a new password
+// changes the hash.
+func resetPasswordPurpose(account *LocalAccount) string {
+	return fmt.Sprintf("%v %v %d", CODE_RESET_PASSWORD, accountBinding(account), account.PasswordResetTime.UnixNano()/1000)
+}
+
+// Email a reset link if a local account exists for the email, replacing the
+// link sent before
+func RequestPasswordReset(c context.Context, email string) error {
+	// Datastore keeps the times to the microsecond
+	now := time.Now().Truncate(time.Microsecond)
+	var account LocalAccount
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		key := localAccountKey(tc, email)
+		if err := datastore.Get(tc, key, &account); err != nil {
+			return err
+		}
+		account.PasswordResetTime = now
+		_, err := datastore.Put(tc, key, &account)
+		return err
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		log.Infof(c, "RequestPasswordReset: No account")
+		return nil
+	} else if err != nil {
+		log.Errorf(c, "RequestPasswordReset: Error updating account: %v", err)
+		return err
+	}
+
+	code, err := NewVerificationCode(c, account.Email, resetPasswordPurpose(&account), PasswordResetExpiration)
+	if err != nil {
+		return err
+	}
+
+	v := url.Values{}
+	v.Set("email", account.Email)
+	v.Set("code", code)
+	return sendAccountEmail(c, account.Email, account.Name, "Deglon Consulting",
+		"Reset your password",
+		"You just requested to reset your password. Please click on the link bellow within the next hour to choose a new password. If you didn't request it, you can ignore this email:",
+		OIDCIssuer+"/oauth2/reset?"+v.Encode())
+}
+
+// Forgot password form, for /oauth2/forgot
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> ForgotPasswordHandler")
+
+	email := NormalizeEmail(r.FormValue("email"))
+	if (r.Method != "POST") || (email == "") {
+		renderPasswordPage(c, w, email, "", "")
+		return
+	}
+
+	if wait, err := CheckPasswordResetAllowed(c, email, r.RemoteAddr); err != nil {
+		renderPasswordPage(c, w, email, "", fmt.Sprintf("Too many requests, please try again in %v.", wait.Truncate(time.Minute)+time.Minute))
+		return
+	}
+
+	if err := RequestPasswordReset(c, email); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Same answer whether the account exists or not
+	common.MessageHandler(c, w, "If an account exists for "+email+", we have sent you an email with a link to reset your password.", "/", 10)
+}
+
+// Reset link sent by email, for /oauth2/reset
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> ResetPasswordHandler")
+
+	email := NormalizeEmail(r.FormValue("email"))
+	code := r.FormValue("code")
+	if (email == "") || (code == "") {
+		renderPasswordPage(c, w, email, "", "This link is invalid.")
+		return
+	}
+
+	if r.Method != "POST" {
+		renderPasswordPage(c, w, email, code, "")
+		return
+	}
+
+	password := r.FormValue("password")
+	if password != r.FormValue("password2") {
+		renderPasswordPage(c, w, email, code, "The second password doesn't match the first.")
+		return
+	}
+	if err := CheckPasswordLength(password); err != nil {
+		renderPasswordPage(c, w, email, code, "Use between 5 and 72 characters in your password.")
+		return
+	}
+
+	purpose := CODE_RESET_PASSWORD
+	if account, err := GetLocalAccount(c, email); err == nil {
+		purpose = resetPasswordPurpose(account)
+	} else if err != datastore.ErrNoSuchEntity {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	err := ConsumeVerificationCode(c, email, code, purpose)
+	if err == ERROR_INVALID_CODE {
+		log.Infof(c, "ResetPasswordHandler: Invalid code")
+		Audit(r, &AuditEvent{Action: AUDIT_PASSWORD_RESET, Outcome: AUDIT_FAILURE, Actor: email, Provider: "Deglon", Details: "invalid code"})
+		renderPasswordPage(c, w, email, "", "This link is invalid or has expired, please request a new one.")
+		return
+	} else if err != nil {
+		log.Errorf(c, "ResetPasswordHandler: Error checking code: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	account, err := SetLocalPassword(c, email, password)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Unlock the account locked by failed attempts
+	deleteLoginAttempts(c, accountAttemptsKey(email))
+
+	// The link was received by email, which verifies it
+	if !account.Verified {
+		if _, err := VerifyLocalAccount(c, email, accountBinding(account)); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	Audit(r, &AuditEvent{Action: AUDIT_PASSWORD_RESET, Outcome: AUDIT_SUCCESS, Actor: email, Provider: "Deglon"})
+	common.MessageHandler(c, w, "Your password has been changed. You can now sign in.", "/", 5)
+}
+
+// Change the password of a local account, for POST /oauth2/password.
+// The user gives the email and the current password with the new one, plus
+// the otp or a recovery code when a second factor is required. No session
+// is needed, local accounts only sign in on the OAuth2 login page.
+func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> ChangePasswordHandler")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	email := NormalizeEmail(r.FormValue("email"))
+	if email == "" {
+		http.Error(w, "email required", http.StatusBadRequest)
+		return
+	}
+
+	if wait, err := CheckLoginAllowed(c, email, r.RemoteAddr); err != nil {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait.Seconds())+1))
+		http.Error(w, "Too many failed attempts", http.StatusTooManyRequests)
+		return
+	}
+
+	account, err := CheckLocalPassword(c, email, r.FormValue("password"))
+	if err == ERROR_BAD_CREDENTIALS || err == ERROR_ACCOUNT_NOT_VERIFIED {
+		RecordLoginFailure(c, email, r.RemoteAddr)
+		Audit(r, &AuditEvent{Action: AUDIT_PASSWORD_CHANGED, Outcome: AUDIT_FAILURE, Actor: email, Provider: "Deglon"})
+		http.Error(w, "Wrong email or password", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if required, err := IsSecondFactorRequired(c, email); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	} else if required {
+		err := VerifySecondFactor(c, email, r.FormValue("otp"))
+		if err == ERROR_INVALID_OTP {
+			RecordLoginFailure(c, email, r.RemoteAddr)
+			Audit(r, &AuditEvent{Action: AUDIT_PASSWORD_CHANGED, Outcome: AUDIT_FAILURE, Actor: email, Provider: "Deglon", Details: "invalid second factor"})
+			http.Error(w, "Wrong code", http.StatusUnauthorized)
+			return
+		} else if err == ERROR_TOTP_NOT_ENABLED {
+			// Administrators must enroll before changing their password
+			http.Error(w, "Two-factor authentication required", http.StatusForbidden)
+			return
+		} else if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	_, err = SetLocalPassword(c, email, r.FormValue("new_password"))
+	if err == ERROR_PASSWORD_TOO_SHORT || err == ERROR_PASSWORD_TOO_LONG {
+		http.Error(w, "Use between 5 and 72 characters in your password", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	Audit(r, &AuditEvent{Action: AUDIT_PASSWORD_CHANGED, Outcome: AUDIT_SUCCESS, Actor: email, Provider: "Deglon"})
+
+	err = sendAccountEmail(c, account.Email, account.Name, "Deglon Consulting",
+		"Your password was changed",
+		"The password of your account was just changed. If you didn't do it, please reset your password with the link bellow:",
+		OIDCIssuer+"/oauth2/forgot")
+	if err != nil {
+		log.Errorf(c, "ChangePasswordHandler: Error sending notification: %v", err)
+	}
+
+	common.WriteJSON(w, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,458 @@
+package auth
+
+import (
+	"github.com/patdeg/go-appengine/common"
+	"github.com/patdeg/go-appengine/track"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+	"net/http"
+	"time"
+)
+
+// Permission to export or erase the data of another user
+const (
+	PERM_MANAGE_PRIVACY = "privacy.manage"
+)
+
+// Status of an erasure request
+const (
+	ERASURE_PENDING = "pending"
+	ERASURE_DONE    = "done"
+)
+
+// Cookie seen with a logged in user, stored in datastore under the kind
+// "UserCookies" keyed by the cookie. It ties the tracking data, keyed by
+// cookie, to the user, and keeps the provider token of the session,
+// encrypted, so that LogoutEverywhere can revoke it.
+type UserCookie struct {
+	UserId      string    `json:"-"`
+	Cookie      string    `json:"cookie,omitempty"`
+	Provider    string    `json:"provider,omitempty"`
+	AccessToken string    `json:"-" datastore:",noindex"`
+	FirstTime   time.Time `json:"first_time,omitempty"`
+	LastTime    time.Time `json:"last_time,omitempty"`
+}
+
+// Erasure of the data of a user, stored in datastore under the kind
+// "ErasureRequests". The cookies are kept until the tracking data, which
+// can fail to be deleted right away, is gone.
+type ErasureRequest struct {
+	EmailHash     string    `json:"email_hash,omitempty"`
+	Cookies       []string  `json:"-" datastore:",noindex"`
+	Status        string    `json:"status,omitempty"`
+	RequestedBy   string    `json:"requested_by,omitempty"`
+	Attempts      int       `json:"attempts,omitempty"`
+	LastError     string    `json:"last_error,omitempty" datastore:",noindex"`
+	CreatedTime   time.Time `json:"created_time,omitempty"`
+	CompletedTime time.Time `json:"completed_time,omitempty"`
+}
+
+// Everything held about a user, as exported by ExportUserDataHandler
+type UserDataArchive struct {
+	GeneratedTime time.Time              `json:"generated_time"`
+	Users         []User                 `json:"users"`
+	Identities    []Identity             `json:"identities"`
+	LocalAccounts []LocalAccount         `json:"local_accounts"`
+	TwoFactor     []TOTPSecret           `json:"two_factor"`
+	ConnectedApps []ConsentGrant         `json:"connected_apps"`
+	APIKeys       []APIKey               `json:"api_keys"`
+	Roles         []string               `json:"roles"`
+	Cookies       []UserCookie           `json:"cookies"`
+	Tracking      map[string]interface{} `json:"tracking"`
+}
+
+// Remember that the cookie belongs to the user, with the provider token of
+// the session
+func RecordUserCookie(c context.Context, userId, cookie, provider, token string) {
+	if (userId == "") || (cookie == "") {
+		return
+	}
+	key := datastore.NewKey(c, "UserCookies", cookie, 0, nil)
+	var uc UserCookie
+	err := datastore.Get(c, key, &uc)
+	if err == datastore.ErrNoSuchEntity {
+		uc = UserCookie{
+			Cookie:    cookie,
+			FirstTime: time.Now(),
+		}
+	} else if err != nil {
+		log.Errorf(c, "RecordUserCookie: Error getting cookie: %v", err)
+		return
+	}
+	uc.UserId = userId
+	uc.Provider = provider
+	uc.AccessToken = ""
+	if token != "" {
+		uc.AccessToken = common.Encrypt(c, "", token)
+	}
+	uc.LastTime = time.Now()
+	if _, err := datastore.Put(c, key, &uc); err != nil {
+		log.Errorf(c, "RecordUserCookie: Error storing cookie: %v", err)
+	}
+}
+
+// Remove the token of a session that ended, the cookie stays tied to the user
+func forgetCookieToken(c context.Context, cookie string) {
+	key := datastore.NewKey(c, "UserCookies", cookie, 0, nil)
+	var uc UserCookie
+	if err := datastore.Get(c, key, &uc); err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			log.Errorf(c, "forgetCookieToken: Error getting cookie: %v", err)
+		}
+		return
+	}
+	if uc.AccessToken == "" {
+		return
+	}
+	uc.AccessToken = ""
+	if _, err := datastore.Put(c, key, &uc); err != nil {
+		log.Errorf(c, "forgetCookieToken: Error storing cookie: %v", err)
+	}
+}
+
+// Emails, identities and cookies of the person with this email
+func getUserKeys(c context.Context, email string) (userId string, emails []string, identities []Identity, cookies []UserCookie, err error) {
+	email = NormalizeEmail(email)
+	emails = []string{email}
+
+	u, err := GetUserByEmail(c, email)
+	if err == datastore.ErrNoSuchEntity {
+		return "", emails, nil, nil, nil
+	} else if err != nil {
+		log.Errorf(c, "getUserKeys: Error getting user: %v", err)
+		return "", nil, nil, nil, err
+	}
+	userId = u.GlobalUserId
+	if userId == "" {
+		return "", emails, nil, nil, nil
+	}
+
+	identities, err = GetUserIdentities(c, userId)
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+	for _, i := range identities {
+		if (i.Email != "") && !common.StringInSlice(i.Email, emails) {
+			emails = append(emails, i.Email)
+		}
+	}
+	var users []User
+	if _, err = datastore.NewQuery("Users").Filter("GlobalUserId =", userId).GetAll(c, &users); err != nil {
+		log.Errorf(c, "getUserKeys: Error querying users: %v", err)
+		return "", nil, nil, nil, err
+	}
+	for _, u := range users {
+		if e := NormalizeEmail(u.UserEmail); (e != "") && !common.StringInSlice(e, emails) {
+			emails = append(emails, e)
+		}
+	}
+
+	_, err = datastore.NewQuery("UserCookies").Filter("UserId =", userId).GetAll(c, &cookies)
+	if err != nil {
+		log.Errorf(c, "getUserKeys: Error querying cookies: %v", err)
+		return "", nil, nil, nil, err
+	}
+	return userId, emails, identities, cookies, nil
+}
+
+// Gather the data held about the person with this email, in auth and in track
+func ExportUserData(c context.Context, email string) (*UserDataArchive, error) {
+	log.Infof(c, ">>>> ExportUserData")
+
+	_, emails, identities, cookies, err := getUserKeys(c, email)
+	if err != nil {
+		return nil, err
+	}
+
+	archive := &UserDataArchive{
+		GeneratedTime: time.Now(),
+		Identities:    identities,
+		Cookies:       cookies,
+	}
+	for _, e := range emails {
+		if u, err := GetUserByEmail(c, e); err == nil {
+			u.AccessToken = ""
+			archive.Users = append(archive.Users, *u)
+		} else if err != datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+		if a, err := GetLocalAccount(c, e); err == nil {
+			archive.LocalAccounts = append(archive.LocalAccounts, *a)
+		} else if err != datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+		t, err := GetTOTPSecret(c, e)
+		if err != nil {
+			return nil, err
+		} else if t != nil {
+			archive.TwoFactor = append(archive.TwoFactor, *t)
+		}
+		grants, err := GetConsentGrants(c, e)
+		if err != nil {
+			return nil, err
+		}
+		archive.ConnectedApps = append(archive.ConnectedApps, grants...)
+		apiKeys, err := GetAPIKeys(c, e)
+		if err != nil {
+			return nil, err
+		}
+		archive.APIKeys = append(archive.APIKeys, apiKeys...)
+		roles, err := GetUserRoles(c, e)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range roles {
+			if !common.StringInSlice(r, archive.Roles) {
+				archive.Roles = append(archive.Roles, r)
+			}
+		}
+	}
+
+	var cookieIds []string
+	for _, uc := range cookies {
+		cookieIds = append(cookieIds, uc.Cookie)
+	}
+	archive.Tracking, err = track.ExportCookieData(c, cookieIds)
+	if err != nil {
+		return nil, err
+	}
+
+	return archive, nil
+}
+
+func deleteQueryKeys(c context.Context, q *datastore.Query) error {
+	keys, err := q.KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return datastore.DeleteMulti(c, keys)
+}
+
+// Delete the data held about the person with this email. The auth data is
+// deleted right away. The tracking data is deleted through an erasure
+// request, retried by EraseRetryHandler until BigQuery accepts it.
+func EraseUserData(c context.Context, email, requestedBy string) (*ErasureRequest, error) {
+	log.Infof(c, ">>>> EraseUserData")
+
+	userId, emails, _, cookies, err := getUserKeys(c, email)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &ErasureRequest{
+		EmailHash:   common.MD5(NormalizeEmail(email)),
+		Status:      ERASURE_PENDING,
+		RequestedBy: NormalizeEmail(requestedBy),
+		CreatedTime: time.Now(),
+	}
+	// The email of the user can't be kept in the request
+	if request.RequestedBy == NormalizeEmail(email) {
+		request.RequestedBy = "self"
+	}
+	for _, uc := range cookies {
+		request.Cookies = append(request.Cookies, uc.Cookie)
+	}
+	key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "ErasureRequests", nil), request)
+	if err != nil {
+		log.Errorf(c, "EraseUserData: Error storing request: %v", err)
+		return nil, err
+	}
+
+	for _, e := range emails {
+		RevokeUserTokens(c, e)
+		deleteLoginAttempts(c, accountAttemptsKey(e))
+		keys := []*datastore.Key{
+			datastore.NewKey(c, "Users", e, 0, nil),
+			localAccountKey(c, e),
+			totpKey(c, e),
+		}
+		for _, k := range keys {
+			if err := datastore.Delete(c, k); err != nil && err != datastore.ErrNoSuchEntity {
+				log.Errorf(c, "EraseUserData: Error deleting %v: %v", k.Kind(), err)
+				return nil, err
+			}
+		}
+		queries := []*datastore.Query{
+			datastore.NewQuery("ConsentGrants").Filter("Email =", e),
+			datastore.NewQuery("VerificationCodes").Filter("Email =", e),
+			datastore.NewQuery("RoleAssignments").Filter("Principal =", e),
+			datastore.NewQuery("APIKeys").Filter("Owner =", e),
+		}
+		for _, q := range queries {
+			if err := deleteQueryKeys(c, q); err != nil {
+				log.Errorf(c, "EraseUserData: Error deleting entities: %v", err)
+				return nil, err
+			}
+		}
+	}
+	common.DeleteMemCache(c, "rbac-assignments")
+
+	if userId != "" {
+		queries := []*datastore.Query{
+			datastore.NewQuery("Identities").Filter("UserId =", userId),
+			datastore.NewQuery("UserCookies").Filter("UserId =", userId),
+		}
+		for _, q := range queries {
+			if err := deleteQueryKeys(c, q); err != nil {
+				log.Errorf(c, "EraseUserData: Error deleting entities: %v", err)
+				return nil, err
+			}
+		}
+	}
+	for _, cookie := range request.Cookies {
+		common.DeleteMemCache(c, "user-"+cookie)
+		common.DeleteMemCache(c, "link-"+cookie)
+	}
+
+	eraseTrackingData(c, key, request)
+	return request, nil
+}
+
+// Delete the tracking data of an erasure request and save its status
+func eraseTrackingData(c context.Context, key *datastore.Key, request *ErasureRequest) {
+	request.Attempts++
+	if err := track.EraseCookieData(c, request.Cookies); err != nil {
+		log.Warningf(c, "eraseTrackingData: Tracking data not erased yet: %v", err)
+		request.LastError = err.Error()
+	} else {
+		request.Status = ERASURE_DONE
+		request.Cookies = nil
+		request.LastError = ""
+		request.CompletedTime = time.Now()
+	}
+	if _, err := datastore.Put(c, key, request); err != nil {
+		log.Errorf(c, "eraseTrackingData: Error storing request: %v", err)
+	}
+}
+
+// Email of the user whose data is requested: the logged in user, or the
+// email parameter for users allowed to manage privacy requests. POST
+// requests of a cookie session must carry its CSRF token.
+func privacyRequestEmail(w http.ResponseWriter, r *http.Request) (email string, requestedBy string, ok bool) {
+	c := appengine.NewContext(r)
+	u, cookieID := GetUserAndCookieID(w, r)
+	if (u == nil) || (u.UserEmail == "") {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return "", "", false
+	}
+	// API keys and bearer tokens are not sent by the browsers on their own
+	if (r.Method == "POST") && (requestAPIKeyUser(r) == nil) && (requestJWTUser(r) == nil) && !CheckCSRFToken(c, r, cookieID) {
+		log.Warningf(c, "privacyRequestEmail: Invalid CSRF token")
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return "", "", false
+	}
+	email = r.FormValue("email")
+	if (email == "") || (NormalizeEmail(email) == NormalizeEmail(u.UserEmail)) {
+		return u.UserEmail, u.UserEmail, true
+	}
+	if !SessionHasPermission(c, r, u, cookieID, PERM_MANAGE_PRIVACY) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return "", "", false
+	}
+	return email, u.UserEmail, true
+}
+
+// Download the data held about the logged in user as a JSON archive, for
+// GET /privacy/export. Privacy managers can pass the email of another user.
+func ExportUserDataHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> ExportUserDataHandler")
+
+	email, requestedBy, ok := privacyRequestEmail(w, r)
+	if !ok {
+		return
+	}
+
+	archive, err := ExportUserData(c, email)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	Audit(r, &AuditEvent{Action: AUDIT_DATA_EXPORTED, Outcome: AUDIT_SUCCESS, Actor: requestedBy, Target: email})
+
+	w.Header().Set("Content-Disposition", `attachment; filename="my-data.json"`)
+	common.WriteJSON(w, archive)
+}
+
+// Delete the data held about the logged in user, for POST /privacy/erase
+// with the csrf_token and confirm=yes. Privacy managers can pass the email
+// of another user.
+func EraseUserDataHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> EraseUserDataHandler")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.FormValue("confirm") != "yes" {
+		http.Error(w, "confirm=yes required", http.StatusBadRequest)
+		return
+	}
+
+	email, requestedBy, ok := privacyRequestEmail(w, r)
+	if !ok {
+		return
+	}
+
+	request, err := EraseUserData(c, email, requestedBy)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	// The erased email isn't kept, only its hash as in the erasure request
+	actor := requestedBy
+	if NormalizeEmail(email) == NormalizeEmail(requestedBy) {
+		actor = ""
+	}
+	Audit(r, &AuditEvent{Action: AUDIT_DATA_ERASED, Outcome: AUDIT_SUCCESS, Actor: actor, Details: request.EmailHash + " " + request.Status})
+
+	// Log out users who erased themselves
+	if NormalizeEmail(email) == NormalizeEmail(requestedBy) {
+		clearTokenCookies(w, r)
+		common.ClearCookie(w, r)
+	}
+
+	common.WriteJSON(w, map[string]string{"status": request.Status})
+}
+
+// Retry the pending erasures of tracking data, for a daily cron job
+func EraseRetryHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> EraseRetryHandler")
+
+	isAdmin := false
+	if user.Current(c) != nil {
+		isAdmin = user.Current(c).Admin
+	}
+
+	if (r.Header.Get("X-AppEngine-Cron") != "true") && (isAdmin == false) {
+		log.Errorf(c, "Handler called without admin/cron priviledge")
+		http.Error(w, "Handler called without admin/cron priviledge", http.StatusBadRequest)
+		return
+	}
+
+	var requests []ErasureRequest
+	keys, err := datastore.NewQuery("ErasureRequests").Filter("Status =", ERASURE_PENDING).GetAll(c, &requests)
+	if err != nil {
+		log.Errorf(c, "EraseRetryHandler: Error querying requests: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	done := 0
+	for i := range requests {
+		eraseTrackingData(c, keys[i], &requests[i])
+		if requests[i].Status == ERASURE_DONE {
+			done++
+		}
+	}
+
+	common.WriteJSON(w, map[string]int{"pending": len(requests) - done, "done": done})
+}
@@ -0,0 +1,440 @@
+package auth
+
+import (
+	"errors"
+	"github.com/patdeg/go-appengine/common"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Permissions checked by this package. Applications can define their own.
+const (
+	PERM_ALL          = "*"
+	PERM_ADMIN        = "admin"
+	PERM_ACCESS       = "access"
+	PERM_MANAGE_ROLES = "roles.manage"
+)
+
+// Built-in roles
+const (
+	ROLE_ADMIN       = "admin"
+	ROLE_WHITELISTED = "whitelisted"
+)
+
+var (
+	ERROR_UNKNOWN_ROLE       = errors.New("Unknown role")
+	ERROR_INVALID_PRINCIPAL  = errors.New("Principal must be an email or *@domain")
+	ERROR_LAST_ADMIN_REMOVAL = errors.New("Can't remove the last admin assignment")
+)
+
+// Named set of permissions, stored in datastore under the kind "Roles"
+// keyed by the name, in the entity group of rbacRootKey.
+type Role struct {
+	Name        string    `json:"name,omitempty"`
+	Description string    `json:"description,omitempty" datastore:",noindex"`
+	Permissions []string  `json:"permissions,omitempty" datastore:",noindex"`
+	UpdatedTime time.Time `json:"updated_time,omitempty"`
+}
+
+// Role given to an email or to every email of a domain ("*@ourcompany.com"),
+// stored in datastore under the kind "RoleAssignments", in the entity group
+// of rbacRootKey.
+type RoleAssignment struct {
+	Principal   string    `json:"principal,omitempty"`
+	Role        string    `json:"role,omitempty"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	CreatedTime time.Time `json:"created_time,omitempty"`
+}
+
+// Roles available before any is stored in datastore. A role stored with the
+// same name replaces them.
+var DefaultRoles = []Role{
+	{Name: ROLE_ADMIN, Description: "Full access", Permissions: []string{PERM_ALL}},
+	{Name: ROLE_WHITELISTED, Description: "Access to the application", Permissions: []string{PERM_ACCESS}},
+}
+
+// Emails that are always admin, read from the ADMIN_USERS environment
+// variable (comma separated) set in app.yaml. It lets each environment have
+// its own first admins, who then manage the other assignments.
+func BootstrapAdmins() []string {
+	var admins []string
+	for _, email := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		if email = NormalizeEmail(email); email != "" {
+			admins = append(admins, email)
+		}
+	}
+	return admins
+}
+
+// Parent of the roles and assignments, so that they are read with strongly
+// consistent ancestor queries: a revoked role must not be cached again
+func rbacRootKey(c context.Context) *datastore.Key {
+	return datastore.NewKey(c, "RBAC", "root", 0, nil)
+}
+
+func roleKey(c context.Context, name string) *datastore.Key {
+	return datastore.NewKey(c, "Roles", name, 0, rbacRootKey(c))
+}
+
+func roleAssignmentKey(c context.Context, principal, role string) *datastore.Key {
+	return datastore.NewKey(c, "RoleAssignments", principal+" "+role, 0, rbacRootKey(c))
+}
+
+// Email or *@domain, lowercase
+func normalizePrincipal(principal string) (string, error) {
+	principal = NormalizeEmail(principal)
+	i := strings.LastIndex(principal, "@")
+	if (i < 1) || (i == len(principal)-1) {
+		return "", ERROR_INVALID_PRINCIPAL
+	}
+	if strings.Contains(principal[:i], "*") && (principal[:i] != "*") {
+		return "", ERROR_INVALID_PRINCIPAL
+	}
+	return principal, nil
+}
+
+func principalMatches(principal, email string) bool {
+	if strings.HasPrefix(principal, "*@") {
+		return strings.HasSuffix(email, principal[1:])
+	}
+	return principal == email
+}
+
+// All the roles, the stored ones replacing the defaults, cached in memcache
+func GetRoles(c context.Context) (map[string]Role, error) {
+	var stored []Role
+	if err := common.GetObjMemCache(c, "rbac-roles", &stored); err != nil {
+		if err != memcache.ErrCacheMiss {
+			log.Errorf(c, "GetRoles: Error reading memcache: %v", err)
+		}
+		stored = nil
+		if _, err := datastore.NewQuery("Roles").Ancestor(rbacRootKey(c)).GetAll(c, &stored); err != nil {
+			log.Errorf(c, "GetRoles: Error querying roles: %v", err)
+			return nil, err
+		}
+		if err := common.SetObjMemCache(c, "rbac-roles", stored, 1); err != nil {
+			log.Errorf(c, "GetRoles: Error setting memcache: %v", err)
+		}
+	}
+
+	roles := map[string]Role{}
+	for _, r := range DefaultRoles {
+		roles[r.Name] = r
+	}
+	for _, r := range stored {
+		roles[r.Name] = r
+	}
+	return roles, nil
+}
+
+// All the role assignments, cached in memcache
+func GetRoleAssignments(c context.Context) ([]RoleAssignment, error) {
+	var assignments []RoleAssignment
+	err := common.GetObjMemCache(c, "rbac-assignments", &assignments)
+	if err == nil {
+		return assignments, nil
+	} else if err != memcache.ErrCacheMiss {
+		log.Errorf(c, "GetRoleAssignments: Error reading memcache: %v", err)
+	}
+
+	assignments = nil
+	if _, err := datastore.NewQuery("RoleAssignments").Ancestor(rbacRootKey(c)).GetAll(c, &assignments); err != nil {
+		log.Errorf(c, "GetRoleAssignments: Error querying assignments: %v", err)
+		return nil, err
+	}
+	if err := common.SetObjMemCache(c, "rbac-assignments", assignments, 1); err != nil {
+		log.Errorf(c, "GetRoleAssignments: Error setting memcache: %v", err)
+	}
+	return assignments, nil
+}
+
+// Names of the roles of the email, by direct or domain assignment
+func GetUserRoles(c context.Context, email string) ([]string, error) {
+	email = NormalizeEmail(email)
+	var names []string
+	if common.StringInSlice(email, BootstrapAdmins()) {
+		names = append(names, ROLE_ADMIN)
+	}
+	assignments, err := GetRoleAssignments(c)
+	if err != nil {
+		return names, err
+	}
+	for _, a := range assignments {
+		if principalMatches(a.Principal, email) && !common.StringInSlice(a.Role, names) {
+			names = append(names, a.Role)
+		}
+	}
+	return names, nil
+}
+
+// Permissions of the email through all its roles
+func GetUserPermissions(c context.Context, email string) ([]string, error) {
+	names, err := GetUserRoles(c, email)
+	if err != nil && len(names) == 0 {
+		return nil, err
+	}
+	roles, err := GetRoles(c)
+	if err != nil {
+		return nil, err
+	}
+	var perms []string
+	for _, name := range names {
+		for _, p := range roles[name].Permissions {
+			if !common.StringInSlice(p, perms) {
+				perms = append(perms, p)
+			}
+		}
+	}
+	return perms, nil
+}
+
+// True if one of the roles of the email grants the permission. Errors deny.
+func HasPermission(c context.Context, email string, perm string) bool {
+	if email == "" {
+		return false
+	}
+	perms, err := GetUserPermissions(c, email)
+	if err != nil {
+		log.Errorf(c, "HasPermission: Error getting permissions: %v", err)
+		return false
+	}
+	return common.StringInSlice(PERM_ALL, perms) || common.StringInSlice(perm, perms)
+}
+
+// True if the user of the session has the permission, entered their
+// second factor in this session when one is required, and the API key of
+// the request, if any, has the scope of the permission
+func SessionHasPermission(c context.Context, r *http.Request, u *User, cookieID string, perm string) bool {
+	return HasPermission(c, u.UserEmail, perm) && apiKeyAllowsPermission(r, perm) && SessionSecondFactorOK(c, r, u, cookieID)
+}
+
+func IsUserAdmin(c context.Context, email string) bool {
+	return HasPermission(c, email, PERM_ADMIN)
+}
+
+func IsUserWhiteListed(c context.Context, email string) bool {
+	return HasPermission(c, email, PERM_ACCESS)
+}
+
+// Create or replace a role
+func PutRole(c context.Context, role *Role) error {
+	log.Infof(c, ">>>> PutRole")
+	role.UpdatedTime = time.Now()
+	if _, err := datastore.Put(c, roleKey(c, role.Name), role); err != nil {
+		log.Errorf(c, "PutRole: Error storing role: %v", err)
+		return err
+	}
+	common.DeleteMemCache(c, "rbac-roles")
+	return nil
+}
+
+// Give a role to an email or to a domain
+func AssignRole(c context.Context, principal, role, createdBy string) error {
+	log.Infof(c, ">>>> AssignRole")
+	principal, err := normalizePrincipal(principal)
+	if err != nil {
+		return err
+	}
+	roles, err := GetRoles(c)
+	if err != nil {
+		return err
+	}
+	if _, ok := roles[role]; !ok {
+		return ERROR_UNKNOWN_ROLE
+	}
+
+	a := &RoleAssignment{
+		Principal:   principal,
+		Role:        role,
+		CreatedBy:   NormalizeEmail(createdBy),
+		CreatedTime: time.Now(),
+	}
+	if _, err := datastore.Put(c, roleAssignmentKey(c, principal, role), a); err != nil {
+		log.Errorf(c, "AssignRole: Error storing assignment: %v", err)
+		return err
+	}
+	common.DeleteMemCache(c, "rbac-assignments")
+	return nil
+}
+
+// Remove a role from an email or a domain. The last admin assignment can't
+// be removed unless admins are set in ADMIN_USERS.
+func UnassignRole(c context.Context, principal, role string) error {
+	log.Infof(c, ">>>> UnassignRole")
+	principal, err := normalizePrincipal(principal)
+	if err != nil {
+		return err
+	}
+
+	// The count and the delete are in one transaction, two admins can't
+	// remove each other at the same time
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		if (role == ROLE_ADMIN) && (len(BootstrapAdmins()) == 0) {
+			var assignments []RoleAssignment
+			q := datastore.NewQuery("RoleAssignments").Ancestor(rbacRootKey(tc)).Filter("Role =", ROLE_ADMIN)
+			if _, err := q.GetAll(tc, &assignments); err != nil {
+				return err
+			}
+			count := 0
+			for _, a := range assignments {
+				if a.Principal != principal {
+					count++
+				}
+			}
+			if count == 0 {
+				return ERROR_LAST_ADMIN_REMOVAL
+			}
+		}
+		err := datastore.Delete(tc, roleAssignmentKey(tc, principal, role))
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		return err
+	}, nil)
+	if err == ERROR_LAST_ADMIN_REMOVAL {
+		return err
+	} else if err != nil {
+		log.Errorf(c, "UnassignRole: Error deleting assignment: %v", err)
+		return err
+	}
+	common.DeleteMemCache(c, "rbac-assignments")
+	return nil
+}
+
+// Wrap a handler so that it only runs for logged in users with the
+// permission, through an API key with the scope of the permission for the
+// requests authenticated by a key. Answers 401 to anonymous users and 403 to
+// the others.
+func RequirePermission(perm string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			c := appengine.NewContext(r)
+			u, cookieID := GetUserAndCookieID(w, r)
+			if (u == nil) || (u.UserEmail == "") {
+				http.Error(w, "Login required", http.StatusUnauthorized)
+				return
+			}
+			if !HasPermission(c, u.UserEmail, perm) {
+				log.Warningf(c, "RequirePermission: %v denied to %v", perm, u.UserEmail)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			if !apiKeyAllowsPermission(r, perm) {
+				log.Warningf(c, "RequirePermission: %v denied to key %v without scope %v", perm, RequestAPIKey(r).KeyId, PermissionScope(perm))
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			if !SessionSecondFactorOK(c, r, u, cookieID) {
+				log.Warningf(c, "RequirePermission: %v denied to %v without second factor", perm, u.UserEmail)
+				http.Error(w, "Second factor required", http.StatusForbidden)
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// Admin API for roles at /admin/roles, to wrap in
+// RequirePermission(PERM_MANAGE_ROLES). GET lists the roles and assignments
+// with the csrf_token of the session. POST with the csrf_token and
+// action=assign or unassign, principal and role changes an assignment, with
+// action=put_role, role, description and permissions (comma separated)
+// creates or replaces a role.
+func RolesAdminHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> RolesAdminHandler")
+
+	u, cookieID := GetUserAndCookieID(w, r)
+
+	if r.Method == "GET" {
+		roles, err := GetRoles(c)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		assignments, err := GetRoleAssignments(c)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		token, err := GetCSRFToken(c, cookieID)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		common.WriteJSON(w, map[string]interface{}{
+			"roles":            roles,
+			"assignments":      assignments,
+			"bootstrap_admins": BootstrapAdmins(),
+			"csrf_token":       token,
+		})
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// API keys and bearer tokens are not sent by the browsers on their own
+	if (requestAPIKeyUser(r) == nil) && (requestJWTUser(r) == nil) && !CheckCSRFToken(c, r, cookieID) {
+		log.Warningf(c, "RolesAdminHandler: Invalid CSRF token")
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	var err error
+	switch r.FormValue("action") {
+	case "assign":
+		err = AssignRole(c, r.FormValue("principal"), r.FormValue("role"), u.UserEmail)
+	case "unassign":
+		err = UnassignRole(c, r.FormValue("principal"), r.FormValue("role"))
+	case "put_role":
+		if r.FormValue("role") == "" {
+			http.Error(w, "role required", http.StatusBadRequest)
+			return
+		}
+		var perms []string
+		for _, p := range strings.Split(r.FormValue("permissions"), ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				perms = append(perms, p)
+			}
+		}
+		err = PutRole(c, &Role{
+			Name:        r.FormValue("role"),
+			Description: r.FormValue("description"),
+			Permissions: perms,
+		})
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+
+	audit := &AuditEvent{
+		Action:  AUDIT_ROLES_CHANGED,
+		Outcome: auditOutcome(err == nil),
+		Actor:   u.UserEmail,
+		Target:  r.FormValue("principal"),
+		Details: r.FormValue("action") + " " + r.FormValue("role") + " " + r.FormValue("permissions"),
+	}
+	if err != nil {
+		audit.Details += " " + err.Error()
+	}
+	Audit(r, audit)
+
+	if err == ERROR_UNKNOWN_ROLE || err == ERROR_INVALID_PRINCIPAL || err == ERROR_LAST_ADMIN_REMOVAL {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	common.WriteJSON(w, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"errors"
+	"golang.org/x/oauth2"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	// Scheme of the tenants registered without one
+	DefaultScheme = "https"
+
+	// When set, requests for hosts not registered with RegisterTenant use
+	// the tenant of this host, which must be registered too
+	DefaultTenantHost = ""
+)
+
+var (
+	ERROR_UNKNOWN_TENANT = errors.New("Unknown host")
+)
+
+// Configuration of a host served by the app. The provider configurations
+// are copies owned by the tenant, with the callback URL of the host, and
+// are never modified by the handlers.
+type Tenant struct {
+	Host     string
+	Scheme   string
+	Google   *oauth2.Config
+	Facebook *oauth2.Config
+}
+
+var tenants = struct {
+	sync.RWMutex
+	hosts map[string]*Tenant
+}{hosts: map[string]*Tenant{}}
+
+// Copy of a provider configuration with the callback URL of the tenant
+func tenantConfig(config *oauth2.Config, redirectURL string) *oauth2.Config {
+	copied := *config
+	copied.RedirectURL = redirectURL
+	return &copied
+}
+
+// Fill the missing fields of a tenant: https, and the Google and Facebook
+// configurations copied from GoogleConfig and FacebookConfig
+func newTenant(t Tenant) *Tenant {
+	t.Host = strings.ToLower(t.Host)
+	if t.Scheme == "" {
+		t.Scheme = DefaultScheme
+	}
+	if t.Google == nil {
+		t.Google = tenantConfig(GoogleConfig, t.URL("/goog_callback"))
+	} else if t.Google.RedirectURL == "" {
+		t.Google = tenantConfig(t.Google, t.URL("/goog_callback"))
+	}
+	if t.Facebook == nil {
+		t.Facebook = tenantConfig(FacebookConfig, t.URL("/fb_callback"))
+	} else if t.Facebook.RedirectURL == "" {
+		t.Facebook = tenantConfig(t.Facebook, t.URL("/fb_callback"))
+	}
+	return &t
+}
+
+// Add or replace the configuration of a host, usually at init. Google and
+// Facebook can be left nil to use GoogleConfig and FacebookConfig, their
+// RedirectURL empty to use the default callback of the host.
+func RegisterTenant(t Tenant) *Tenant {
+	registered := newTenant(t)
+	tenants.Lock()
+	tenants.hosts[registered.Host] = registered
+	tenants.Unlock()
+	return registered
+}
+
+// Tenant of the host of the request, or of DefaultTenantHost when the host
+// is not registered. The Host header is never trusted to build a tenant:
+// without a registered tenant the request gets ERROR_UNKNOWN_TENANT.
+func GetTenant(r *http.Request) (*Tenant, error) {
+	host := strings.ToLower(r.Host)
+	tenants.RLock()
+	defer tenants.RUnlock()
+	if t, ok := tenants.hosts[host]; ok {
+		return t, nil
+	}
+	if DefaultTenantHost != "" {
+		if t, ok := tenants.hosts[strings.ToLower(DefaultTenantHost)]; ok {
+			return t, nil
+		}
+	}
+	return nil, ERROR_UNKNOWN_TENANT
+}
+
+// Absolute URL of a path on the tenant
+func (t *Tenant) URL(path string) string {
+	return t.Scheme + "://" + t.Host + path
+}
+
+// Whether cookies of the tenant must be sent over https only
+func (t *Tenant) SecureCookies() bool {
+	return t.Scheme == "https"
+}
+
+// Configuration of a login provider, nil if unknown
+func (t *Tenant) OAuthConfig(provider string) *oauth2.Config {
+	switch provider {
+	case "Google":
+		return t.Google
+	case "Facebook":
+		return t.Facebook
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetTenant(t *testing.T) {
+	defer func(host string) { DefaultTenantHost = host }(DefaultTenantHost)
+	registered := RegisterTenant(Tenant{Host: "Example.com"})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "EXAMPLE.com"
+	if tenant, err := GetTenant(r); (err != nil) || (tenant != registered) {
+		t.Errorf("registered host: %v, %v", tenant, err)
+	}
+	if registered.URL("/goog_callback") != "https://example.com/goog_callback" {
+		t.Errorf("callback URL: %v", registered.URL("/goog_callback"))
+	}
+
+	r.Host = "evil.com"
+	DefaultTenantHost = ""
+	if tenant, err := GetTenant(r); err != ERROR_UNKNOWN_TENANT {
+		t.Errorf("unknown host: %v, %v, want %v", tenant, err, ERROR_UNKNOWN_TENANT)
+	}
+	DefaultTenantHost = "example.com"
+	if tenant, err := GetTenant(r); (err != nil) || (tenant != registered) {
+		t.Errorf("unknown host with DefaultTenantHost: %v, %v", tenant, err)
+	}
+	DefaultTenantHost = "other.com"
+	if tenant, err := GetTenant(r); err != ERROR_UNKNOWN_TENANT {
+		t.Errorf("unregistered DefaultTenantHost: %v, %v, want %v", tenant, err, ERROR_UNKNOWN_TENANT)
+	}
+}
@@ -3,6 +3,7 @@ package auth
 import (
 	"bytes"
 	"github.com/patdeg/go-appengine/common"
+	"github.com/patdeg/go-appengine/track"
 	"encoding/json"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
@@ -222,7 +223,7 @@ func GetCookieToken(r *http.Request) (token string, provider string) {
 		// Check if token is valid
 		tokenInfo, err := CheckToken(c, token)
 		if err != nil {
-			log.Errorf(c, "getToken: Error checking token %v: %v", token, err)
+			log.Errorf(c, "getToken: Error checking token: %v", err)
 			return "", ""
 		}
 
@@ -242,6 +243,14 @@ func GetUserAndCookieID(w http.ResponseWriter, r *http.Request) (*User, string)
 	c := appengine.NewContext(r)
 	log.Infof(c, ">>>> GetUserAndCookieID")
 
+	// Requests authenticated by APIKeyMiddleware or JWTMiddleware have no session
+	if apiUser := requestAPIKeyUser(r); apiUser != nil {
+		return apiUser, ""
+	}
+	if jwtUser := requestJWTUser(r); jwtUser != nil {
+		return jwtUser, ""
+	}
+
 	cookieID := common.GetCookieID(w, r)
 
 	var u User
@@ -289,51 +298,7 @@ func GetUserAndCookieID(w http.ResponseWriter, r *http.Request) (*User, string)
 		u.FacebookLoginURL = "/fb_login"
 	} else {
 		u.LogoutURL = "/logout"
-		log.Debugf(c, "GetUserAndCookieID: LoginProvider: %v", u.LoginProvider)
-		if u.LoginProvider == "Google" {
-			log.Debugf(c, "GetUserAndCookieID: Google User")
-			me, err := GoogleUserInfo(c, u.AccessToken)
-			if err == nil {
-				log.Debugf(c, "GetUserAndCookieID: GoogleUserInfo successful")
-				u.IsGoogle = true
-				if me.Image != nil {
-					u.UserImage = me.Image.Url
-				}
-				u.UserName = me.DisplayName
-				// Loop through user's emails and find the first which type is "account" (Google account email address)
-				// https://godoc.org/google.golang.org/api/plus/v1#PersonEmails
-				for _, e := range me.Emails {
-					if e.Type == "account" {
-						u.UserEmail = e.Value
-						break
-					}
-				}
-				// If userEmail is empty (i.e. no email type "account"), take first email in list
-				if u.UserEmail == "" {
-					if me.Emails[0] != nil {
-						u.UserEmail = me.Emails[0].Value
-					}
-				}
-				u.UserId = common.Encrypt(c, "", me.Id)
-				u.GlobalUserId = common.Encrypt(c, "", "G-"+me.Id)
-			} else {
-				log.Debugf(c, "GetUserAndCookieID: GoogleUserInfo error: %v", err)
-			}
-		} else if u.LoginProvider == "Facebook" {
-			log.Debugf(c, "GetUserAndCookieID: Facebook User")
-			me, err := FacebookUserInfo(c, u.AccessToken)
-			if err == nil {
-				log.Debugf(c, "GetUserAndCookieID: FacebookUserInfo successful")
-				u.IsFacebook = true
-				u.UserImage = me.Image
-				u.UserName = me.Name
-				u.UserEmail = me.Email
-				u.UserId = common.Encrypt(c, "", me.Id)
-				u.GlobalUserId = common.Encrypt(c, "", "FB-"+me.Id)
-			} else {
-				log.Debugf(c, "GetUserAndCookieID: FacebookUserInfo error: %v", err)
-			}
-		}
+		loadProviderUser(c, cookieID, &u)
 	}
 
 	if user.Current(c) != nil {
@@ -374,6 +339,8 @@ func GetUserAndCookieID(w http.ResponseWriter, r *http.Request) (*User, string)
 	log.Debugf(c, "GetUserAndCookieID: User Email: %v", u.UserEmail)
 	log.Debugf(c, "GetUserAndCookieID: Create Date: %v", u.CreatedTime)
 
+	RecordUserCookie(c, u.GlobalUserId, cookieID, u.LoginProvider, u.AccessToken)
+
 	if u.UserEmail != "" {
 		err = StoreUsers(c, u, cookieID)
 		if err != nil {
@@ -385,6 +352,104 @@ func GetUserAndCookieID(w http.ResponseWriter, r *http.Request) (*User, string)
 	return &u, cookieID
 }
 
+// Fill u with the profile of the user of u.AccessToken at u.LoginProvider,
+// and with the global id of the person the identity resolves to
+func loadProviderUser(c context.Context, cookieID string, u *User) {
+	log.Infof(c, ">>>> loadProviderUser")
+
+	subject := ""
+	emailVerified := false
+	log.Debugf(c, "loadProviderUser: LoginProvider: %v", u.LoginProvider)
+	if u.LoginProvider == "Google" {
+		log.Debugf(c, "loadProviderUser: Google User")
+		me, err := GoogleUserInfo(c, u.AccessToken)
+		if err == nil {
+			log.Debugf(c, "loadProviderUser: GoogleUserInfo successful")
+			u.IsGoogle = true
+			if me.Image != nil {
+				u.UserImage = me.Image.Url
+			}
+			u.UserName = me.DisplayName
+			// Loop through user's emails and find the first which type is "account" (Google account email address)
+			// https://godoc.org/google.golang.org/api/plus/v1#PersonEmails
+			for _, e := range me.Emails {
+				if e.Type == "account" {
+					u.UserEmail = e.Value
+					emailVerified = true
+					break
+				}
+			}
+			// If userEmail is empty (i.e. no email type "account"), take first email in list
+			if u.UserEmail == "" {
+				if me.Emails[0] != nil {
+					u.UserEmail = me.Emails[0].Value
+				}
+			}
+			u.UserId = common.Encrypt(c, "", me.Id)
+			u.GlobalUserId = common.Encrypt(c, "", "G-"+me.Id)
+			subject = me.Id
+		} else {
+			log.Debugf(c, "loadProviderUser: GoogleUserInfo error: %v", err)
+		}
+	} else if u.LoginProvider == "Facebook" {
+		log.Debugf(c, "loadProviderUser: Facebook User")
+		me, err := FacebookUserInfo(c, u.AccessToken)
+		if err == nil {
+			log.Debugf(c, "loadProviderUser: FacebookUserInfo successful")
+			u.IsFacebook = true
+			u.UserImage = me.Image
+			u.UserName = me.Name
+			u.UserEmail = me.Email
+			u.UserId = common.Encrypt(c, "", me.Id)
+			u.GlobalUserId = common.Encrypt(c, "", "FB-"+me.Id)
+			subject = me.Id
+			// Facebook only returns confirmed emails
+			emailVerified = true
+		} else {
+			log.Debugf(c, "loadProviderUser: FacebookUserInfo error: %v", err)
+		}
+	}
+
+	// Replace the id derived from the provider with the id of the person
+	if subject != "" {
+		userId, err := ResolveIdentity(c, cookieID, u.LoginProvider, subject, u.UserEmail, emailVerified, u.GlobalUserId)
+		if err == ERROR_EMAIL_NOT_VERIFIED {
+			u.UserEmail = ""
+		} else if err != nil {
+			log.Errorf(c, "loadProviderUser: Error resolving identity: %v", err)
+		} else {
+			u.GlobalUserId = userId
+		}
+	}
+}
+
+// Tie the anonymous history of the cookie to the user who just logged in
+// with the access token of a provider
+func identifyLogin(w http.ResponseWriter, r *http.Request, cookieID, provider, accessToken string) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>> identifyLogin")
+
+	u := User{AccessToken: accessToken, LoginProvider: provider}
+	loadProviderUser(c, cookieID, &u)
+	if (u.GlobalUserId != "") && (u.UserEmail != "") {
+		track.TrackIdentify(w, r, cookieID, u.GlobalUserId, provider)
+	}
+}
+
+// Tie the anonymous history of the cookie to the local account that just
+// signed in on the authorization server
+func identifyLocalLogin(w http.ResponseWriter, r *http.Request, email string) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>> identifyLocalLogin")
+
+	u, err := GetUserByEmail(c, NormalizeEmail(email))
+	if err != nil {
+		log.Errorf(c, "identifyLocalLogin: Error getting user: %v", err)
+		return
+	}
+	track.TrackIdentify(w, r, common.GetCookieID(w, r), u.GlobalUserId, "Deglon")
+}
+
 func GetUser(w http.ResponseWriter, r *http.Request) *User {
 	log.Infof(appengine.NewContext(r), ">>>> GetUser")
 	u, _ := GetUserAndCookieID(w, r)
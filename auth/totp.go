@@ -0,0 +1,729 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/RangelReale/osin"
+	"github.com/patdeg/go-appengine/common"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// Issuer shown in the authenticator apps
+	TOTPIssuer = "Deglon Consulting"
+
+	// Time steps accepted before and after the current one, for clock drift
+	TOTPSkew = 1
+
+	// Number of recovery codes generated at enrollment
+	RecoveryCodeCount = 10
+
+	// Time given to enter the code once the password is accepted
+	SecondFactorExpiration = time.Minute * 5
+
+	// How long a session keeps the second factor checked by
+	// TOTPSessionHandler
+	SecondFactorSessionExpiration = time.Hour * 12
+)
+
+const (
+	totpDigits = 6
+	totpPeriod = 30
+)
+
+var (
+	ERROR_TOTP_ENABLED     = errors.New("Two-factor authentication already enabled")
+	ERROR_TOTP_NOT_ENABLED = errors.New("Two-factor authentication not enabled")
+	ERROR_TOTP_REQUIRED    = errors.New("Two-factor authentication required for administrators")
+	ERROR_INVALID_OTP      = errors.New("Invalid one-time password")
+)
+
+// Purposes of the codes passed between the steps of a two-factor login
+const (
+	CODE_LOGIN_MFA      = "login_mfa"
+	CODE_LOGIN_COMPLETE = "login_complete"
+)
+
+// TOTP enrollment of an account, stored in datastore under the kind
+// "TOTPSecrets" keyed by the lowercase email. The enrollment is pending
+// until a first code is verified. Recovery codes are stored as SHA-256.
+type TOTPSecret struct {
+	Email         string    `json:"email,omitempty"`
+	Secret        string    `json:"-" datastore:",noindex"`
+	Enabled       bool      `json:"enabled,omitempty"`
+	RecoveryCodes []string  `json:"-" datastore:",noindex"`
+	LastStep      int64     `json:"-" datastore:",noindex"`
+	CreatedTime   time.Time `json:"created_time,omitempty"`
+	EnabledTime   time.Time `json:"enabled_time,omitempty"`
+}
+
+func totpKey(c context.Context, email string) *datastore.Key {
+	return datastore.NewKey(c, "TOTPSecrets", NormalizeEmail(email), 0, nil)
+}
+
+// RFC 6238 code of the secret for a time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// Time step of the code matching the secret, or ERROR_INVALID_OTP
+func matchTOTP(secret, code string, now time.Time) (int64, error) {
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != totpDigits {
+		return 0, ERROR_INVALID_OTP
+	}
+	current := now.Unix() / totpPeriod
+	for i := -TOTPSkew; i <= TOTPSkew; i++ {
+		expected, err := totpCode(secret, current+int64(i))
+		if err != nil {
+			return 0, err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return current + int64(i), nil
+		}
+	}
+	return 0, ERROR_INVALID_OTP
+}
+
+// otpauth:// URI to show as a QR code to the authenticator app
+func TOTPProvisioningURI(email, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", TOTPIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%d", totpDigits))
+	v.Set("period", fmt.Sprintf("%d", totpPeriod))
+	label := url.PathEscape(TOTPIssuer + ":" + NormalizeEmail(email))
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+}
+
+func newRecoveryCodes() (codes []string, hashes []string, err error) {
+	for i := 0; i < RecoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, hashCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// Return the TOTP enrollment of the email, nil if there is none
+func GetTOTPSecret(c context.Context, email string) (*TOTPSecret, error) {
+	var t TOTPSecret
+	err := datastore.Get(c, totpKey(c, email), &t)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		log.Errorf(c, "GetTOTPSecret: Error getting secret: %v", err)
+		return nil, err
+	}
+	return &t, nil
+}
+
+// True if the email must enter a one-time password to sign in
+func IsSecondFactorRequired(c context.Context, email string) (bool, error) {
+	if IsUserAdmin(c, email) {
+		return true, nil
+	}
+	t, err := GetTOTPSecret(c, email)
+	if err != nil {
+		return false, err
+	}
+	return (t != nil) && t.Enabled, nil
+}
+
+// Generate a new pending secret for the email, replacing any previous
+// pending one. Returns ERROR_TOTP_ENABLED if TOTP is already enabled.
+func BeginTOTPEnrollment(c context.Context, email string) (*TOTPSecret, error) {
+	log.Infof(c, ">>>> BeginTOTPEnrollment")
+
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	t := &TOTPSecret{
+		Email:       NormalizeEmail(email),
+		Secret:      base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b),
+		CreatedTime: time.Now(),
+	}
+
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		key := totpKey(tc, email)
+		var old TOTPSecret
+		err := datastore.Get(tc, key, &old)
+		if err == nil && old.Enabled {
+			return ERROR_TOTP_ENABLED
+		} else if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err = datastore.Put(tc, key, t)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Enable the pending secret of the email if the code matches it. Returns
+// the recovery codes, which are only shown this once.
+func ConfirmTOTPEnrollment(c context.Context, email, code string) ([]string, error) {
+	log.Infof(c, ">>>> ConfirmTOTPEnrollment")
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		key := totpKey(tc, email)
+		var t TOTPSecret
+		err := datastore.Get(tc, key, &t)
+		if err == datastore.ErrNoSuchEntity {
+			return ERROR_TOTP_NOT_ENABLED
+		} else if err != nil {
+			return err
+		}
+		if t.Enabled {
+			return ERROR_TOTP_ENABLED
+		}
+		step, err := matchTOTP(t.Secret, code, time.Now())
+		if err != nil {
+			return err
+		}
+		t.Enabled = true
+		t.EnabledTime = time.Now()
+		t.LastStep = step
+		t.RecoveryCodes = hashes
+		_, err = datastore.Put(tc, key, &t)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Check a one-time password or a recovery code of the email. A code can't
+// be used twice: TOTP steps must increase and recovery codes are deleted.
+func VerifySecondFactor(c context.Context, email, code string) error {
+	log.Infof(c, ">>>> VerifySecondFactor")
+
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		key := totpKey(tc, email)
+		var t TOTPSecret
+		err := datastore.Get(tc, key, &t)
+		if err == datastore.ErrNoSuchEntity {
+			return ERROR_TOTP_NOT_ENABLED
+		} else if err != nil {
+			return err
+		}
+		if !t.Enabled {
+			return ERROR_TOTP_NOT_ENABLED
+		}
+
+		if step, err := matchTOTP(t.Secret, code, time.Now()); err == nil {
+			if step <= t.LastStep {
+				log.Warningf(tc, "VerifySecondFactor: Code replayed")
+				return ERROR_INVALID_OTP
+			}
+			t.LastStep = step
+			_, err = datastore.Put(tc, key, &t)
+			return err
+		} else if err != ERROR_INVALID_OTP {
+			return err
+		}
+
+		hash := hashCode(normalizeRecoveryCode(code))
+		for i, h := range t.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+				log.Infof(tc, "VerifySecondFactor: Recovery code used, %v left", len(t.RecoveryCodes)-1)
+				t.RecoveryCodes = append(t.RecoveryCodes[:i], t.RecoveryCodes[i+1:]...)
+				_, err := datastore.Put(tc, key, &t)
+				return err
+			}
+		}
+		return ERROR_INVALID_OTP
+	}, nil)
+}
+
+// Remove the TOTP enrollment of the email. Administrators can't disable it.
+func DisableTOTP(c context.Context, email string) error {
+	log.Infof(c, ">>>> DisableTOTP")
+	if IsUserAdmin(c, email) {
+		return ERROR_TOTP_REQUIRED
+	}
+	err := datastore.Delete(c, totpKey(c, email))
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		log.Errorf(c, "DisableTOTP: Error deleting secret: %v", err)
+		return err
+	}
+	return nil
+}
+
+// Second factor checked in a session, stored in datastore under the kind
+// "SecondFactorSessions" keyed by cookie id
+type SecondFactorSession struct {
+	Email        string    `json:"email,omitempty"`
+	VerifiedTime time.Time `json:"verified_time,omitempty"`
+}
+
+// Record that the user of the session entered their second factor
+func MarkSecondFactorSession(c context.Context, cookieID, email string) error {
+	s := &SecondFactorSession{
+		Email:        NormalizeEmail(email),
+		VerifiedTime: time.Now(),
+	}
+	if _, err := datastore.Put(c, datastore.NewKey(c, "SecondFactorSessions", cookieID, 0, nil), s); err != nil {
+		log.Errorf(c, "MarkSecondFactorSession: Error storing session: %v", err)
+		return err
+	}
+	common.SetObjMemCache(c, "mfa-"+cookieID, s, int32(SecondFactorSessionExpiration/time.Hour))
+	return nil
+}
+
+func forgetSecondFactorSession(c context.Context, cookieID string) {
+	common.DeleteMemCache(c, "mfa-"+cookieID)
+	err := datastore.Delete(c, datastore.NewKey(c, "SecondFactorSessions", cookieID, 0, nil))
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		log.Errorf(c, "forgetSecondFactorSession: Error deleting session: %v", err)
+	}
+}
+
+func isSecondFactorSession(c context.Context, cookieID, email string) bool {
+	if cookieID == "" {
+		return false
+	}
+	var s SecondFactorSession
+	if common.GetObjMemCache(c, "mfa-"+cookieID, &s) != nil {
+		err := datastore.Get(c, datastore.NewKey(c, "SecondFactorSessions", cookieID, 0, nil), &s)
+		if err != nil {
+			return false
+		}
+	}
+	return (s.Email == NormalizeEmail(email)) && (time.Since(s.VerifiedTime) < SecondFactorSessionExpiration)
+}
+
+// Whether the session of the request can use the permissions of u: the
+// users who need a second factor, like the administrators logged in with
+// Google or Facebook, must have entered it with TOTPSessionHandler. API
+// keys and access tokens carry their own grants: AccessTokenHandler and
+// APIKeysHandler only issue them to sessions that pass this check.
+func SessionSecondFactorOK(c context.Context, r *http.Request, u *User, cookieID string) bool {
+	if (requestAPIKeyUser(r) != nil) || (requestJWTUser(r) != nil) {
+		return true
+	}
+	required, err := IsSecondFactorRequired(c, u.UserEmail)
+	if err != nil {
+		return false
+	}
+	return !required || isSecondFactorSession(c, cookieID, u.UserEmail)
+}
+
+var totpHTML = `<html>
+	<head>
+		<meta name="viewport" content="width=device-width, initial-scale=1">
+		<link href="/lib/bootstrap-3.3.4/css/bootstrap.min.css" rel="stylesheet">
+		<link href="/lib/bootstrap-3.3.4/css/bootstrap-theme.min.css" rel="stylesheet">
+		<script src="/lib/qrcode/qrcode.min.js"></script>
+		<style>
+			html {
+		   		height:100%;
+			}
+
+			body {
+				min-height:100%;
+				min-height:100vh;
+				display:flex;
+				align-items:center;
+			}
+		</style>
+	</head>
+	<body>
+		<div class="container">
+			<div class="row">
+				<div class="col-xs-12 col-sm-offset-1 col-sm-10 col-md-offset-2 col-lg-offset-3 col-md-8 col-lg-6">
+					<p style="text-align:center">
+						<img src="/img/logo.png" height="40" alt="Deglon Consulting" />
+					</p>
+					<form method="POST" action="https://[[.Server]]/oauth2/auth?response_type=[[.Type]]&client_id=[[.ClientId]]&state=[[.State]]&redirect_uri=[[.Redirect]]&scope=[[.Scope]]&nonce=[[.Nonce]]">
+						<input type="hidden" name="email" value="[[.Email]]">
+						<input type="hidden" name="mfa_ticket" value="[[.Ticket]]">
+						[[if .RecoveryCodes]]
+						<h2>Save your recovery codes</h2>
+						<p>Each of these codes can be used once instead of a code from your app, if you lose your phone. Keep them somewhere safe, they won't be shown again.</p>
+						<pre>[[range .RecoveryCodes]][[.]]
+[[end]]</pre>
+						<input type="hidden" name="mfa_done" value="1">
+						<p style="text-align:center">
+							<button type="submit" class="btn btn-primary" style="width:200px">Continue</button>
+						</p>
+						[[else]]
+						<h2>Two-step verification</h2>
+						[[if .Error]]<div class="alert alert-danger">[[.Error]]</div>[[end]]
+						[[if .URI]]
+						<p>Two-step verification is required for your account. Scan this QR code with an authenticator app such as Google Authenticator, or enter the key manually.</p>
+						<p style="text-align:center"><a href="[[.URI]]"><span id="qrcode" data-uri="[[.URI]]"></span></a></p>
+						<p style="text-align:center"><code>[[.Secret]]</code></p>
+						<script>
+							var qr = document.getElementById("qrcode");
+							if (window.QRCode) {
+								new QRCode(qr, qr.getAttribute("data-uri"));
+							}
+						</script>
+						[[end]]
+						<div class="form-group">
+							<label for="otp">Code from your authenticator app</label>
+							<input type="text" class="form-control" id="otp" name="otp" autofocus autocomplete="off" placeholder="123456">
+							[[if not .URI]]<p class="help-block">You can also enter one of your recovery codes.</p>[[end]]
+						</div>
+						<p style="text-align:center">
+							<button type="submit" class="btn btn-primary" style="width:200px">Verify</button>
+						</p>
+						[[end]]
+					</form>
+				</div>
+			</div>
+		</div>
+	</body>
+</html>`
+
+var totpTemplate = template.Must(template.New("totp.html").Delims("[[", "]]").Parse(totpHTML))
+
+// Show the second step of the login: the code prompt, or the enrollment of
+// an administrator who doesn't have TOTP yet
+func renderSecondFactorPage(c context.Context, ar *osin.AuthorizeRequest, w http.ResponseWriter, r *http.Request, email, errorMessage string) {
+	ticket, err := NewVerificationCode(c, email, CODE_LOGIN_MFA, SecondFactorExpiration)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	data := loginFormData(ar, r)
+	data["Email"] = NormalizeEmail(email)
+	data["Ticket"] = ticket
+	data["Error"] = errorMessage
+
+	t, err := GetTOTPSecret(c, email)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if (t == nil) || !t.Enabled {
+		if t == nil {
+			if t, err = BeginTOTPEnrollment(c, email); err != nil {
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		}
+		// html/template would replace the otpauth: scheme with #ZgotmplZ
+		data["URI"] = template.URL(TOTPProvisioningURI(email, t.Secret))
+		data["Secret"] = t.Secret
+	}
+
+	if err := totpTemplate.Execute(w, data); err != nil {
+		log.Infof(c, "Error with totpTemplate: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// Second step of the login, after the password was accepted. Returns true
+// when the authorization can proceed.
+func handleSecondFactor(c context.Context, ar *osin.AuthorizeRequest, w http.ResponseWriter, r *http.Request) bool {
+	log.Infof(c, ">>>> handleSecondFactor")
+
+	email := NormalizeEmail(r.FormValue("email"))
+	ticket := r.FormValue("mfa_ticket")
+
+	// The recovery codes were shown after the enrollment, nothing left to check
+	if r.FormValue("mfa_done") != "" {
+		if err := ConsumeVerificationCode(c, email, ticket, CODE_LOGIN_COMPLETE); err != nil {
+			renderLoginPage(c, ar, w, r, "Your sign in has expired, please sign in again.")
+			return false
+		}
+		return true
+	}
+
+	if err := ConsumeVerificationCode(c, email, ticket, CODE_LOGIN_MFA); err != nil {
+		renderLoginPage(c, ar, w, r, "Your sign in has expired, please sign in again.")
+		return false
+	}
+
+	if wait, err := CheckLoginAllowed(c, email, r.RemoteAddr); err != nil {
+		renderLoginPage(c, ar, w, r, fmt.Sprintf("Too many failed attempts, please try again in %v.", wait.Truncate(time.Second)+time.Second))
+		return false
+	}
+
+	t, err := GetTOTPSecret(c, email)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+
+	if (t != nil) && t.Enabled {
+		err = VerifySecondFactor(c, email, r.FormValue("otp"))
+		if err == ERROR_INVALID_OTP {
+			RecordLoginFailure(c, email, r.RemoteAddr)
+			Audit(r, &AuditEvent{Action: AUDIT_LOGIN_MFA, Outcome: AUDIT_FAILURE, Actor: email, Provider: "Deglon", ClientId: ar.Client.GetId()})
+			renderSecondFactorPage(c, ar, w, r, email, "Wrong code, please try again.")
+			return false
+		} else if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return false
+		}
+		RecordLoginSuccess(c, email, r.RemoteAddr)
+		Audit(r, &AuditEvent{Action: AUDIT_LOGIN_MFA, Outcome: AUDIT_SUCCESS, Actor: email, Provider: "Deglon", ClientId: ar.Client.GetId()})
+		return true
+	}
+
+	codes, err := ConfirmTOTPEnrollment(c, email, r.FormValue("otp"))
+	if err == ERROR_INVALID_OTP || err == ERROR_TOTP_NOT_ENABLED {
+		RecordLoginFailure(c, email, r.RemoteAddr)
+		Audit(r, &AuditEvent{Action: AUDIT_LOGIN_MFA, Outcome: AUDIT_FAILURE, Actor: email, Provider: "Deglon", ClientId: ar.Client.GetId()})
+		renderSecondFactorPage(c, ar, w, r, email, "Wrong code, please check the time of your phone and try again.")
+		return false
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	RecordLoginSuccess(c, email, r.RemoteAddr)
+	Audit(r, &AuditEvent{Action: AUDIT_TOTP_ENROLLED, Outcome: AUDIT_SUCCESS, Actor: email, Provider: "Deglon", ClientId: ar.Client.GetId()})
+	Audit(r, &AuditEvent{Action: AUDIT_LOGIN_MFA, Outcome: AUDIT_SUCCESS, Actor: email, Provider: "Deglon", ClientId: ar.Client.GetId()})
+
+	ticket, err = NewVerificationCode(c, email, CODE_LOGIN_COMPLETE, SecondFactorExpiration)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	data := loginFormData(ar, r)
+	data["Email"] = email
+	data["Ticket"] = ticket
+	data["RecoveryCodes"] = codes
+	if err := totpTemplate.Execute(w, data); err != nil {
+		log.Infof(c, "Error with totpTemplate: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+	return false
+}
+
+// Check the password of a POST to the TOTP endpoints, writing the error
+// response if it fails. Without password, the email is the one of the
+// logged in user and the cookie id of the session is returned too.
+func checkTOTPRequest(c context.Context, w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return "", "", false
+	}
+
+	// Users logged in with Google or Facebook have no local password
+	if r.FormValue("password") == "" {
+		u, cookieID := GetUserAndCookieID(w, r)
+		if (cookieID == "") || (u.UserEmail == "") {
+			http.Error(w, "Login required", http.StatusUnauthorized)
+			return "", "", false
+		}
+		return NormalizeEmail(u.UserEmail), cookieID, true
+	}
+
+	email := NormalizeEmail(r.FormValue("email"))
+	if wait, err := CheckLoginAllowed(c, email, r.RemoteAddr); err != nil {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait.Seconds())+1))
+		http.Error(w, "Too many failed attempts", http.StatusTooManyRequests)
+		return "", "", false
+	}
+
+	_, err := CheckLocalPassword(c, email, r.FormValue("password"))
+	if err == ERROR_BAD_CREDENTIALS || err == ERROR_ACCOUNT_NOT_VERIFIED {
+		RecordLoginFailure(c, email, r.RemoteAddr)
+		http.Error(w, "Wrong email or password", http.StatusUnauthorized)
+		return "", "", false
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return "", "", false
+	}
+	return email, "", true
+}
+
+// Start the TOTP enrollment of a local account, for POST /oauth2/totp/enroll
+// with the email and password. Returns the secret and its provisioning URI.
+func TOTPEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> TOTPEnrollHandler")
+
+	email, _, ok := checkTOTPRequest(c, w, r)
+	if !ok {
+		return
+	}
+
+	t, err := BeginTOTPEnrollment(c, email)
+	if err == ERROR_TOTP_ENABLED {
+		http.Error(w, "Two-factor authentication already enabled", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	common.WriteJSON(w, map[string]string{
+		"secret": t.Secret,
+		"uri":    TOTPProvisioningURI(email, t.Secret),
+	})
+}
+
+// Enable the pending TOTP enrollment, for POST /oauth2/totp/confirm with the
+// email, password and otp. Returns the recovery codes.
+func TOTPConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> TOTPConfirmHandler")
+
+	email, cookieID, ok := checkTOTPRequest(c, w, r)
+	if !ok {
+		return
+	}
+
+	codes, err := ConfirmTOTPEnrollment(c, email, r.FormValue("otp"))
+	if err == ERROR_INVALID_OTP {
+		RecordLoginFailure(c, email, r.RemoteAddr)
+		http.Error(w, "Wrong code", http.StatusUnauthorized)
+		return
+	} else if err == ERROR_TOTP_ENABLED || err == ERROR_TOTP_NOT_ENABLED {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if cookieID != "" {
+		MarkSecondFactorSession(c, cookieID, email)
+	}
+	Audit(r, &AuditEvent{Action: AUDIT_TOTP_ENROLLED, Outcome: AUDIT_SUCCESS, Actor: email})
+	common.WriteJSON(w, map[string]interface{}{
+		"status":         "ok",
+		"recovery_codes": codes,
+	})
+}
+
+// Disable TOTP, for POST /oauth2/totp/disable with the email, password and
+// a current otp or recovery code
+func TOTPDisableHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> TOTPDisableHandler")
+
+	email, _, ok := checkTOTPRequest(c, w, r)
+	if !ok {
+		return
+	}
+
+	// Refused before the code is checked, so that no recovery code is used
+	if IsUserAdmin(c, email) {
+		Audit(r, &AuditEvent{Action: AUDIT_TOTP_DISABLED, Outcome: AUDIT_DENIED, Actor: email})
+		http.Error(w, ERROR_TOTP_REQUIRED.Error(), http.StatusForbidden)
+		return
+	}
+
+	err := VerifySecondFactor(c, email, r.FormValue("otp"))
+	if err == ERROR_INVALID_OTP {
+		RecordLoginFailure(c, email, r.RemoteAddr)
+		http.Error(w, "Wrong code", http.StatusUnauthorized)
+		return
+	} else if err == ERROR_TOTP_NOT_ENABLED {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := DisableTOTP(c, email); err == ERROR_TOTP_REQUIRED {
+		Audit(r, &AuditEvent{Action: AUDIT_TOTP_DISABLED, Outcome: AUDIT_DENIED, Actor: email})
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	Audit(r, &AuditEvent{Action: AUDIT_TOTP_DISABLED, Outcome: AUDIT_SUCCESS, Actor: email})
+
+	common.WriteJSON(w, map[string]string{"status": "ok"})
+}
+
+// Enter the second factor in the current session, for POST
+// /oauth2/totp/session with the otp or a recovery code. Required before the
+// users who need a second factor can use their permissions.
+func TOTPSessionHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> TOTPSessionHandler")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u, cookieID := GetUserAndCookieID(w, r)
+	if (cookieID == "") || (u.UserEmail == "") {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
+	email := NormalizeEmail(u.UserEmail)
+
+	if wait, err := CheckLoginAllowed(c, email, r.RemoteAddr); err != nil {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait.Seconds())+1))
+		http.Error(w, "Too many failed attempts", http.StatusTooManyRequests)
+		return
+	}
+
+	err := VerifySecondFactor(c, email, r.FormValue("otp"))
+	if err == ERROR_INVALID_OTP {
+		RecordLoginFailure(c, email, r.RemoteAddr)
+		Audit(r, &AuditEvent{Action: AUDIT_LOGIN_MFA, Outcome: AUDIT_FAILURE, Actor: email, Provider: u.LoginProvider})
+		http.Error(w, "Wrong code", http.StatusUnauthorized)
+		return
+	} else if err == ERROR_TOTP_NOT_ENABLED {
+		http.Error(w, "Enroll in two-factor authentication first", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := MarkSecondFactorSession(c, cookieID, email); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	RecordLoginSuccess(c, email, r.RemoteAddr)
+	Audit(r, &AuditEvent{Action: AUDIT_LOGIN_MFA, Outcome: AUDIT_SUCCESS, Actor: email, Provider: u.LoginProvider})
+
+	common.WriteJSON(w, map[string]string{"status": "ok"})
+}
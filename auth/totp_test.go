@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// Secret of the SHA1 test vectors of RFC 6238 appendix B
+var rfc6238Secret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+// Last 6 digits of the 8 digit codes of RFC 6238 appendix B
+var rfc6238Vectors = []struct {
+	time int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestTOTPCode(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		code, err := totpCode(rfc6238Secret, v.time/totpPeriod)
+		if err != nil {
+			t.Fatalf("totpCode: %v", err)
+		}
+		if code != v.code {
+			t.Errorf("code at %v: %v, want %v", v.time, code, v.code)
+		}
+	}
+
+	if _, err := totpCode("not base32!", 1); err == nil {
+		t.Errorf("totpCode: no error on an invalid secret")
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		now := time.Unix(v.time, 0)
+		step, err := matchTOTP(rfc6238Secret, v.code, now)
+		if err != nil {
+			t.Errorf("matchTOTP at %v: %v", v.time, err)
+		} else if step != v.time/totpPeriod {
+			t.Errorf("matchTOTP at %v: step %v, want %v", v.time, step, v.time/totpPeriod)
+		}
+
+		// Accepted within TOTPSkew steps, refused after
+		if _, err := matchTOTP(rfc6238Secret, v.code, now.Add(totpPeriod*time.Second)); err != nil {
+			t.Errorf("matchTOTP one step later at %v: %v", v.time, err)
+		}
+		if _, err := matchTOTP(rfc6238Secret, v.code, now.Add(3*totpPeriod*time.Second)); err != ERROR_INVALID_OTP {
+			t.Errorf("matchTOTP three steps later at %v: %v, want %v", v.time, err, ERROR_INVALID_OTP)
+		}
+	}
+
+	now := time.Unix(59, 0)
+	for _, code := range []string{"287 082", " 287082 "} {
+		if _, err := matchTOTP(rfc6238Secret, code, now); err != nil {
+			t.Errorf("matchTOTP %q: %v", code, err)
+		}
+	}
+	for _, code := range []string{"", "28708", "2870821", "000000"} {
+		if _, err := matchTOTP(rfc6238Secret, code, now); err != ERROR_INVALID_OTP {
+			t.Errorf("matchTOTP %q: %v, want %v", code, err, ERROR_INVALID_OTP)
+		}
+	}
+}
@@ -1,121 +1,272 @@
-package common
-
-import (
-	"errors"
-	"golang.org/x/net/context"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	bigquery "google.golang.org/api/bigquery/v2"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/urlfetch"
-	"net/http"
-	"time"
-)
-
-func GetBQServiceAccountClient(c context.Context) (*bigquery.Service, error) {
-
-	serviceAccountClient := &http.Client{
-		Transport: &oauth2.Transport{
-			Source: google.AppEngineTokenSource(c,
-				"https://www.googleapis.com/auth/userinfo.email",
-				"https://www.googleapis.com/auth/bigquery"),
-			Base: &urlfetch.Transport{
-				Context: c,
-			},
-		},
-	}
-	return bigquery.New(serviceAccountClient)
-}
-
-func CreateTableInBigQuery(c context.Context, newTable *bigquery.Table) error {
-
-	if newTable == nil {
-		return errors.New("No newTable defined for CreateTableInBigQuery")
-	}
-
-	if newTable.TableReference == nil {
-		return errors.New("No newTable.TableReference defined for CreateTableInBigQuery")
-	}
-
-	if newTable.Schema == nil {
-		return errors.New("No newTable.Schema defined for CreateTableInBigQuery")
-	}
-
-	bqServiceAccountService, err := GetBQServiceAccountClient(c)
-	if err != nil {
-		log.Errorf(c, "Error getting BigQuery Service: %v", err)
-		return err
-	}
-
-	err = bigquery.
-		NewTablesService(bqServiceAccountService).
-		Delete(
-		newTable.TableReference.ProjectId,
-		newTable.TableReference.DatasetId,
-		newTable.TableReference.TableId).
-		Do()
-	if err != nil {
-		log.Warningf(c, "There was an error while trying to delete old snapshot table: %v", err)
-	}
-
-	_, err = bigquery.
-		NewTablesService(bqServiceAccountService).
-		Insert(
-		newTable.TableReference.ProjectId,
-		newTable.TableReference.DatasetId,
-		newTable).
-		Do()
-
-	return err
-}
-
-func StreamDataInBigquery(c context.Context, projectId, datasetId, tableId string, req *bigquery.TableDataInsertAllRequest) error {
-
-	if req == nil {
-		return errors.New("No req defined for StreamDataInBigquery")
-	}
-
-	bqServiceAccountService, err := GetBQServiceAccountClient(c)
-	if err != nil {
-		log.Errorf(c, "Error getting BigQuery Service: %v", err)
-		return err
-	}
-
-	resp, err := bigquery.
-		NewTabledataService(bqServiceAccountService).
-		InsertAll(projectId, datasetId, tableId, req).
-		Do()
-	if err != nil {
-		log.Warningf(c, "Error streaming data to Big Query, trying again in 10 seconds: %v", err)
-		time.Sleep(time.Second * 10)
-		resp, err = bigquery.
-			NewTabledataService(bqServiceAccountService).
-			InsertAll(projectId, datasetId, tableId, req).
-			Do()
-		if err != nil {
-			log.Errorf(c, "Error again streaming data to Big Query: %v", err)
-			return err
-		} else {
-			log.Infof(c, "2nd try was successful")
-		}
-	}
-
-	isError := false
-	for i, insertError := range resp.InsertErrors {
-		if insertError != nil {
-			for j, e := range insertError.Errors {
-				if (e.DebugInfo != "") || (e.Message != "") || (e.Reason != "") {
-					log.Errorf(c, "BigQuery error %v: %v at %v/%v", e.Reason, e.Message, i, j)
-					isError = true
-				}
-			}
-		}
-	}
-
-	if isError {
-		return errors.New("There was an error streaming data to Big Query")
-	}
-
-	return nil
-
-}
+package common
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	bigquery "google.golang.org/api/bigquery/v2"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+	"net/http"
+	"time"
+)
+
+func GetBQServiceAccountClient(c context.Context) (*bigquery.Service, error) {
+
+	serviceAccountClient := &http.Client{
+		Transport: &oauth2.Transport{
+			Source: google.AppEngineTokenSource(c,
+				"https://www.googleapis.com/auth/userinfo.email",
+				"https://www.googleapis.com/auth/bigquery"),
+			Base: &urlfetch.Transport{
+				Context: c,
+			},
+		},
+	}
+	return bigquery.New(serviceAccountClient)
+}
+
+func CreateTableInBigQuery(c context.Context, newTable *bigquery.Table) error {
+
+	if newTable == nil {
+		return errors.New("No newTable defined for CreateTableInBigQuery")
+	}
+
+	if newTable.TableReference == nil {
+		return errors.New("No newTable.TableReference defined for CreateTableInBigQuery")
+	}
+
+	if newTable.Schema == nil {
+		return errors.New("No newTable.Schema defined for CreateTableInBigQuery")
+	}
+
+	bqServiceAccountService, err := GetBQServiceAccountClient(c)
+	if err != nil {
+		log.Errorf(c, "Error getting BigQuery Service: %v", err)
+		return err
+	}
+
+	err = bigquery.
+		NewTablesService(bqServiceAccountService).
+		Delete(
+		newTable.TableReference.ProjectId,
+		newTable.TableReference.DatasetId,
+		newTable.TableReference.TableId).
+		Do()
+	if err != nil {
+		log.Warningf(c, "There was an error while trying to delete old snapshot table: %v", err)
+	}
+
+	_, err = bigquery.
+		NewTablesService(bqServiceAccountService).
+		Insert(
+		newTable.TableReference.ProjectId,
+		newTable.TableReference.DatasetId,
+		newTable).
+		Do()
+
+	return err
+}
+
+// Replace the schema of an existing table with the schema of table, to add
+// the new nullable columns without recreating the table and its rows
+func PatchTableSchemaInBigQuery(c context.Context, table *bigquery.Table) error {
+
+	if (table == nil) || (table.TableReference == nil) || (table.Schema == nil) {
+		return errors.New("No table, TableReference or Schema defined for PatchTableSchemaInBigQuery")
+	}
+
+	bqServiceAccountService, err := GetBQServiceAccountClient(c)
+	if err != nil {
+		log.Errorf(c, "Error getting BigQuery Service: %v", err)
+		return err
+	}
+
+	_, err = bigquery.
+		NewTablesService(bqServiceAccountService).
+		Patch(
+		table.TableReference.ProjectId,
+		table.TableReference.DatasetId,
+		table.TableReference.TableId,
+		&bigquery.Table{Schema: table.Schema}).
+		Do()
+
+	return err
+}
+
+// Create or replace a standard SQL view
+func CreateViewInBigQuery(c context.Context, projectId, datasetId, tableId, query string) error {
+
+	bqServiceAccountService, err := GetBQServiceAccountClient(c)
+	if err != nil {
+		log.Errorf(c, "Error getting BigQuery Service: %v", err)
+		return err
+	}
+
+	err = bigquery.
+		NewTablesService(bqServiceAccountService).
+		Delete(projectId, datasetId, tableId).
+		Do()
+	if err != nil {
+		log.Warningf(c, "There was an error while trying to delete old view: %v", err)
+	}
+
+	_, err = bigquery.
+		NewTablesService(bqServiceAccountService).
+		Insert(projectId, datasetId, &bigquery.Table{
+			TableReference: &bigquery.TableReference{
+				ProjectId: projectId,
+				DatasetId: datasetId,
+				TableId:   tableId,
+			},
+			View: &bigquery.ViewDefinition{
+				Query:           query,
+				UseLegacySql:    false,
+				ForceSendFields: []string{"UseLegacySql"},
+			},
+		}).
+		Do()
+
+	return err
+}
+
+func StreamDataInBigquery(c context.Context, projectId, datasetId, tableId string, req *bigquery.TableDataInsertAllRequest) error {
+
+	if req == nil {
+		return errors.New("No req defined for StreamDataInBigquery")
+	}
+
+	bqServiceAccountService, err := GetBQServiceAccountClient(c)
+	if err != nil {
+		log.Errorf(c, "Error getting BigQuery Service: %v", err)
+		return err
+	}
+
+	resp, err := bigquery.
+		NewTabledataService(bqServiceAccountService).
+		InsertAll(projectId, datasetId, tableId, req).
+		Do()
+	if err != nil {
+		log.Warningf(c, "Error streaming data to Big Query, trying again in 10 seconds: %v", err)
+		time.Sleep(time.Second * 10)
+		resp, err = bigquery.
+			NewTabledataService(bqServiceAccountService).
+			InsertAll(projectId, datasetId, tableId, req).
+			Do()
+		if err != nil {
+			log.Errorf(c, "Error again streaming data to Big Query: %v", err)
+			return err
+		} else {
+			log.Infof(c, "2nd try was successful")
+		}
+	}
+
+	isError := false
+	for i, insertError := range resp.InsertErrors {
+		if insertError != nil {
+			for j, e := range insertError.Errors {
+				if (e.DebugInfo != "") || (e.Message != "") || (e.Reason != "") {
+					log.Errorf(c, "BigQuery error %v: %v at %v/%v", e.Reason, e.Message, i, j)
+					isError = true
+				}
+			}
+		}
+	}
+
+	if isError {
+		return errors.New("There was an error streaming data to Big Query")
+	}
+
+	return nil
+
+}
+
+// Parameter of a standard SQL query holding an array of strings, used as
+// "IN UNNEST(@name)"
+func StringArrayQueryParameter(name string, values []string) *bigquery.QueryParameter {
+	var arrayValues []*bigquery.QueryParameterValue
+	for _, v := range values {
+		arrayValues = append(arrayValues, &bigquery.QueryParameterValue{Value: v})
+	}
+	return &bigquery.QueryParameter{
+		Name: name,
+		ParameterType: &bigquery.QueryParameterType{
+			Type:      "ARRAY",
+			ArrayType: &bigquery.QueryParameterType{Type: "STRING"},
+		},
+		ParameterValue: &bigquery.QueryParameterValue{ArrayValues: arrayValues},
+	}
+}
+
+// Run a standard SQL statement and wait for it. Returns the rows as maps of
+// column name to value, and the number of rows changed by a DML statement.
+func RunQueryInBigQuery(c context.Context, projectId, query string, params []*bigquery.QueryParameter) ([]map[string]interface{}, int64, error) {
+
+	bqServiceAccountService, err := GetBQServiceAccountClient(c)
+	if err != nil {
+		log.Errorf(c, "Error getting BigQuery Service: %v", err)
+		return nil, 0, err
+	}
+
+	useLegacySql := false
+	resp, err := bigquery.
+		NewJobsService(bqServiceAccountService).
+		Query(projectId, &bigquery.QueryRequest{
+			Query:           query,
+			QueryParameters: params,
+			UseLegacySql:    &useLegacySql,
+			TimeoutMs:       30000,
+		}).
+		Do()
+	if err != nil {
+		log.Errorf(c, "Error running query in BigQuery: %v", err)
+		return nil, 0, err
+	}
+
+	schema := resp.Schema
+	rows := resp.Rows
+	affected := resp.NumDmlAffectedRows
+	complete := resp.JobComplete
+	pageToken := resp.PageToken
+	for !complete || (pageToken != "") {
+		if resp.JobReference == nil {
+			return nil, 0, errors.New("No job reference returned by BigQuery")
+		}
+		results, err := bigquery.
+			NewJobsService(bqServiceAccountService).
+			GetQueryResults(projectId, resp.JobReference.JobId).
+			Location(resp.JobReference.Location).
+			PageToken(pageToken).
+			TimeoutMs(30000).
+			Do()
+		if err != nil {
+			log.Errorf(c, "Error getting query results from BigQuery: %v", err)
+			return nil, 0, err
+		}
+		if len(results.Errors) > 0 {
+			return nil, 0, errors.New(results.Errors[0].Message)
+		}
+		complete = results.JobComplete
+		if complete {
+			schema = results.Schema
+			rows = append(rows, results.Rows...)
+			affected = results.NumDmlAffectedRows
+			pageToken = results.PageToken
+		}
+	}
+
+	var records []map[string]interface{}
+	if schema != nil {
+		for _, row := range rows {
+			record := map[string]interface{}{}
+			for i, cell := range row.F {
+				if i < len(schema.Fields) {
+					record[schema.Fields[i].Name] = cell.V
+				}
+			}
+			records = append(records, record)
+		}
+	}
+	return records, affected, nil
+}
@@ -0,0 +1,289 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/mail"
+	"google.golang.org/appengine/memcache"
+	"google.golang.org/appengine/urlfetch"
+	"html/template"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// Sinks notified of the errors reported with ServeError and ReportError
+	ErrorSinks = []ErrorSink{}
+
+	// A sink is notified of an error at most once per interval, the
+	// occurrences in between are counted in Suppressed. Sinks implementing
+	// ThrottledErrorSink choose their own interval.
+	ErrorNotificationInterval = 10 * time.Minute
+)
+
+// Error of a request, grouped with the other occurrences of the same error
+// by Fingerprint
+type ErrorReport struct {
+	Fingerprint string    `json:"fingerprint"`
+	Title       string    `json:"title"`
+	Message     string    `json:"message"`
+	Error       string    `json:"error,omitempty"`
+	Code        int       `json:"code"`
+	Fatal       bool      `json:"fatal"`
+	Time        time.Time `json:"time"`
+	Host        string    `json:"host,omitempty"`
+	Method      string    `json:"method,omitempty"`
+	URL         string    `json:"url,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	Stack       string    `json:"stack,omitempty"`
+	// Occurrences not notified to the sink since its last notification
+	Suppressed uint64 `json:"suppressed,omitempty"`
+	// Event of the request, for the GA sink
+	event GAEvent
+}
+
+// Destination of the error notifications
+type ErrorSink interface {
+	ReportError(c context.Context, e *ErrorReport) error
+}
+
+// Sink with its own notification interval, 0 to be notified of every
+// occurrence
+type ThrottledErrorSink interface {
+	ErrorSink
+	NotificationInterval() time.Duration
+}
+
+// Email to the administrators, from an address allowed to send mail
+type EmailErrorSink struct {
+	Sender    string
+	To        []string
+	FatalOnly bool
+}
+
+func (s *EmailErrorSink) ReportError(c context.Context, e *ErrorReport) error {
+	if s.FatalOnly && !e.Fatal {
+		return nil
+	}
+	subject := "Error " + e.Title
+	if e.Fatal {
+		subject = "Fatal Error " + e.Title
+	}
+	body := fmt.Sprintf("There was an error on %v at %v: %v\n", e.Host, e.Time, e.Message)
+	if e.Error != "" {
+		body += e.Error + "\n"
+	}
+	if e.Suppressed > 0 {
+		body += fmt.Sprintf("\nIt occurred %v more times since the last email.\n", e.Suppressed)
+	}
+	body += fmt.Sprintf("\n%v %v\nFingerprint: %v\n\n%v", e.Method, e.URL, e.Fingerprint, e.Stack)
+	return mail.Send(c, &mail.Message{
+		Sender:  s.Sender,
+		To:      s.To,
+		Subject: subject,
+		Body:    body,
+	})
+}
+
+// JSON of the report posted to a URL. The "text" field makes it usable as a
+// Slack incoming webhook.
+type WebhookErrorSink struct {
+	URL string
+}
+
+func (s *WebhookErrorSink) ReportError(c context.Context, e *ErrorReport) error {
+	text := fmt.Sprintf("%v on %v: %v", e.Title, e.Host, e.Message)
+	if e.Suppressed > 0 {
+		text += fmt.Sprintf(" (%v more since the last notification)", e.Suppressed)
+	}
+	body, err := json.Marshal(struct {
+		Text string `json:"text"`
+		*ErrorReport
+	}{text, e})
+	if err != nil {
+		return err
+	}
+	resp, err := urlfetch.Client(c).Post(s.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook answered %v", resp.Status)
+	}
+	return nil
+}
+
+// Exception hit queued for Google Analytics, for every occurrence
+type GAErrorSink struct {
+	PropertyID string
+}
+
+func (s *GAErrorSink) ReportError(c context.Context, e *ErrorReport) error {
+	hit, err := GAExceptionHit(e.event, e.Title+": "+e.Message, e.Fatal)
+	if err != nil {
+		return err
+	}
+	return QueueGAHit(c, s.PropertyID, hit)
+}
+
+func (s *GAErrorSink) NotificationInterval() time.Duration {
+	return 0
+}
+
+// Goroutine ids, arguments and offsets change between occurrences
+var stackNoiseRegexp = regexp.MustCompile(`\(0x[0-9a-fA-F, .]*\)|\(\.\.\.\)|\+0x[0-9a-f]+|^goroutine \d+.*$`)
+
+// Fingerprint of an error: the message and the call stack, without what
+// changes from an occurrence to the other
+func errorFingerprint(message, stack string) string {
+	h := sha256.New()
+	h.Write([]byte(message))
+	for _, line := range strings.Split(stack, "\n") {
+		line = strings.TrimSpace(stackNoiseRegexp.ReplaceAllString(line, ""))
+		if line != "" {
+			h.Write([]byte("\n" + line))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// Whether the sink i can be notified of the error now. The occurrences
+// not notified are counted and returned with the next notification.
+func allowErrorNotification(c context.Context, i int, s ErrorSink, e *ErrorReport) (bool, uint64) {
+	interval := ErrorNotificationInterval
+	if t, ok := s.(ThrottledErrorSink); ok {
+		interval = t.NotificationInterval()
+	}
+	if interval <= 0 {
+		return true, 0
+	}
+	key := "error-" + strconv.Itoa(i) + "-" + e.Fingerprint
+	err := memcache.Add(c, &memcache.Item{Key: key, Value: []byte("1"), Expiration: interval})
+	if err == memcache.ErrNotStored {
+		memcache.Increment(c, key+"-suppressed", 1, 0)
+		return false, 0
+	}
+	// On a memcache failure, notifying is better than losing the error
+	var suppressed uint64
+	if item, err := memcache.Get(c, key+"-suppressed"); err == nil {
+		suppressed, _ = strconv.ParseUint(string(item.Value), 10, 64)
+		memcache.Delete(c, key+"-suppressed")
+	}
+	return true, suppressed
+}
+
+// Log an error of a request and notify the sinks, each at most once per
+// notification interval for errors of the same fingerprint
+func ReportError(r *http.Request, title, message string, err error, code int, fatal bool) *ErrorReport {
+	return reportError(r, title, message, err, code, fatal, ErrorSinks)
+}
+
+func reportError(r *http.Request, title, message string, err error, code int, fatal bool, sinks []ErrorSink) *ErrorReport {
+	c := appengine.NewContext(r)
+	stack := string(debug.Stack())
+	e := &ErrorReport{
+		Fingerprint: errorFingerprint(message, stack),
+		Title:       title,
+		Message:     message,
+		Code:        code,
+		Fatal:       fatal,
+		Time:        time.Now(),
+		Host:        r.Host,
+		Method:      r.Method,
+		URL:         r.URL.String(),
+		UserAgent:   r.UserAgent(),
+		Stack:       stack,
+		event:       GetEvent(r),
+	}
+	if err != nil {
+		e.Error = err.Error()
+		log.Errorf(c, "%v: %v [%v]", message, err, e.Fingerprint)
+	} else {
+		log.Errorf(c, "%v [%v]", message, e.Fingerprint)
+	}
+
+	for i, s := range sinks {
+		ok, suppressed := allowErrorNotification(c, i, s, e)
+		if !ok {
+			continue
+		}
+		notified := *e
+		notified.Suppressed = suppressed
+		if err := s.ReportError(c, &notified); err != nil {
+			log.Errorf(c, "ReportError: Error notifying sink %v: %v", i, err)
+		}
+	}
+	return e
+}
+
+var errorHTML = `<html>
+<head>
+	<title>[[.Title]]</title>
+  	<meta name="viewport" content="width=device-width, initial-scale=1">
+  	<link href="/lib/bootstrap-3.3.4/css/bootstrap.min.css" rel="stylesheet">
+</head>
+<body>
+	<div class="container">
+		<div class="row">
+			<div class="col-xs-12 col-sm-12 col-md-12 col-lg-12">
+				<h2>[[.Title]]</h2>
+				<p>Reference: [[.Fingerprint]]</p>
+				Click <a href="/">here</a> to continue.
+			</div>
+		</div>
+	</div>
+</body>
+</html>`
+
+var errorTemplate = template.
+	Must(template.
+		New("error.html").
+		Delims("[[", "]]").
+		Parse(errorHTML))
+
+// Whether the client of the request expects JSON rather than a page
+func WantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") ||
+		(r.Header.Get("X-Requested-With") == "XMLHttpRequest") ||
+		(!strings.Contains(accept, "text/html") && strings.Contains(r.Header.Get("Content-Type"), "application/json"))
+}
+
+// Answer an error with its code, as JSON or as an HTML page depending on
+// the request. Only the title and the fingerprint are shown, the message
+// may hold internal details.
+func RenderError(w http.ResponseWriter, r *http.Request, e *ErrorReport) {
+	w.Header().Set("Cache-Control", "no-store")
+	if WantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(e.Code)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":     e.Title,
+			"code":      e.Code,
+			"reference": e.Fingerprint,
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(e.Code)
+	if err := errorTemplate.Execute(w, e); err != nil {
+		log.Errorf(appengine.NewContext(r), "Error with errorTemplate: %v", err)
+	}
+}
+
+// Report an error to the sinks and answer the request with it
+func ServeError(w http.ResponseWriter, r *http.Request, title, message string, err error, code int, fatal bool) {
+	EnsureGAClientID(w, r)
+	RenderError(w, r, ReportError(r, title, message, err, code, fatal))
+}
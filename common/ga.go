@@ -1,271 +1,285 @@
-package common
-
-import (
-	"bytes"
-	"fmt"
-	"golang.org/x/net/context"
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/mail"
-	"google.golang.org/appengine/urlfetch"
-	"net/http"
-	"net/url"
-	"strings"
-	"time"
-)
-
-var (
-	PropertyID string = "UA-63208527-1"
-	// PropertyID string = "UA-68699208-1"
-)
-
-// https://developers.google.com/analytics/devguides/collection/protocol/v1/parameters
-type GAEvent struct {
-	CampaignContent        string `json:"CampaignContent,omitempty"`
-	CustomDimension1       string `json:"CustomDimension1,omitempty"`
-	CustomDimension2       string `json:"CustomDimension2,omitempty"`
-	CustomDimension3       string `json:"CustomDimension3,omitempty"`
-	CustomDimension4       string `json:"CustomDimension4,omitempty"`
-	CustomDimension5       string `json:"CustomDimension5,omitempty"`
-	CustomDimension6       string `json:"CustomDimension6,omitempty"`
-	CustomDimension7       string `json:"CustomDimension7,omitempty"`
-	CustomDimension8       string `json:"CustomDimension8,omitempty"`
-	CustomDimension9       string `json:"CustomDimension9,omitempty"`
-	Guid                   string `json:"Guid,omitempty"`
-	UserId                 string `json:"UserId,omitempty"`
-	CampaignKeyword        string `json:"CampaignKeyword,omitempty"`
-	CampaignMedium         string `json:"CampaignMedium,omitempty"`
-	CustomMetric1          string `json:"CustomMetric1,omitempty"`
-	CustomMetric2          string `json:"CustomMetric2,omitempty"`
-	CustomMetric3          string `json:"CustomMetric3,omitempty"`
-	CustomMetric4          string `json:"CustomMetric4,omitempty"`
-	CustomMetric5          string `json:"CustomMetric5,omitempty"`
-	CustomMetric6          string `json:"CustomMetric6,omitempty"`
-	CustomMetric7          string `json:"CustomMetric7,omitempty"`
-	CustomMetric8          string `json:"CustomMetric8,omitempty"`
-	CustomMetric9          string `json:"CustomMetric9,omitempty"`
-	CampaignName           string `json:"CampaignName,omitempty"`
-	CampaignSource         string `json:"CampaignSource,omitempty"`
-	CurrencyCode           string `json:"CurrencyCode,omitempty"`
-	DocumentHostName       string `json:"DocumentHostName,omitempty"`
-	DocumentLocationURL    string `json:"DocumentLocationURL,omitempty"`
-	DocumentPath           string `json:"DocumentPath,omitempty"`
-	Referer                string `json:"Referer,omitempty"`
-	DocumentTitle          string `json:"DocumentTitle,omitempty"`
-	Action                 string `json:"Action,omitempty"`
-	Category               string `json:"Category,omitempty"`
-	Label                  string `json:"Label,omitempty"`
-	Value                  string `json:"Value,omitempty"`
-	ExceptionDescription   string `json:"ExceptionDescription,omitempty"`
-	IsExceptionFatal       string `json:"IsExceptionFatal,omitempty"`
-	GoogleAdWordsID        string `json:"GoogleAdWordsID,omitempty"`
-	ItemCode               string `json:"ItemCode,omitempty"`
-	ItemName               string `json:"ItemName,omitempty"`
-	ItemPrice              string `json:"ItemPrice,omitempty"`
-	ItemQuantity           string `json:"ItemQuantity,omitempty"`
-	ItemCategory           string `json:"ItemCategory,omitempty"`
-	SocialAction           string `json:"SocialAction,omitempty"`
-	SocialNetwork          string `json:"SocialNetwork,omitempty"`
-	SocialActionTarget     string `json:"SocialActionTarget,omitempty"`
-	TransactionAffiliation string `json:"TransactionAffiliation,omitempty"`
-	TransactionID          string `json:"TransactionID,omitempty"`
-	TransactionShipping    string `json:"TransactionShipping,omitempty"`
-	TransactionTax         string `json:"TransactionTax,omitempty"`
-	Agent                  string `json:"Agent,omitempty"`
-	IP                     string `json:"IP,omitempty"`
-	UserLanguage           string `json:"UserLanguage,omitempty"`
-	ExperimentID           string `json:"ExperimentID,omitempty"`
-	ExperimentVariant      string `json:"ExperimentVariant,omitempty"`
-}
-
-func setIfNotEmpty(v *url.Values, key string, value string) {
-	if value != "" {
-		v.Set(key, value)
-	}
-}
-
-func setEvent(etype string, event GAEvent) url.Values {
-	v := url.Values{}
-	v.Set("v", "1")
-	v.Set("t", etype)
-
-	setIfNotEmpty(&v, "cc", event.CampaignContent)
-	setIfNotEmpty(&v, "cd1", event.CustomDimension1)
-	setIfNotEmpty(&v, "cd2", event.CustomDimension2)
-	setIfNotEmpty(&v, "cd3", event.CustomDimension3)
-	setIfNotEmpty(&v, "cd4", event.CustomDimension4)
-	setIfNotEmpty(&v, "cd5", event.CustomDimension5)
-	setIfNotEmpty(&v, "cd6", event.CustomDimension6)
-	setIfNotEmpty(&v, "cd7", event.CustomDimension7)
-	setIfNotEmpty(&v, "cd8", event.CustomDimension8)
-	setIfNotEmpty(&v, "cd9", event.CustomDimension9)
-	setIfNotEmpty(&v, "cid", event.Guid)
-	setIfNotEmpty(&v, "uid", event.UserId)
-	setIfNotEmpty(&v, "ck", event.CampaignKeyword)
-	setIfNotEmpty(&v, "cm", event.CampaignMedium)
-	setIfNotEmpty(&v, "cm1", event.CustomMetric1)
-	setIfNotEmpty(&v, "cm2", event.CustomMetric2)
-	setIfNotEmpty(&v, "cm3", event.CustomMetric3)
-	setIfNotEmpty(&v, "cm4", event.CustomMetric4)
-	setIfNotEmpty(&v, "cm5", event.CustomMetric5)
-	setIfNotEmpty(&v, "cm6", event.CustomMetric6)
-	setIfNotEmpty(&v, "cm7", event.CustomMetric7)
-	setIfNotEmpty(&v, "cm8", event.CustomMetric8)
-	setIfNotEmpty(&v, "cm9", event.CustomMetric9)
-	setIfNotEmpty(&v, "cn", event.CampaignName)
-	setIfNotEmpty(&v, "cs", event.CampaignSource)
-	setIfNotEmpty(&v, "cu", event.CurrencyCode)
-	setIfNotEmpty(&v, "dh", event.DocumentHostName)
-	setIfNotEmpty(&v, "dl", event.DocumentLocationURL)
-	setIfNotEmpty(&v, "dp", event.DocumentPath)
-	setIfNotEmpty(&v, "dr", event.Referer)
-	setIfNotEmpty(&v, "dt", event.DocumentTitle)
-	setIfNotEmpty(&v, "ea", event.Action)
-	setIfNotEmpty(&v, "ec", event.Category)
-	setIfNotEmpty(&v, "el", event.Label)
-	setIfNotEmpty(&v, "ev", event.Value)
-	setIfNotEmpty(&v, "exd", event.ExceptionDescription)
-	setIfNotEmpty(&v, "exf", event.IsExceptionFatal)
-	setIfNotEmpty(&v, "gclid", event.GoogleAdWordsID)
-	setIfNotEmpty(&v, "ic", event.ItemCode)
-	setIfNotEmpty(&v, "in", event.ItemName)
-	setIfNotEmpty(&v, "ip", event.ItemPrice)
-	setIfNotEmpty(&v, "iq", event.ItemQuantity)
-	setIfNotEmpty(&v, "iv", event.ItemCategory)
-	setIfNotEmpty(&v, "sa", event.SocialAction)
-	setIfNotEmpty(&v, "sn", event.SocialNetwork)
-	setIfNotEmpty(&v, "st", event.SocialActionTarget)
-	setIfNotEmpty(&v, "ta", event.TransactionAffiliation)
-	setIfNotEmpty(&v, "ti", event.TransactionID)
-	setIfNotEmpty(&v, "ts", event.TransactionShipping)
-	setIfNotEmpty(&v, "tt", event.TransactionTax)
-	setIfNotEmpty(&v, "ua", event.Agent)
-	setIfNotEmpty(&v, "uip", event.IP)
-	setIfNotEmpty(&v, "ul", event.UserLanguage)
-	setIfNotEmpty(&v, "xid", event.ExperimentID)
-	setIfNotEmpty(&v, "xvar", event.ExperimentVariant)
-
-	return v
-}
-
-func GetEvent(r *http.Request) GAEvent {
-	guid := ""
-	cookie, err := r.Cookie("ID")
-	if err == nil {
-		if cookie != nil {
-			guid = cookie.Value
-		}
-	}
-	if guid == "" {
-		guid = Encrypt(appengine.NewContext(r), "", MD5(r.RemoteAddr+r.Header.Get("User-Agent")))
-	}
-
-	query := ""
-	if r.Header.Get("Referer") != "" {
-		if refererUrl, err := url.Parse(r.Header.Get("Referer")); err == nil {
-			query = refererUrl.Query().Get("q")
-		}
-	}
-	if query == "" {
-		query = r.FormValue("k")
-	}
-
-	socialNetwork := ""
-	referer := strings.ToLower(r.Referer())
-	switch {
-	case strings.Contains(referer, "facebook"):
-		socialNetwork = "Facebook"
-	case strings.Contains(referer, "twitter"):
-		socialNetwork = "Twitter"
-	case strings.Contains(referer, "linkedin"):
-		socialNetwork = "LinkedIn"
-	}
-
-	event := GAEvent{
-		Guid:                guid,
-		IP:                  r.RemoteAddr,
-		DocumentHostName:    r.Host,
-		DocumentLocationURL: r.RequestURI,
-		DocumentPath:        r.URL.Path,
-		Referer:             r.Referer(),
-		DocumentTitle:       r.URL.Path,
-		Agent:               r.Header.Get("User-Agent"),
-		UserLanguage:        r.Header.Get("Accept-Language"),
-		CampaignKeyword:     query,
-		CampaignName:        r.FormValue("cm"),
-		SocialNetwork:       socialNetwork,
-	}
-
-	return event
-}
-
-func TrackGAPage(c context.Context, PropertyID string, event GAEvent) {
-	endpointUrl := "https://www.google-analytics.com/collect?"
-	v := setEvent("pageview", event)
-	v.Set("tid", PropertyID)
-	payload_data := v.Encode()
-	log.Infof(c, "GA: Calling %v with %v", endpointUrl, payload_data)
-
-	req, err := http.NewRequest("POST", endpointUrl, bytes.NewBufferString(payload_data))
-	if err != nil {
-		log.Errorf(c, "Error while tracking Google Analytics: %v", err)
-		return
-	}
-	resp, err := urlfetch.Client(c).Do(req)
-	if err != nil {
-		log.Errorf(c, "Error while tracking Google Analytics: %v", err)
-		return
-	}
-
-	log.Debugf(c, "GA status code %v", resp.StatusCode)
-}
-
-func TrackGAEvent(c context.Context, PropertyID string, event GAEvent) {
-	endpointUrl := "https://www.google-analytics.com/collect?"
-	v := setEvent("pageview", event)
-	v.Set("tid", PropertyID)
-	payload_data := v.Encode()
-	log.Infof(c, "GA: Calling %v with %v", endpointUrl, payload_data)
-
-	req, err := http.NewRequest("POST", endpointUrl, bytes.NewBufferString(payload_data))
-	if err != nil {
-		log.Errorf(c, "Error while tracking Google Analytics: %v", err)
-		return
-	}
-	resp, err := urlfetch.Client(c).Do(req)
-	if err != nil {
-		log.Errorf(c, "Error while tracking Google Analytics: %v", err)
-		return
-	}
-
-	log.Debugf(c, "GA status code %v", resp.StatusCode)
-}
-
-func GATrackServeError(w http.ResponseWriter, r *http.Request, PropertyID string,
-	errorTitle, errorMessage string, err error, code int, isFatal bool, AppEngineEmail string) {
-	c := appengine.NewContext(r)
-	if err != nil {
-		log.Errorf(c, "%v: %v", errorMessage, err.Error())
-	}
-	event := GetEvent(r)
-	event.ExceptionDescription = errorMessage
-	if err != nil {
-		event.ExceptionDescription += ": " + err.Error()
-	}
-	if isFatal {
-		event.IsExceptionFatal = "1"
-		msg := &mail.Message{
-			Sender:  AppEngineEmail,
-			To:      []string{AppEngineEmail},
-			Subject: "Fatal Error " + errorTitle,
-			Body:    fmt.Sprintf(`There was a fatal error on %v at %v: %v`, r.Host, time.Now(), errorMessage),
-		}
-		if err := mail.Send(c, msg); err != nil {
-			log.Errorf(c, "Couldn't send error email: %v", err)
-		}
-	} else {
-		event.IsExceptionFatal = ""
-	}
-	TrackGAPage(c, PropertyID, event)
-	http.Error(w, errorTitle, code)
-}
+package common
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+var (
+	PropertyID string = "UA-63208527-1"
+	// PropertyID string = "UA-68699208-1"
+)
+
+// https://developers.google.com/analytics/devguides/collection/protocol/v1/parameters
+type GAEvent struct {
+	CampaignContent        string `json:"CampaignContent,omitempty"`
+	Guid                   string `json:"Guid,omitempty"`
+	UserId                 string `json:"UserId,omitempty"`
+	CampaignKeyword        string `json:"CampaignKeyword,omitempty"`
+	CampaignMedium         string `json:"CampaignMedium,omitempty"`
+	CampaignName           string `json:"CampaignName,omitempty"`
+	CampaignSource         string `json:"CampaignSource,omitempty"`
+	CurrencyCode           string `json:"CurrencyCode,omitempty"`
+	DocumentHostName       string `json:"DocumentHostName,omitempty"`
+	DocumentLocationURL    string `json:"DocumentLocationURL,omitempty"`
+	DocumentPath           string `json:"DocumentPath,omitempty"`
+	Referer                string `json:"Referer,omitempty"`
+	DocumentTitle          string `json:"DocumentTitle,omitempty"`
+	Action                 string `json:"Action,omitempty"`
+	Category               string `json:"Category,omitempty"`
+	Label                  string `json:"Label,omitempty"`
+	Value                  string `json:"Value,omitempty"`
+	ExceptionDescription   string `json:"ExceptionDescription,omitempty"`
+	IsExceptionFatal       string `json:"IsExceptionFatal,omitempty"`
+	GoogleAdWordsID        string `json:"GoogleAdWordsID,omitempty"`
+	ItemCode               string `json:"ItemCode,omitempty"`
+	ItemName               string `json:"ItemName,omitempty"`
+	ItemPrice              string `json:"ItemPrice,omitempty"`
+	ItemQuantity           string `json:"ItemQuantity,omitempty"`
+	ItemCategory           string `json:"ItemCategory,omitempty"`
+	SocialAction           string `json:"SocialAction,omitempty"`
+	SocialNetwork          string `json:"SocialNetwork,omitempty"`
+	SocialActionTarget     string `json:"SocialActionTarget,omitempty"`
+	TransactionAffiliation string `json:"TransactionAffiliation,omitempty"`
+	TransactionID          string `json:"TransactionID,omitempty"`
+	TransactionShipping    string `json:"TransactionShipping,omitempty"`
+	TransactionTax         string `json:"TransactionTax,omitempty"`
+	TransactionRevenue     string `json:"TransactionRevenue,omitempty"`
+	ScreenName             string `json:"ScreenName,omitempty"`
+	TimingCategory         string `json:"TimingCategory,omitempty"`
+	TimingVariable         string `json:"TimingVariable,omitempty"`
+	TimingTime             string `json:"TimingTime,omitempty"`
+	TimingLabel            string `json:"TimingLabel,omitempty"`
+	Agent                  string `json:"Agent,omitempty"`
+	IP                     string `json:"IP,omitempty"`
+	UserLanguage           string `json:"UserLanguage,omitempty"`
+	ExperimentID           string `json:"ExperimentID,omitempty"`
+	ExperimentVariant      string `json:"ExperimentVariant,omitempty"`
+	// Indexed parameters: cd<index>, cm<index> and cg<index>
+	CustomDimensions map[int]string `json:"CustomDimensions,omitempty"`
+	CustomMetrics    map[int]string `json:"CustomMetrics,omitempty"`
+	ContentGroups    map[int]string `json:"ContentGroups,omitempty"`
+	// Enhanced e-commerce: pa, and pr<position> for each product
+	ProductAction string      `json:"ProductAction,omitempty"`
+	Products      []GAProduct `json:"Products,omitempty"`
+}
+
+// Product of an enhanced e-commerce hit, sent as pr<position><param>
+type GAProduct struct {
+	ID               string         `json:"ID,omitempty"`
+	Name             string         `json:"Name,omitempty"`
+	Brand            string         `json:"Brand,omitempty"`
+	Category         string         `json:"Category,omitempty"`
+	Variant          string         `json:"Variant,omitempty"`
+	Price            string         `json:"Price,omitempty"`
+	Quantity         string         `json:"Quantity,omitempty"`
+	CouponCode       string         `json:"CouponCode,omitempty"`
+	Position         string         `json:"Position,omitempty"`
+	CustomDimensions map[int]string `json:"CustomDimensions,omitempty"`
+	CustomMetrics    map[int]string `json:"CustomMetrics,omitempty"`
+}
+
+// Highest indexes accepted by Google Analytics
+const (
+	GA_MAX_CUSTOM_INDEX  = 200
+	GA_MAX_CONTENT_GROUP = 5
+	GA_MAX_PRODUCTS      = 200
+)
+
+func setIfNotEmpty(v *url.Values, key string, value string) {
+	if value != "" {
+		v.Set(key, value)
+	}
+}
+
+// Set prefix<index> for each value of an indexed parameter, ignoring the
+// indexes out of range, refused by Validate
+func setIndexed(v *url.Values, prefix string, values map[int]string, max int) {
+	for i, value := range values {
+		if (i >= 1) && (i <= max) {
+			setIfNotEmpty(v, prefix+strconv.Itoa(i), value)
+		}
+	}
+}
+
+// Check the indexes of an indexed parameter
+func validateIndexes(name string, values map[int]string, max int) error {
+	for i := range values {
+		if (i < 1) || (i > max) {
+			return fmt.Errorf("GA %v index %v out of range 1-%v", name, i, max)
+		}
+	}
+	return nil
+}
+
+// Check the indexes of the custom dimensions, metrics, content groups and
+// products of the event
+func (event *GAEvent) validateIndexes() error {
+	if err := validateIndexes("custom dimension", event.CustomDimensions, GA_MAX_CUSTOM_INDEX); err != nil {
+		return err
+	}
+	if err := validateIndexes("custom metric", event.CustomMetrics, GA_MAX_CUSTOM_INDEX); err != nil {
+		return err
+	}
+	if err := validateIndexes("content group", event.ContentGroups, GA_MAX_CONTENT_GROUP); err != nil {
+		return err
+	}
+	if len(event.Products) > GA_MAX_PRODUCTS {
+		return fmt.Errorf("GA hit has %v products, at most %v", len(event.Products), GA_MAX_PRODUCTS)
+	}
+	for _, p := range event.Products {
+		if err := validateIndexes("product custom dimension", p.CustomDimensions, GA_MAX_CUSTOM_INDEX); err != nil {
+			return err
+		}
+		if err := validateIndexes("product custom metric", p.CustomMetrics, GA_MAX_CUSTOM_INDEX); err != nil {
+			return err
+		}
+	}
+	if (len(event.Products) > 0) && (event.ProductAction == "") {
+		return fmt.Errorf("GA products need a product action")
+	}
+	return nil
+}
+
+func setEvent(etype string, event GAEvent) url.Values {
+	v := url.Values{}
+	v.Set("v", "1")
+	v.Set("t", etype)
+
+	setIfNotEmpty(&v, "cc", event.CampaignContent)
+	setIfNotEmpty(&v, "cid", event.Guid)
+	setIfNotEmpty(&v, "uid", event.UserId)
+	setIfNotEmpty(&v, "ck", event.CampaignKeyword)
+	setIfNotEmpty(&v, "cm", event.CampaignMedium)
+	setIfNotEmpty(&v, "cn", event.CampaignName)
+	setIfNotEmpty(&v, "cs", event.CampaignSource)
+	setIfNotEmpty(&v, "cu", event.CurrencyCode)
+	setIfNotEmpty(&v, "dh", event.DocumentHostName)
+	setIfNotEmpty(&v, "dl", event.DocumentLocationURL)
+	setIfNotEmpty(&v, "dp", event.DocumentPath)
+	setIfNotEmpty(&v, "dr", event.Referer)
+	setIfNotEmpty(&v, "dt", event.DocumentTitle)
+	setIfNotEmpty(&v, "ea", event.Action)
+	setIfNotEmpty(&v, "ec", event.Category)
+	setIfNotEmpty(&v, "el", event.Label)
+	setIfNotEmpty(&v, "ev", event.Value)
+	setIfNotEmpty(&v, "exd", event.ExceptionDescription)
+	setIfNotEmpty(&v, "exf", event.IsExceptionFatal)
+	setIfNotEmpty(&v, "gclid", event.GoogleAdWordsID)
+	setIfNotEmpty(&v, "ic", event.ItemCode)
+	setIfNotEmpty(&v, "in", event.ItemName)
+	setIfNotEmpty(&v, "ip", event.ItemPrice)
+	setIfNotEmpty(&v, "iq", event.ItemQuantity)
+	setIfNotEmpty(&v, "iv", event.ItemCategory)
+	setIfNotEmpty(&v, "sa", event.SocialAction)
+	setIfNotEmpty(&v, "sn", event.SocialNetwork)
+	setIfNotEmpty(&v, "st", event.SocialActionTarget)
+	setIfNotEmpty(&v, "ta", event.TransactionAffiliation)
+	setIfNotEmpty(&v, "ti", event.TransactionID)
+	setIfNotEmpty(&v, "ts", event.TransactionShipping)
+	setIfNotEmpty(&v, "tt", event.TransactionTax)
+	setIfNotEmpty(&v, "tr", event.TransactionRevenue)
+	setIfNotEmpty(&v, "cd", event.ScreenName)
+	setIfNotEmpty(&v, "utc", event.TimingCategory)
+	setIfNotEmpty(&v, "utv", event.TimingVariable)
+	setIfNotEmpty(&v, "utt", event.TimingTime)
+	setIfNotEmpty(&v, "utl", event.TimingLabel)
+	setIfNotEmpty(&v, "ua", event.Agent)
+	setIfNotEmpty(&v, "uip", event.IP)
+	setIfNotEmpty(&v, "ul", event.UserLanguage)
+	setIfNotEmpty(&v, "xid", event.ExperimentID)
+	setIfNotEmpty(&v, "xvar", event.ExperimentVariant)
+
+	setIndexed(&v, "cd", event.CustomDimensions, GA_MAX_CUSTOM_INDEX)
+	setIndexed(&v, "cm", event.CustomMetrics, GA_MAX_CUSTOM_INDEX)
+	setIndexed(&v, "cg", event.ContentGroups, GA_MAX_CONTENT_GROUP)
+
+	setIfNotEmpty(&v, "pa", event.ProductAction)
+	for i, p := range event.Products {
+		if i >= GA_MAX_PRODUCTS {
+			break
+		}
+		prefix := "pr" + strconv.Itoa(i+1)
+		setIfNotEmpty(&v, prefix+"id", p.ID)
+		setIfNotEmpty(&v, prefix+"nm", p.Name)
+		setIfNotEmpty(&v, prefix+"br", p.Brand)
+		setIfNotEmpty(&v, prefix+"ca", p.Category)
+		setIfNotEmpty(&v, prefix+"va", p.Variant)
+		setIfNotEmpty(&v, prefix+"pr", p.Price)
+		setIfNotEmpty(&v, prefix+"qt", p.Quantity)
+		setIfNotEmpty(&v, prefix+"cc", p.CouponCode)
+		setIfNotEmpty(&v, prefix+"ps", p.Position)
+		setIndexed(&v, prefix+"cd", p.CustomDimensions, GA_MAX_CUSTOM_INDEX)
+		setIndexed(&v, prefix+"cm", p.CustomMetrics, GA_MAX_CUSTOM_INDEX)
+	}
+
+	return v
+}
+
+// Event with the client id and the page of the request. The client id is
+// empty when the request has no client id cookie, and Validate refuses the
+// hit: call EnsureGAClientID first to mint one kept by the browser.
+func GetEvent(r *http.Request) GAEvent {
+	guid := GetGAClientID(r)
+
+	referer := ParseReferer(appengine.NewContext(r), r.Referer(), r.Host)
+	query := referer.SearchTerm
+	if query == "" {
+		query = r.FormValue("k")
+	}
+
+	socialNetwork := ""
+	if referer.Medium == REFERER_SOCIAL {
+		socialNetwork = referer.Source
+	}
+
+	event := GAEvent{
+		Guid:                guid,
+		IP:                  r.RemoteAddr,
+		DocumentHostName:    r.Host,
+		DocumentLocationURL: r.RequestURI,
+		DocumentPath:        r.URL.Path,
+		Referer:             r.Referer(),
+		DocumentTitle:       r.URL.Path,
+		Agent:               r.Header.Get("User-Agent"),
+		UserLanguage:        r.Header.Get("Accept-Language"),
+		CampaignKeyword:     query,
+		CampaignName:        r.FormValue("cm"),
+		SocialNetwork:       socialNetwork,
+	}
+
+	return event
+}
+
+// Queue a page view for the Universal Analytics property, and the GA4
+// stream of MeasurementID when set
+func TrackGAPage(c context.Context, PropertyID string, event GAEvent) {
+	QueueGAHit(c, PropertyID, &GAHit{Type: GA_PAGEVIEW, Event: event})
+}
+
+// Queue an event, with the category, action, label and value of the
+// GAEvent, for the Universal Analytics property, and the GA4 stream of
+// MeasurementID when set
+func TrackGAEvent(c context.Context, PropertyID string, event GAEvent) {
+	QueueGAHit(c, PropertyID, &GAHit{Type: GA_EVENT, Event: event})
+}
+
+// Report an error and answer the request with it, see ServeError. Without
+// ErrorSinks, the error is sent to Google Analytics and the fatal errors
+// are emailed to AppEngineEmail, rate limited.
+func GATrackServeError(w http.ResponseWriter, r *http.Request, PropertyID string,
+	errorTitle, errorMessage string, err error, code int, isFatal bool, AppEngineEmail string) {
+	sinks := ErrorSinks
+	if len(sinks) == 0 {
+		sinks = []ErrorSink{
+			&GAErrorSink{PropertyID: PropertyID},
+			&EmailErrorSink{Sender: AppEngineEmail, To: []string{AppEngineEmail}, FatalOnly: true},
+		}
+	}
+	EnsureGAClientID(w, r)
+	RenderError(w, r, reportError(r, errorTitle, errorMessage, err, code, isFatal, sinks))
+}
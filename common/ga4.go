@@ -0,0 +1,417 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// GA4 data stream used by TrackGAPage and TrackGAEvent in addition to
+	// PropertyID, when both are set. The API secret is created in the
+	// Measurement Protocol settings of the data stream.
+	MeasurementID string = ""
+	APISecret     string = ""
+)
+
+// Limit of the Measurement Protocol on the events of a request
+const GA4_MAX_EVENTS = 25
+
+// GA4 event of an item hit whose transaction is not in the same hits. A
+// transaction with N items must stay one purchase.
+const GA4_ITEM_EVENT = "purchase_item"
+
+var (
+	ERROR_GA4_NO_CLIENT_ID  = errors.New("GA4 client_id is required")
+	ERROR_GA4_NO_EVENTS     = errors.New("GA4 request has no event")
+	ERROR_GA4_INVALID_EVENT = errors.New("Invalid GA4 event name")
+)
+
+// Names of events and parameters: letters, digits and underscores,
+// starting with a letter, at most 40 characters
+var ga4NameRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,39}$`)
+
+// https://developers.google.com/analytics/devguides/collection/protocol/ga4/reference
+type GA4Event struct {
+	Name   string                 `json:"name"`
+	Params map[string]interface{} `json:"params,omitempty"`
+	// Time of the event when it was sent later, replaces the one of the
+	// payload
+	TimestampMicros int64 `json:"timestamp_micros,omitempty"`
+}
+
+type GA4UserProperty struct {
+	Value interface{} `json:"value"`
+}
+
+// Body of a Measurement Protocol request
+type GA4Payload struct {
+	ClientId           string                     `json:"client_id"`
+	UserId             string                     `json:"user_id,omitempty"`
+	TimestampMicros    int64                      `json:"timestamp_micros,omitempty"`
+	NonPersonalizedAds bool                       `json:"non_personalized_ads,omitempty"`
+	UserProperties     map[string]GA4UserProperty `json:"user_properties,omitempty"`
+	Events             []GA4Event                 `json:"events"`
+}
+
+// Measurement Protocol client of a GA4 data stream
+type GA4Client struct {
+	MeasurementID string
+	APISecret     string
+	// https://www.google-analytics.com/mp/collect when empty
+	Endpoint string
+}
+
+func NewGA4Client(measurementID, apiSecret string) *GA4Client {
+	return &GA4Client{MeasurementID: measurementID, APISecret: apiSecret}
+}
+
+// Set a user property of the payload
+func (p *GA4Payload) SetUserProperty(name string, value interface{}) {
+	if p.UserProperties == nil {
+		p.UserProperties = map[string]GA4UserProperty{}
+	}
+	p.UserProperties[name] = GA4UserProperty{Value: value}
+}
+
+// Check the client id and the names of the events, user properties and
+// params. The reserved prefixes are refused like GA4 does, silently.
+func (p *GA4Payload) Validate() error {
+	if p.ClientId == "" {
+		return ERROR_GA4_NO_CLIENT_ID
+	}
+	if len(p.Events) == 0 {
+		return ERROR_GA4_NO_EVENTS
+	}
+	for _, e := range p.Events {
+		if !isGA4Name(e.Name) {
+			return fmt.Errorf("%v: %q", ERROR_GA4_INVALID_EVENT, e.Name)
+		}
+		for name := range e.Params {
+			if !isGA4Name(name) {
+				return fmt.Errorf("Invalid GA4 param name %q in event %v", name, e.Name)
+			}
+		}
+	}
+	for name := range p.UserProperties {
+		if (len(name) > 24) || !isGA4Name(name) {
+			return fmt.Errorf("Invalid GA4 user property name %q", name)
+		}
+	}
+	return nil
+}
+
+func isGA4Name(name string) bool {
+	if !ga4NameRegexp.MatchString(name) {
+		return false
+	}
+	for _, prefix := range []string{"ga_", "google_", "firebase_"} {
+		if strings.HasPrefix(strings.ToLower(name), prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Send the events of the payload, in requests of at most GA4_MAX_EVENTS
+// events sharing the client id, user id and user properties
+func (cl *GA4Client) Send(c context.Context, p *GA4Payload) error {
+	log.Infof(c, ">>>> GA4Client.Send")
+
+	if err := p.Validate(); err != nil {
+		log.Errorf(c, "GA4: %v", err)
+		return err
+	}
+
+	endpoint := cl.Endpoint
+	if endpoint == "" {
+		endpoint = "https://www.google-analytics.com/mp/collect"
+	}
+	endpoint += "?measurement_id=" + url.QueryEscape(cl.MeasurementID) + "&api_secret=" + url.QueryEscape(cl.APISecret)
+
+	events := p.Events
+	for len(events) > 0 {
+		n := len(events)
+		if n > GA4_MAX_EVENTS {
+			n = GA4_MAX_EVENTS
+		}
+		batch := *p
+		batch.Events = events[:n]
+		events = events[n:]
+
+		body, err := json.Marshal(&batch)
+		if err != nil {
+			return err
+		}
+		log.Debugf(c, "GA4: Sending %v events to %v", n, cl.MeasurementID)
+		resp, err := urlfetch.Client(c).Post(endpoint, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Errorf(c, "Error while tracking Google Analytics 4: %v", err)
+			return err
+		}
+		resp.Body.Close()
+		// The collect endpoint answers 2xx even for invalid events
+		if resp.StatusCode >= 300 {
+			log.Errorf(c, "GA4 status code %v", resp.StatusCode)
+			return fmt.Errorf("GA4 answered %v", resp.Status)
+		}
+	}
+	return nil
+}
+
+// Lowercase name with underscores, usable as a GA4 event name
+func ga4EventName(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(strings.TrimSpace(s)) {
+		switch {
+		case (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9'):
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "_"):
+			b.WriteRune('_')
+		}
+	}
+	name := strings.TrimSuffix(b.String(), "_")
+	if (name == "") || !isGA4Name(name) {
+		return ""
+	}
+	return name
+}
+
+func setParamIfNotEmpty(params map[string]interface{}, key string, value string) {
+	if value != "" {
+		params[key] = value
+	}
+}
+
+func setNumberParamIfNotEmpty(params map[string]interface{}, key string, value string) {
+	if value == "" {
+		return
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		params[key] = f
+	} else {
+		params[key] = value
+	}
+}
+
+// GA4 events of the enhanced e-commerce product actions
+var ga4ProductActions = map[string]string{
+	"detail":   "view_item",
+	"click":    "select_item",
+	"add":      "add_to_cart",
+	"remove":   "remove_from_cart",
+	"checkout": "begin_checkout",
+	"purchase": "purchase",
+	"refund":   "refund",
+}
+
+// GA4 event of a Universal Analytics hit type, one of the GA_* constants,
+// and its GAEvent fields
+func GA4EventFromGAEvent(etype string, event GAEvent) GA4Event {
+	params := map[string]interface{}{
+		// Without engagement time, GA4 doesn't count the user as active
+		"engagement_time_msec": 1,
+	}
+	e := GA4Event{Params: params}
+
+	switch etype {
+	case "pageview":
+		e.Name = "page_view"
+	case "event":
+		e.Name = ga4EventName(event.Action)
+		if e.Name == "" {
+			e.Name = "event"
+		}
+		setParamIfNotEmpty(params, "event_category", event.Category)
+		setParamIfNotEmpty(params, "event_action", event.Action)
+		setParamIfNotEmpty(params, "event_label", event.Label)
+		setNumberParamIfNotEmpty(params, "value", event.Value)
+	case "exception":
+		e.Name = "exception"
+		setParamIfNotEmpty(params, "description", event.ExceptionDescription)
+		params["fatal"] = event.IsExceptionFatal == "1"
+	case "social":
+		e.Name = "share"
+		setParamIfNotEmpty(params, "method", event.SocialNetwork)
+		setParamIfNotEmpty(params, "content_type", event.SocialAction)
+		setParamIfNotEmpty(params, "item_id", event.SocialActionTarget)
+	case "screenview":
+		e.Name = "screen_view"
+		setParamIfNotEmpty(params, "screen_name", event.ScreenName)
+	case "timing":
+		e.Name = "timing_complete"
+		setParamIfNotEmpty(params, "event_category", event.TimingCategory)
+		setParamIfNotEmpty(params, "name", event.TimingVariable)
+		setNumberParamIfNotEmpty(params, "value", event.TimingTime)
+		setParamIfNotEmpty(params, "event_label", event.TimingLabel)
+	case "transaction", "item":
+		e.Name = "purchase"
+		if etype == "item" {
+			// Not a purchase on its own, GA4EventsFromGAHits adds the items
+			// to the purchase of their transaction
+			e.Name = GA4_ITEM_EVENT
+		}
+		setNumberParamIfNotEmpty(params, "value", event.TransactionRevenue)
+		setParamIfNotEmpty(params, "transaction_id", event.TransactionID)
+		setParamIfNotEmpty(params, "affiliation", event.TransactionAffiliation)
+		setNumberParamIfNotEmpty(params, "shipping", event.TransactionShipping)
+		setNumberParamIfNotEmpty(params, "tax", event.TransactionTax)
+		setParamIfNotEmpty(params, "currency", event.CurrencyCode)
+		if (event.ItemCode != "") || (event.ItemName != "") {
+			item := map[string]interface{}{}
+			setParamIfNotEmpty(item, "item_id", event.ItemCode)
+			setParamIfNotEmpty(item, "item_name", event.ItemName)
+			setParamIfNotEmpty(item, "item_category", event.ItemCategory)
+			setNumberParamIfNotEmpty(item, "price", event.ItemPrice)
+			setNumberParamIfNotEmpty(item, "quantity", event.ItemQuantity)
+			params["items"] = []map[string]interface{}{item}
+		}
+	default:
+		e.Name = ga4EventName(etype)
+	}
+
+	setParamIfNotEmpty(params, "page_location", event.DocumentLocationURL)
+	if (event.DocumentHostName != "") && strings.HasPrefix(event.DocumentLocationURL, "/") {
+		params["page_location"] = "https://" + event.DocumentHostName + event.DocumentLocationURL
+	}
+	setParamIfNotEmpty(params, "page_path", event.DocumentPath)
+	setParamIfNotEmpty(params, "page_title", event.DocumentTitle)
+	setParamIfNotEmpty(params, "page_referrer", event.Referer)
+	setParamIfNotEmpty(params, "language", event.UserLanguage)
+	setParamIfNotEmpty(params, "campaign", event.CampaignName)
+	setParamIfNotEmpty(params, "source", event.CampaignSource)
+	setParamIfNotEmpty(params, "medium", event.CampaignMedium)
+	setParamIfNotEmpty(params, "term", event.CampaignKeyword)
+	setParamIfNotEmpty(params, "content", event.CampaignContent)
+	setParamIfNotEmpty(params, "gclid", event.GoogleAdWordsID)
+	setParamIfNotEmpty(params, "experiment_id", event.ExperimentID)
+	setParamIfNotEmpty(params, "experiment_variant", event.ExperimentVariant)
+
+	// Custom dimensions and metrics keep their index, to be registered as
+	// custom definitions in GA4
+	for i, d := range event.CustomDimensions {
+		setParamIfNotEmpty(params, "dimension"+strconv.Itoa(i), d)
+	}
+	for i, m := range event.CustomMetrics {
+		setNumberParamIfNotEmpty(params, "metric"+strconv.Itoa(i), m)
+	}
+	for i, g := range event.ContentGroups {
+		if i == 1 {
+			setParamIfNotEmpty(params, "content_group", g)
+		} else {
+			setParamIfNotEmpty(params, "content_group"+strconv.Itoa(i), g)
+		}
+	}
+
+	// Enhanced e-commerce becomes the matching GA4 e-commerce event
+	if name, ok := ga4ProductActions[event.ProductAction]; ok {
+		e.Name = name
+		setParamIfNotEmpty(params, "currency", event.CurrencyCode)
+	}
+	if len(event.Products) > 0 {
+		var items []map[string]interface{}
+		if existing, ok := params["items"].([]map[string]interface{}); ok {
+			items = existing
+		}
+		for _, p := range event.Products {
+			item := map[string]interface{}{}
+			setParamIfNotEmpty(item, "item_id", p.ID)
+			setParamIfNotEmpty(item, "item_name", p.Name)
+			setParamIfNotEmpty(item, "item_brand", p.Brand)
+			setParamIfNotEmpty(item, "item_category", p.Category)
+			setParamIfNotEmpty(item, "item_variant", p.Variant)
+			setParamIfNotEmpty(item, "coupon", p.CouponCode)
+			setNumberParamIfNotEmpty(item, "price", p.Price)
+			setNumberParamIfNotEmpty(item, "quantity", p.Quantity)
+			setNumberParamIfNotEmpty(item, "index", p.Position)
+			items = append(items, item)
+		}
+		params["items"] = items
+	}
+
+	return e
+}
+
+// GA4 events of hits of one client. The items of the item hits are added to
+// the purchase of their transaction when it is in the hits, the other item
+// hits become GA4_ITEM_EVENT events.
+func GA4EventsFromGAHits(hits []GAHit) []GA4Event {
+	return ga4EventsFromGAHits(hits, nil)
+}
+
+// GA4EventsFromGAHits, with the time of each hit when times is not nil
+func ga4EventsFromGAHits(hits []GAHit, times []time.Time) []GA4Event {
+	event := func(i int) GA4Event {
+		e := GA4EventFromGAEvent(hits[i].Type, hits[i].Event)
+		if times != nil {
+			e.TimestampMicros = times[i].UnixNano() / int64(time.Microsecond)
+		}
+		return e
+	}
+	var events []GA4Event
+	purchases := map[string]int{}
+	for i, h := range hits {
+		if h.Type == GA_ITEM {
+			continue
+		}
+		e := event(i)
+		if h.Type == GA_TRANSACTION {
+			purchases[h.Event.TransactionID] = len(events)
+		}
+		events = append(events, e)
+	}
+	for i, h := range hits {
+		if h.Type != GA_ITEM {
+			continue
+		}
+		e := event(i)
+		i, ok := purchases[h.Event.TransactionID]
+		if !ok {
+			events = append(events, e)
+			continue
+		}
+		items, _ := events[i].Params["items"].([]map[string]interface{})
+		if added, ok := e.Params["items"].([]map[string]interface{}); ok {
+			events[i].Params["items"] = append(items, added...)
+		}
+	}
+	return events
+}
+
+// Payload of a single GAEvent, with its client and user ids
+func GA4PayloadFromGAEvent(etype string, event GAEvent) *GA4Payload {
+	return &GA4Payload{
+		ClientId: event.Guid,
+		UserId:   event.UserId,
+		Events:   []GA4Event{GA4EventFromGAEvent(etype, event)},
+	}
+}
+
+// Send a GAEvent to the GA4 stream of MeasurementID, if configured
+func trackGA4(c context.Context, etype string, event GAEvent) {
+	if (MeasurementID == "") || (APISecret == "") {
+		return
+	}
+	if err := NewGA4Client(MeasurementID, APISecret).Send(c, GA4PayloadFromGAEvent(etype, event)); err != nil {
+		log.Errorf(c, "Error while tracking Google Analytics 4: %v", err)
+	}
+}
+
+// Send a page view to the GA4 stream of MeasurementID
+func TrackGA4Page(c context.Context, event GAEvent) {
+	trackGA4(c, "pageview", event)
+}
+
+// Send an event to the GA4 stream of MeasurementID, named after its action
+func TrackGA4Event(c context.Context, event GAEvent) {
+	trackGA4(c, "event", event)
+}
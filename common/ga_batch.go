@@ -0,0 +1,439 @@
+package common
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+	"google.golang.org/appengine/urlfetch"
+	"google.golang.org/appengine/user"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// Pull queue of the hits waiting to be sent, declared in queue.yaml:
+	//   - name: ga-hits
+	//     mode: pull
+	GAHitsQueue = "ga-hits"
+
+	// Hits are sent by FlushGAHits, called by the cron of GAFlushHandler,
+	// for at most this long
+	GAFlushDeadline = 50 * time.Second
+)
+
+// Limits of the /batch endpoint
+const (
+	GA_BATCH_MAX_HITS  = 20
+	GA_BATCH_MAX_BYTES = 16 * 1024
+	GA_HIT_MAX_BYTES   = 8 * 1024
+)
+
+// Hits older than 4 hours are dropped by Google Analytics
+const gaMaxQueueTime = 4 * time.Hour
+
+var ERROR_GA_HIT_TOO_LARGE = errors.New("GA hit larger than 8KB")
+
+// Hit waiting in GAHitsQueue. Universal Analytics and GA4 are sent
+// independently, a hit sent to only one of them is queued again for the
+// other.
+type queuedGAHit struct {
+	PropertyID string
+	Hit        GAHit
+	Time       time.Time
+	UASent     bool
+	GA4Sent    bool
+}
+
+// Queue a hit to be sent in a batch by FlushGAHits, so that the request
+// doesn't wait for Google Analytics. The hit is sent right away if it
+// can't be queued.
+func QueueGAHit(c context.Context, PropertyID string, hit *GAHit) error {
+	if err := hit.Validate(); err != nil {
+		log.Errorf(c, "GA: Invalid hit: %v", err)
+		return err
+	}
+
+	err := addQueuedGAHits(c, []*queuedGAHit{{PropertyID: PropertyID, Hit: *hit, Time: time.Now()}}, 0)
+	if err != nil {
+		log.Warningf(c, "GA: Error queuing hit, sending it now: %v", err)
+		return SendGAHit(c, PropertyID, hit)
+	}
+	return nil
+}
+
+// Add hits to GAHitsQueue, to be leased after the delay
+func addQueuedGAHits(c context.Context, hits []*queuedGAHit, delay time.Duration) error {
+	var tasks []*taskqueue.Task
+	for _, q := range hits {
+		var payload bytes.Buffer
+		if err := gob.NewEncoder(&payload).Encode(q); err != nil {
+			return err
+		}
+		tasks = append(tasks, &taskqueue.Task{Method: "PULL", Payload: payload.Bytes(), Delay: delay})
+	}
+	_, err := taskqueue.AddMulti(c, tasks, GAHitsQueue)
+	return err
+}
+
+// Line of a hit in a /batch request, with its queue time
+func gaHitLine(q *queuedGAHit) string {
+	v := setEvent(q.Hit.Type, q.Hit.Event)
+	v.Set("tid", q.PropertyID)
+	v.Set("qt", strconv.FormatInt(int64(time.Since(q.Time)/time.Millisecond), 10))
+	return v.Encode()
+}
+
+// Split lines in batches of at most GA_BATCH_MAX_HITS lines and
+// GA_BATCH_MAX_BYTES bytes, newlines included
+func splitGABatches(lines []string) [][]string {
+	var batches [][]string
+	var batch []string
+	size := 0
+	for _, line := range lines {
+		if (len(batch) == GA_BATCH_MAX_HITS) || ((len(batch) > 0) && (size+len(line)+1 > GA_BATCH_MAX_BYTES)) {
+			batches = append(batches, batch)
+			batch, size = nil, 0
+		}
+		batch = append(batch, line)
+		size += len(line) + 1
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// Post lines to the /batch endpoint of GAEndpoint
+func postGABatch(client *http.Client, lines []string) error {
+	resp, err := client.Post(GAEndpoint+"/batch", "text/plain", strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("GA batch answered %v", resp.Status)
+	}
+	return nil
+}
+
+// Send the hits not sent yet to Universal Analytics, in batches, and mark
+// the ones accepted. Hits too large for a batch are marked too, they can
+// never be sent, and the hits without PropertyID are marked without being
+// sent.
+func sendUAHits(c context.Context, hits []*queuedGAHit) {
+	var pending []*queuedGAHit
+	var lines []string
+	for _, q := range hits {
+		if q.UASent {
+			continue
+		}
+		if q.PropertyID == "" {
+			// GA4 only setup
+			q.UASent = true
+			continue
+		}
+		line := gaHitLine(q)
+		if len(line) > GA_HIT_MAX_BYTES {
+			log.Errorf(c, "FlushGAHits: Dropping hit: %v", ERROR_GA_HIT_TOO_LARGE)
+			q.UASent = true
+			continue
+		}
+		pending = append(pending, q)
+		lines = append(lines, line)
+	}
+
+	for _, batch := range splitGABatches(lines) {
+		log.Debugf(c, "GA: Sending a batch of %v hits", len(batch))
+		err := postGABatch(urlfetch.Client(c), batch)
+		if err != nil {
+			log.Errorf(c, "FlushGAHits: Error sending batch: %v", err)
+		}
+		for _, q := range pending[:len(batch)] {
+			q.UASent = err == nil
+		}
+		pending = pending[len(batch):]
+	}
+}
+
+// Groups of the hits of a client giving at most GA4_MAX_EVENTS events, so
+// that each group is sent in a single request. A transaction stays with its
+// items, they become one purchase. The hits keep their order in a group.
+func splitGA4Hits(hits []*queuedGAHit) [][]*queuedGAHit {
+	// Hits of each event: a transaction and its items, or a single hit
+	var units [][]int
+	purchases := map[string]int{}
+	for i, q := range hits {
+		if q.Hit.Type == GA_ITEM {
+			continue
+		}
+		if q.Hit.Type == GA_TRANSACTION {
+			purchases[q.Hit.Event.TransactionID] = len(units)
+		}
+		units = append(units, []int{i})
+	}
+	for i, q := range hits {
+		if q.Hit.Type != GA_ITEM {
+			continue
+		}
+		if u, ok := purchases[q.Hit.Event.TransactionID]; ok {
+			units[u] = append(units[u], i)
+		} else {
+			units = append(units, []int{i})
+		}
+	}
+
+	var groups [][]*queuedGAHit
+	for len(units) > 0 {
+		n := len(units)
+		if n > GA4_MAX_EVENTS {
+			n = GA4_MAX_EVENTS
+		}
+		var indexes []int
+		for _, u := range units[:n] {
+			indexes = append(indexes, u...)
+		}
+		units = units[n:]
+		sort.Ints(indexes)
+		group := make([]*queuedGAHit, len(indexes))
+		for j, i := range indexes {
+			group[j] = hits[i]
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// GA4 payloads of the hits not sent yet to GA4, per client and with at most
+// GA4_MAX_EVENTS events, with the time each hit was queued
+func ga4PayloadsFromQueuedHits(hits []*queuedGAHit) ([]*GA4Payload, [][]*queuedGAHit) {
+	var clientHits [][]*queuedGAHit
+	clients := map[string]int{}
+	for _, q := range hits {
+		if q.GA4Sent {
+			continue
+		}
+		key := q.Hit.Event.Guid + "|" + q.Hit.Event.UserId
+		i, ok := clients[key]
+		if !ok {
+			i = len(clientHits)
+			clients[key] = i
+			clientHits = append(clientHits, nil)
+		}
+		clientHits[i] = append(clientHits[i], q)
+	}
+	var payloads []*GA4Payload
+	var payloadHits [][]*queuedGAHit
+	for _, client := range clientHits {
+		for _, group := range splitGA4Hits(client) {
+			var gaHits []GAHit
+			var times []time.Time
+			for _, q := range group {
+				gaHits = append(gaHits, q.Hit)
+				times = append(times, q.Time)
+			}
+			payloads = append(payloads, &GA4Payload{
+				ClientId:        group[0].Hit.Event.Guid,
+				UserId:          group[0].Hit.Event.UserId,
+				TimestampMicros: times[0].UnixNano() / int64(time.Microsecond),
+				Events:          ga4EventsFromGAHits(gaHits, times),
+			})
+			payloadHits = append(payloadHits, group)
+		}
+	}
+	return payloads, payloadHits
+}
+
+// Send the hits not sent yet to the GA4 stream of MeasurementID, one
+// request per payload, and mark the ones accepted. Without GA4 stream, all
+// the hits are marked.
+func sendGA4Hits(c context.Context, hits []*queuedGAHit) {
+	if (MeasurementID == "") || (APISecret == "") {
+		for _, q := range hits {
+			q.GA4Sent = true
+		}
+		return
+	}
+	client := NewGA4Client(MeasurementID, APISecret)
+	payloads, payloadHits := ga4PayloadsFromQueuedHits(hits)
+	for i, p := range payloads {
+		var err error
+		if verr := p.Validate(); verr != nil {
+			// Can never be sent, like the hits with only a user id
+			log.Errorf(c, "FlushGAHits: Dropping GA4 events: %v", verr)
+		} else if err = client.Send(c, p); err != nil {
+			log.Errorf(c, "FlushGAHits: Error sending GA4 events: %v", err)
+		}
+		for _, q := range payloadHits[i] {
+			q.GA4Sent = err == nil
+		}
+	}
+}
+
+// Send the hits of GAHitsQueue to Universal Analytics in batches of
+// GA_BATCH_MAX_HITS, and to GA4 when MeasurementID is set, until the queue
+// is empty or GAFlushDeadline. Each is sent whatever happens to the other:
+// hits sent to only one are queued again, for a minute later, to be sent to
+// the other. Returns the number of hits fully sent.
+func FlushGAHits(c context.Context) (int, error) {
+	log.Infof(c, ">>>> FlushGAHits")
+
+	deadline := time.Now().Add(GAFlushDeadline)
+	sent := 0
+	for time.Now().Before(deadline) {
+		tasks, err := taskqueue.Lease(c, 5*GA_BATCH_MAX_HITS, GAHitsQueue, 60)
+		if err != nil {
+			log.Errorf(c, "FlushGAHits: Error leasing hits: %v", err)
+			return sent, err
+		}
+		if len(tasks) == 0 {
+			break
+		}
+
+		var done []*taskqueue.Task
+		var hits []*queuedGAHit
+		var hitTasks []*taskqueue.Task
+		for _, t := range tasks {
+			var q queuedGAHit
+			if err := gob.NewDecoder(bytes.NewReader(t.Payload)).Decode(&q); err != nil {
+				log.Errorf(c, "FlushGAHits: Dropping unreadable hit: %v", err)
+				done = append(done, t)
+				continue
+			}
+			if time.Since(q.Time) > gaMaxQueueTime {
+				log.Warningf(c, "FlushGAHits: Dropping hit queued at %v", q.Time)
+				done = append(done, t)
+				continue
+			}
+			hits = append(hits, &q)
+			hitTasks = append(hitTasks, t)
+		}
+
+		sendUAHits(c, hits)
+		sendGA4Hits(c, hits)
+
+		var retry []*queuedGAHit
+		var retryTasks []*taskqueue.Task
+		for i, q := range hits {
+			if q.UASent && q.GA4Sent {
+				done = append(done, hitTasks[i])
+				sent++
+			} else if q.UASent || q.GA4Sent {
+				retry = append(retry, q)
+				retryTasks = append(retryTasks, hitTasks[i])
+			}
+		}
+		// Without the new tasks, the leased ones are sent again to both
+		if len(retry) > 0 {
+			if err := addQueuedGAHits(c, retry, time.Minute); err != nil {
+				log.Errorf(c, "FlushGAHits: Error queuing hits again: %v", err)
+			} else {
+				done = append(done, retryTasks...)
+			}
+		}
+
+		if len(done) > 0 {
+			if err := taskqueue.DeleteMulti(c, done, GAHitsQueue); err != nil {
+				log.Errorf(c, "FlushGAHits: Error deleting hits: %v", err)
+			}
+		}
+		if len(done) < len(tasks) || len(retry) > 0 {
+			// Google Analytics is failing, the hits left are retried later
+			break
+		}
+	}
+	return sent, nil
+}
+
+// Send the queued hits, for a cron every minute
+func GAFlushHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> GAFlushHandler")
+
+	isAdmin := false
+	if user.Current(c) != nil {
+		isAdmin = user.Current(c).Admin
+	}
+
+	if (r.Header.Get("X-AppEngine-Cron") != "true") && (isAdmin == false) {
+		log.Errorf(c, "Handler called without admin/cron priviledge")
+		http.Error(w, "Handler called without admin/cron priviledge", http.StatusBadRequest)
+		return
+	}
+
+	n, err := FlushGAHits(c)
+	if err != nil {
+		http.Error(w, "Error while sending hits: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "%v hits sent", n)
+}
+
+// Message of the validation server about a hit
+type GAParserMessage struct {
+	MessageType string `json:"messageType"`
+	Description string `json:"description"`
+	Parameter   string `json:"parameter,omitempty"`
+}
+
+// Validation of a hit by the /debug/collect endpoint
+type GAHitParsingResult struct {
+	Valid         bool              `json:"valid"`
+	ParserMessage []GAParserMessage `json:"parserMessage"`
+	Hit           string            `json:"hit"`
+}
+
+// Check hits with the /debug/collect endpoint, which parses them without
+// recording them. Returns one result per hit, in order.
+func ValidateGAHits(c context.Context, PropertyID string, hits ...*GAHit) ([]GAHitParsingResult, error) {
+	log.Infof(c, ">>>> ValidateGAHits")
+
+	var results []GAHitParsingResult
+	for _, hit := range hits {
+		result, err := validateGAHit(urlfetch.Client(c), PropertyID, hit)
+		if err != nil {
+			log.Errorf(c, "ValidateGAHits: Error validating hit: %v", err)
+			return nil, err
+		}
+		results = append(results, *result)
+	}
+	return results, nil
+}
+
+// Check a hit with the /debug/collect endpoint of GAEndpoint
+func validateGAHit(client *http.Client, PropertyID string, hit *GAHit) (*GAHitParsingResult, error) {
+	v := setEvent(hit.Type, hit.Event)
+	v.Set("tid", PropertyID)
+	resp, err := client.Post(GAEndpoint+"/debug/collect", "text/plain", strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("Validation server answered %v", resp.Status)
+	}
+	var body struct {
+		HitParsingResult []GAHitParsingResult `json:"hitParsingResult"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if len(body.HitParsingResult) != 1 {
+		return nil, fmt.Errorf("Validation server answered %v results for 1 hit", len(body.HitParsingResult))
+	}
+	result := body.HitParsingResult[0]
+	// Hits refused by our own checks are reported the same way
+	if err := hit.Validate(); err != nil {
+		result.Valid = false
+		result.ParserMessage = append(result.ParserMessage, GAParserMessage{MessageType: "ERROR", Description: err.Error()})
+	}
+	return &result, nil
+}
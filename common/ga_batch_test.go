@@ -0,0 +1,235 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Stub of the Measurement Protocol, set as GAEndpoint for the test
+func newGAStub(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	server := httptest.NewServer(handler)
+	endpoint := GAEndpoint
+	GAEndpoint = server.URL
+	t.Cleanup(func() {
+		GAEndpoint = endpoint
+		server.Close()
+	})
+	return server
+}
+
+func TestSplitGABatches(t *testing.T) {
+	short := make([]string, 45)
+	for i := range short {
+		short[i] = fmt.Sprintf("v=1&t=pageview&cid=%d", i)
+	}
+	// 4 lines of 5000 bytes fill 15004 bytes with the newlines
+	long := make([]string, 5)
+	for i := range long {
+		long[i] = strings.Repeat("x", 5000)
+	}
+
+	tests := []struct {
+		name  string
+		lines []string
+		sizes []int
+	}{
+		{"empty", nil, nil},
+		{"one", short[:1], []int{1}},
+		{"exactly max hits", short[:GA_BATCH_MAX_HITS], []int{20}},
+		{"by hits", short, []int{20, 20, 5}},
+		{"by bytes", long, []int{3, 2}},
+		{"line at the byte limit", []string{strings.Repeat("x", GA_BATCH_MAX_BYTES-1), "a"}, []int{1, 1}},
+	}
+	for _, test := range tests {
+		batches := splitGABatches(test.lines)
+		if len(batches) != len(test.sizes) {
+			t.Errorf("%v: %v batches, want %v", test.name, len(batches), len(test.sizes))
+			continue
+		}
+		n := 0
+		for i, batch := range batches {
+			if len(batch) != test.sizes[i] {
+				t.Errorf("%v: batch %v has %v lines, want %v", test.name, i, len(batch), test.sizes[i])
+			}
+			size := 0
+			for _, line := range batch {
+				if line != test.lines[n] {
+					t.Errorf("%v: line %v out of order", test.name, n)
+				}
+				size += len(line) + 1
+				n++
+			}
+			if size > GA_BATCH_MAX_BYTES {
+				t.Errorf("%v: batch %v has %v bytes", test.name, i, size)
+			}
+		}
+	}
+}
+
+func TestPostGABatch(t *testing.T) {
+	var path, body string
+	status := http.StatusOK
+	newGAStub(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		path, body = r.URL.Path, string(b)
+		w.WriteHeader(status)
+	})
+
+	lines := []string{"v=1&t=pageview&cid=1", "v=1&t=event&cid=2"}
+	if err := postGABatch(http.DefaultClient, lines); err != nil {
+		t.Fatalf("postGABatch: %v", err)
+	}
+	if path != "/batch" {
+		t.Errorf("path %q, want /batch", path)
+	}
+	if body != lines[0]+"\n"+lines[1] {
+		t.Errorf("body %q", body)
+	}
+
+	status = http.StatusInternalServerError
+	if err := postGABatch(http.DefaultClient, lines); err == nil {
+		t.Errorf("postGABatch: no error on %v", status)
+	}
+}
+
+func TestValidateGAHit(t *testing.T) {
+	var form url.Values
+	newGAStub(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/debug/collect" {
+			http.NotFound(w, r)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		form, _ = url.ParseQuery(string(b))
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"hitParsingResult": []GAHitParsingResult{{Valid: true, Hit: "/debug/collect?" + string(b)}},
+		})
+	})
+
+	hit, err := GAEventHit(GAEvent{Guid: "555"}, "video", "play", "", -1)
+	if err != nil {
+		t.Fatalf("GAEventHit: %v", err)
+	}
+	result, err := validateGAHit(http.DefaultClient, "UA-1-1", hit)
+	if err != nil {
+		t.Fatalf("validateGAHit: %v", err)
+	}
+	if !result.Valid {
+		t.Errorf("valid hit reported invalid: %v", result.ParserMessage)
+	}
+	if (form.Get("tid") != "UA-1-1") || (form.Get("t") != GA_EVENT) || (form.Get("ea") != "play") {
+		t.Errorf("stub got %v", form)
+	}
+
+	// Accepted by the stub, refused by GAHit.Validate
+	result, err = validateGAHit(http.DefaultClient, "UA-1-1", &GAHit{Type: GA_EVENT, Event: GAEvent{Guid: "555"}})
+	if err != nil {
+		t.Fatalf("validateGAHit: %v", err)
+	}
+	if result.Valid || (len(result.ParserMessage) == 0) {
+		t.Errorf("invalid hit reported valid")
+	}
+}
+
+func TestGA4PayloadsFromQueuedHits(t *testing.T) {
+	start := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	transaction, _ := GATransactionHit(GAEvent{Guid: "a"}, "T1", "", 30, 0, 0, "USD")
+	item1, _ := GAItemHit(GAEvent{Guid: "a"}, "T1", "Shirt", "S1", "", 10, 1, "USD")
+	item2, _ := GAItemHit(GAEvent{Guid: "a"}, "T1", "Hat", "H1", "", 20, 1, "USD")
+	page, _ := GAPageviewHit(GAEvent{Guid: "b", DocumentPath: "/"})
+	hits := []*queuedGAHit{
+		{Hit: *item1, Time: start.Add(time.Second)},
+		{Hit: *page, Time: start.Add(2 * time.Second)},
+		{Hit: *transaction, Time: start},
+		{Hit: *item2, Time: start.Add(3 * time.Second)},
+		{Hit: *page, Time: start.Add(4 * time.Second), GA4Sent: true},
+	}
+
+	payloads, payloadHits := ga4PayloadsFromQueuedHits(hits)
+	if len(payloads) != 2 || len(payloadHits) != 2 {
+		t.Fatalf("%v payloads, want one per client", len(payloads))
+	}
+
+	a := payloads[0]
+	if a.ClientId != "a" {
+		t.Fatalf("first payload of %q, want a", a.ClientId)
+	}
+	if len(payloadHits[0]) != 3 {
+		t.Errorf("%v hits for client a, want 3", len(payloadHits[0]))
+	}
+	if a.TimestampMicros != start.Add(time.Second).UnixNano()/1000 {
+		t.Errorf("payload timestamp %v", a.TimestampMicros)
+	}
+	if len(a.Events) != 1 || a.Events[0].Name != "purchase" {
+		t.Fatalf("events %v, want a single purchase", a.Events)
+	}
+	if a.Events[0].TimestampMicros != start.UnixNano()/1000 {
+		t.Errorf("purchase timestamp %v, want the time of the transaction", a.Events[0].TimestampMicros)
+	}
+	if items, _ := a.Events[0].Params["items"].([]map[string]interface{}); len(items) != 2 {
+		t.Errorf("purchase items %v, want 2", a.Events[0].Params["items"])
+	}
+
+	b := payloads[1]
+	if (b.ClientId != "b") || (len(b.Events) != 1) || (b.Events[0].Name != "page_view") {
+		t.Errorf("second payload %+v, want the page view not sent yet", b)
+	}
+}
+
+func TestSplitGA4Hits(t *testing.T) {
+	start := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	page, _ := GAPageviewHit(GAEvent{Guid: "a", DocumentPath: "/"})
+	transaction, _ := GATransactionHit(GAEvent{Guid: "a"}, "T1", "", 30, 0, 0, "USD")
+	item, _ := GAItemHit(GAEvent{Guid: "a"}, "T1", "Shirt", "S1", "", 10, 1, "USD")
+	orphan, _ := GAItemHit(GAEvent{Guid: "a"}, "T2", "Hat", "H1", "", 20, 1, "USD")
+
+	var hits []*queuedGAHit
+	add := func(h *GAHit, n int) {
+		for i := 0; i < n; i++ {
+			hits = append(hits, &queuedGAHit{Hit: *h, Time: start.Add(time.Duration(len(hits)) * time.Second)})
+		}
+	}
+	add(item, 10)
+	add(page, 20)
+	add(transaction, 1)
+	add(item, 20)
+	add(page, 10)
+	add(orphan, 2)
+
+	payloads, payloadHits := ga4PayloadsFromQueuedHits(hits)
+	// 30 page views, one purchase of 30 items and 2 items without their
+	// transaction: 33 events
+	if len(payloads) != 2 {
+		t.Fatalf("%v payloads, want 2", len(payloads))
+	}
+	events, n := 0, 0
+	for i, p := range payloads {
+		if len(p.Events) > GA4_MAX_EVENTS {
+			t.Errorf("payload %v has %v events", i, len(p.Events))
+		}
+		events += len(p.Events)
+		n += len(payloadHits[i])
+		for j := 1; j < len(payloadHits[i]); j++ {
+			if payloadHits[i][j].Time.Before(payloadHits[i][j-1].Time) {
+				t.Errorf("payload %v: hits out of order", i)
+			}
+		}
+	}
+	if (events != 33) || (n != len(hits)) {
+		t.Errorf("%v events for %v hits, want 33 for %v", events, n, len(hits))
+	}
+	for _, e := range payloads[0].Events {
+		if e.Name == "purchase" {
+			if items, _ := e.Params["items"].([]map[string]interface{}); len(items) != 30 {
+				t.Errorf("purchase has %v items, want 30", len(items))
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package common
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// First-party cookie holding the client id minted by EnsureGAClientID
+	GAClientIDCookie = "_gacid"
+
+	// Lifetime of GAClientIDCookie, renewed at each visit
+	GAClientIDExpiration = 2 * 365 * 24 * time.Hour
+)
+
+var uuidRegexp = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// gtag.js client id, like "GA1.2.1234567890.1600000000": the last two
+// numbers are the client id
+var gaCookieRegexp = regexp.MustCompile(`^GA\d+\.\d+(?:-\d+)?\.(\d+\.\d+)$`)
+
+// Random UUID version 4
+func NewUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// Client id of the request: the one of the _ga cookie set by gtag.js when
+// present, so that server and browser hits are the same user, then the one
+// of GAClientIDCookie, then the ID cookie of GetCookieID. Empty if the
+// request has none of them.
+func GetGAClientID(r *http.Request) string {
+	if cookie, err := r.Cookie("_ga"); err == nil {
+		if m := gaCookieRegexp.FindStringSubmatch(cookie.Value); m != nil {
+			return m[1]
+		}
+	}
+	if cookie, err := r.Cookie(GAClientIDCookie); err == nil {
+		if id := strings.ToLower(cookie.Value); uuidRegexp.MatchString(id) {
+			return id
+		}
+	}
+	if cookie, err := r.Cookie("ID"); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// Client id of the request, minting a UUID stored in GAClientIDCookie when
+// the request has none. The cookie is added to the request too, so that
+// GetEvent finds it in the same request.
+func EnsureGAClientID(w http.ResponseWriter, r *http.Request) string {
+	id := GetGAClientID(r)
+	if id == "" {
+		var err error
+		if id, err = NewUUID(); err != nil {
+			return ""
+		}
+		r.AddCookie(&http.Cookie{Name: GAClientIDCookie, Value: id})
+	} else if _, err := r.Cookie(GAClientIDCookie); err != nil {
+		// The _ga cookie is managed by gtag.js, the ID cookie by GetCookieID
+		return id
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     GAClientIDCookie,
+		Value:    id,
+		Path:     "/",
+		Expires:  time.Now().Add(GAClientIDExpiration),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id
+}
@@ -0,0 +1,205 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+	"net/http"
+	"strconv"
+)
+
+// Hit types of the Measurement Protocol
+const (
+	GA_PAGEVIEW    = "pageview"
+	GA_SCREENVIEW  = "screenview"
+	GA_EVENT       = "event"
+	GA_TRANSACTION = "transaction"
+	GA_ITEM        = "item"
+	GA_SOCIAL      = "social"
+	GA_EXCEPTION   = "exception"
+	GA_TIMING      = "timing"
+)
+
+// Base URL of the Measurement Protocol, to change for a stub server in tests
+var GAEndpoint = "https://www.google-analytics.com"
+
+var (
+	ERROR_GA_UNKNOWN_HIT_TYPE = errors.New("Unknown GA hit type")
+	ERROR_GA_NO_CLIENT_ID     = errors.New("GA hit needs a client id or a user id")
+)
+
+// Hit of a given type, built with the GA*Hit functions so that the
+// parameters required by its type are set
+type GAHit struct {
+	Type  string
+	Event GAEvent
+}
+
+// Check the parameters required by the type of the hit
+// https://developers.google.com/analytics/devguides/collection/protocol/v1/parameters
+func (h *GAHit) Validate() error {
+	e := &h.Event
+	if (e.Guid == "") && (e.UserId == "") {
+		return ERROR_GA_NO_CLIENT_ID
+	}
+	if err := e.validateIndexes(); err != nil {
+		return err
+	}
+	required := map[string]string{}
+	switch h.Type {
+	case GA_PAGEVIEW:
+		if (e.DocumentLocationURL == "") && (e.DocumentPath == "") {
+			return fmt.Errorf("GA %v hit needs a document location or path", h.Type)
+		}
+	case GA_SCREENVIEW:
+		required["cd"] = e.ScreenName
+	case GA_EVENT:
+		required["ec"] = e.Category
+		required["ea"] = e.Action
+		if e.Value != "" {
+			if n, err := strconv.Atoi(e.Value); err != nil || n < 0 {
+				return fmt.Errorf("GA event value must be a non-negative integer: %q", e.Value)
+			}
+		}
+	case GA_TRANSACTION:
+		required["ti"] = e.TransactionID
+	case GA_ITEM:
+		required["ti"] = e.TransactionID
+		required["in"] = e.ItemName
+	case GA_SOCIAL:
+		required["sn"] = e.SocialNetwork
+		required["sa"] = e.SocialAction
+		required["st"] = e.SocialActionTarget
+	case GA_EXCEPTION:
+	case GA_TIMING:
+		required["utc"] = e.TimingCategory
+		required["utv"] = e.TimingVariable
+		required["utt"] = e.TimingTime
+	default:
+		return fmt.Errorf("%v: %q", ERROR_GA_UNKNOWN_HIT_TYPE, h.Type)
+	}
+	for param, value := range required {
+		if value == "" {
+			return fmt.Errorf("GA %v hit needs %v", h.Type, param)
+		}
+	}
+	return nil
+}
+
+// Page view of the document of the event
+func GAPageviewHit(event GAEvent) (*GAHit, error) {
+	h := &GAHit{Type: GA_PAGEVIEW, Event: event}
+	return h, h.Validate()
+}
+
+// Screen view of an app
+func GAScreenviewHit(event GAEvent, screenName string) (*GAHit, error) {
+	event.ScreenName = screenName
+	h := &GAHit{Type: GA_SCREENVIEW, Event: event}
+	return h, h.Validate()
+}
+
+// Event with a category and an action, the label is optional and the value
+// is not sent when negative
+func GAEventHit(event GAEvent, category, action, label string, value int) (*GAHit, error) {
+	event.Category = category
+	event.Action = action
+	event.Label = label
+	event.Value = ""
+	if value >= 0 {
+		event.Value = strconv.Itoa(value)
+	}
+	h := &GAHit{Type: GA_EVENT, Event: event}
+	return h, h.Validate()
+}
+
+// E-commerce transaction, with its items sent as GAItemHit
+func GATransactionHit(event GAEvent, id, affiliation string, revenue, shipping, tax float64, currency string) (*GAHit, error) {
+	event.TransactionID = id
+	event.TransactionAffiliation = affiliation
+	event.TransactionRevenue = strconv.FormatFloat(revenue, 'f', -1, 64)
+	event.TransactionShipping = strconv.FormatFloat(shipping, 'f', -1, 64)
+	event.TransactionTax = strconv.FormatFloat(tax, 'f', -1, 64)
+	event.CurrencyCode = currency
+	h := &GAHit{Type: GA_TRANSACTION, Event: event}
+	return h, h.Validate()
+}
+
+// Item of an e-commerce transaction
+func GAItemHit(event GAEvent, transactionID, name, code, category string, price float64, quantity int, currency string) (*GAHit, error) {
+	event.TransactionID = transactionID
+	event.ItemName = name
+	event.ItemCode = code
+	event.ItemCategory = category
+	event.ItemPrice = strconv.FormatFloat(price, 'f', -1, 64)
+	event.ItemQuantity = strconv.Itoa(quantity)
+	event.CurrencyCode = currency
+	h := &GAHit{Type: GA_ITEM, Event: event}
+	return h, h.Validate()
+}
+
+// Social interaction, like a share or a like, on a target URL
+func GASocialHit(event GAEvent, network, action, target string) (*GAHit, error) {
+	event.SocialNetwork = network
+	event.SocialAction = action
+	event.SocialActionTarget = target
+	h := &GAHit{Type: GA_SOCIAL, Event: event}
+	return h, h.Validate()
+}
+
+// Exception, fatal or not
+func GAExceptionHit(event GAEvent, description string, fatal bool) (*GAHit, error) {
+	event.ExceptionDescription = Trunc500(description)
+	event.IsExceptionFatal = "0"
+	if fatal {
+		event.IsExceptionFatal = "1"
+	}
+	h := &GAHit{Type: GA_EXCEPTION, Event: event}
+	return h, h.Validate()
+}
+
+// User timing in milliseconds
+func GATimingHit(event GAEvent, category, variable string, milliseconds int, label string) (*GAHit, error) {
+	event.TimingCategory = category
+	event.TimingVariable = variable
+	event.TimingTime = strconv.Itoa(milliseconds)
+	event.TimingLabel = label
+	h := &GAHit{Type: GA_TIMING, Event: event}
+	return h, h.Validate()
+}
+
+// Send a hit to the Universal Analytics property, and to the GA4 stream of
+// MeasurementID when set, during the request. Invalid hits are not sent.
+// QueueGAHit is usually better.
+func SendGAHit(c context.Context, PropertyID string, hit *GAHit) error {
+	if err := hit.Validate(); err != nil {
+		log.Errorf(c, "GA: Invalid hit: %v", err)
+		return err
+	}
+
+	trackGA4(c, hit.Type, hit.Event)
+
+	endpointUrl := GAEndpoint + "/collect"
+	v := setEvent(hit.Type, hit.Event)
+	v.Set("tid", PropertyID)
+	payload_data := v.Encode()
+	log.Infof(c, "GA: Calling %v with %v", endpointUrl, payload_data)
+
+	req, err := http.NewRequest("POST", endpointUrl, bytes.NewBufferString(payload_data))
+	if err != nil {
+		log.Errorf(c, "Error while tracking Google Analytics: %v", err)
+		return err
+	}
+	resp, err := urlfetch.Client(c).Do(req)
+	if err != nil {
+		log.Errorf(c, "Error while tracking Google Analytics: %v", err)
+		return err
+	}
+	resp.Body.Close()
+
+	log.Debugf(c, "GA status code %v", resp.StatusCode)
+	return nil
+}
@@ -0,0 +1,91 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestGAHitValidate(t *testing.T) {
+	client := GAEvent{Guid: "555"}
+	with := func(f func(e *GAEvent)) GAEvent {
+		e := client
+		f(&e)
+		return e
+	}
+
+	tests := []struct {
+		name  string
+		hit   GAHit
+		valid bool
+	}{
+		{"no client id", GAHit{Type: GA_PAGEVIEW, Event: GAEvent{DocumentPath: "/"}}, false},
+		{"user id only", GAHit{Type: GA_PAGEVIEW, Event: GAEvent{UserId: "u1", DocumentPath: "/"}}, true},
+		{"unknown type", GAHit{Type: "click", Event: client}, false},
+		{"empty type", GAHit{Event: client}, false},
+
+		{"pageview path", GAHit{Type: GA_PAGEVIEW, Event: with(func(e *GAEvent) { e.DocumentPath = "/" })}, true},
+		{"pageview location", GAHit{Type: GA_PAGEVIEW, Event: with(func(e *GAEvent) { e.DocumentLocationURL = "https://example.com/" })}, true},
+		{"pageview without page", GAHit{Type: GA_PAGEVIEW, Event: client}, false},
+
+		{"screenview", GAHit{Type: GA_SCREENVIEW, Event: with(func(e *GAEvent) { e.ScreenName = "Home" })}, true},
+		{"screenview without name", GAHit{Type: GA_SCREENVIEW, Event: client}, false},
+
+		{"event", GAHit{Type: GA_EVENT, Event: with(func(e *GAEvent) { e.Category, e.Action = "video", "play" })}, true},
+		{"event without action", GAHit{Type: GA_EVENT, Event: with(func(e *GAEvent) { e.Category = "video" })}, false},
+		{"event value", GAHit{Type: GA_EVENT, Event: with(func(e *GAEvent) { e.Category, e.Action, e.Value = "video", "play", "0" })}, true},
+		{"event negative value", GAHit{Type: GA_EVENT, Event: with(func(e *GAEvent) { e.Category, e.Action, e.Value = "video", "play", "-1" })}, false},
+		{"event decimal value", GAHit{Type: GA_EVENT, Event: with(func(e *GAEvent) { e.Category, e.Action, e.Value = "video", "play", "1.5" })}, false},
+
+		{"transaction", GAHit{Type: GA_TRANSACTION, Event: with(func(e *GAEvent) { e.TransactionID = "T1" })}, true},
+		{"transaction without id", GAHit{Type: GA_TRANSACTION, Event: client}, false},
+		{"item", GAHit{Type: GA_ITEM, Event: with(func(e *GAEvent) { e.TransactionID, e.ItemName = "T1", "Shirt" })}, true},
+		{"item without name", GAHit{Type: GA_ITEM, Event: with(func(e *GAEvent) { e.TransactionID = "T1" })}, false},
+
+		{"social", GAHit{Type: GA_SOCIAL, Event: with(func(e *GAEvent) {
+			e.SocialNetwork, e.SocialAction, e.SocialActionTarget = "Twitter", "share", "https://example.com/"
+		})}, true},
+		{"social without target", GAHit{Type: GA_SOCIAL, Event: with(func(e *GAEvent) { e.SocialNetwork, e.SocialAction = "Twitter", "share" })}, false},
+
+		{"exception", GAHit{Type: GA_EXCEPTION, Event: client}, true},
+
+		{"timing", GAHit{Type: GA_TIMING, Event: with(func(e *GAEvent) {
+			e.TimingCategory, e.TimingVariable, e.TimingTime = "load", "dom", "120"
+		})}, true},
+		{"timing without time", GAHit{Type: GA_TIMING, Event: with(func(e *GAEvent) { e.TimingCategory, e.TimingVariable = "load", "dom" })}, false},
+
+		{"custom dimension", GAHit{Type: GA_EXCEPTION, Event: with(func(e *GAEvent) { e.CustomDimensions = map[int]string{GA_MAX_CUSTOM_INDEX: "a"} })}, true},
+		{"custom dimension 0", GAHit{Type: GA_EXCEPTION, Event: with(func(e *GAEvent) { e.CustomDimensions = map[int]string{0: "a"} })}, false},
+		{"custom metric out of range", GAHit{Type: GA_EXCEPTION, Event: with(func(e *GAEvent) { e.CustomMetrics = map[int]string{GA_MAX_CUSTOM_INDEX + 1: "1"} })}, false},
+		{"content group out of range", GAHit{Type: GA_EXCEPTION, Event: with(func(e *GAEvent) { e.ContentGroups = map[int]string{GA_MAX_CONTENT_GROUP + 1: "a"} })}, false},
+	}
+	for _, test := range tests {
+		err := test.hit.Validate()
+		if test.valid && (err != nil) {
+			t.Errorf("%v: %v", test.name, err)
+		} else if !test.valid && (err == nil) {
+			t.Errorf("%v: no error", test.name)
+		}
+	}
+}
+
+func TestGAHitBuilders(t *testing.T) {
+	client := GAEvent{Guid: "555"}
+
+	if h, err := GAEventHit(client, "video", "play", "", -1); (err != nil) || (h.Event.Value != "") {
+		t.Errorf("GAEventHit without value: %v, value %q", err, h.Event.Value)
+	}
+	if h, err := GAEventHit(client, "video", "play", "intro", 3); (err != nil) || (h.Event.Value != "3") {
+		t.Errorf("GAEventHit with value: %v, value %q", err, h.Event.Value)
+	}
+	if _, err := GAEventHit(client, "", "play", "", -1); err == nil {
+		t.Errorf("GAEventHit without category: no error")
+	}
+	if _, err := GAPageviewHit(GAEvent{DocumentPath: "/"}); err != ERROR_GA_NO_CLIENT_ID {
+		t.Errorf("GAPageviewHit without client: %v, want %v", err, ERROR_GA_NO_CLIENT_ID)
+	}
+	if h, err := GAExceptionHit(client, "crash", true); (err != nil) || (h.Event.IsExceptionFatal != "1") {
+		t.Errorf("GAExceptionHit: %v, fatal %q", err, h.Event.IsExceptionFatal)
+	}
+	if h, err := GATransactionHit(client, "T1", "", 30.5, 0, 2, "USD"); (err != nil) || (h.Event.TransactionRevenue != "30.5") {
+		t.Errorf("GATransactionHit: %v, revenue %q", err, h.Event.TransactionRevenue)
+	}
+}
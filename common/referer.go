@@ -0,0 +1,371 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+	"google.golang.org/appengine/user"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mediums of the referer database
+const (
+	REFERER_SEARCH   = "search"
+	REFERER_SOCIAL   = "social"
+	REFERER_EMAIL    = "email"
+	REFERER_PAID     = "paid"
+	REFERER_INTERNAL = "internal"
+	REFERER_UNKNOWN  = "unknown"
+)
+
+var (
+	// Database loaded by UpdateRefererDatabaseHandler, in the JSON format of
+	// the Snowplow referer-parser, for example
+	// https://s3-eu-west-1.amazonaws.com/snowplow-hosted-assets/third-party/referer-parser/referers-latest.json
+	// The embedded database is used when empty or until the first update.
+	RefererDatabaseURL = ""
+
+	// How often an instance reads again the database stored by
+	// UpdateRefererDatabaseHandler
+	RefererDatabaseRefresh = time.Hour
+)
+
+var ERROR_INVALID_REFERER_DATABASE = errors.New("Invalid referer database")
+
+// Source of a referer URL
+type RefererInfo struct {
+	Known      bool   `json:"known"`
+	Medium     string `json:"medium"`
+	Source     string `json:"source,omitempty"`
+	SearchTerm string `json:"searchTerm,omitempty"`
+	Host       string `json:"host,omitempty"`
+}
+
+// Referer database: medium, then source name, then its parameters and
+// domains. A domain can end with ".*" to match every TLD of a name, like
+// "google.*" for google.fr and google.co.uk.
+type refererDatabase map[string]map[string]struct {
+	Parameters []string `json:"parameters,omitempty"`
+	Domains    []string `json:"domains"`
+}
+
+type refererSource struct {
+	Medium     string
+	Source     string
+	Parameters []string
+}
+
+// Referer database ready for lookups by domain, or domain and path
+type RefererParser struct {
+	domains map[string]*refererSource
+	sources map[string]string
+}
+
+// Parser of a database in the JSON format of the Snowplow referer-parser
+func NewRefererParser(data []byte) (*RefererParser, error) {
+	var db refererDatabase
+	if err := json.Unmarshal(data, &db); err != nil {
+		return nil, fmt.Errorf("%v: %v", ERROR_INVALID_REFERER_DATABASE, err)
+	}
+	p := &RefererParser{domains: map[string]*refererSource{}, sources: map[string]string{}}
+	for medium, sources := range db {
+		for name, s := range sources {
+			source := &refererSource{Medium: medium, Source: name, Parameters: s.Parameters}
+			for _, d := range s.Domains {
+				p.domains[strings.ToLower(d)] = source
+			}
+			p.sources[strings.ToLower(name)] = medium
+		}
+	}
+	if len(p.domains) == 0 {
+		return nil, ERROR_INVALID_REFERER_DATABASE
+	}
+	return p, nil
+}
+
+// Second level labels of the country TLDs, like the "co" of co.uk
+var countrySecondLevels = map[string]bool{
+	"co": true, "com": true, "net": true, "org": true, "ac": true,
+	"gov": true, "edu": true, "ne": true, "or": true, "gob": true,
+}
+
+// Source of a host and path: the host and path, the host, then the host
+// without its subdomains one by one, then the name of the domain with any
+// TLD
+func (p *RefererParser) lookup(host, path string) *refererSource {
+	labels := strings.Split(host, ".")
+	for i := 0; i < len(labels)-1; i++ {
+		domain := strings.Join(labels[i:], ".")
+		if path != "" && path != "/" {
+			if s, ok := p.domains[domain+path]; ok {
+				return s
+			}
+			if parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2); parts[0] != "" {
+				if s, ok := p.domains[domain+"/"+parts[0]]; ok {
+					return s
+				}
+			}
+		}
+		if s, ok := p.domains[domain]; ok {
+			return s
+		}
+	}
+	for j := 0; j < len(labels)-1; j++ {
+		tld := labels[j+1:]
+		if (len(tld) > 2) || ((len(tld) == 2) && !countrySecondLevels[tld[0]]) {
+			continue
+		}
+		for i := 0; i <= j; i++ {
+			if s, ok := p.domains[strings.Join(labels[i:j+1], ".")+".*"]; ok {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+// Source of a referer URL for a page of host: internal when the referer is
+// the same host, unknown when the database has no match
+func (p *RefererParser) Parse(referer, host string) RefererInfo {
+	u, err := url.Parse(referer)
+	if (referer == "") || (err != nil) || (u.Host == "") {
+		return RefererInfo{Medium: REFERER_UNKNOWN}
+	}
+	refererHost := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	info := RefererInfo{Medium: REFERER_UNKNOWN, Host: refererHost}
+
+	pageHost := strings.ToLower(strings.Split(host, ":")[0])
+	if (pageHost != "") && ((refererHost == pageHost) || (refererHost == "www."+pageHost) || ("www."+refererHost == pageHost)) {
+		info.Medium = REFERER_INTERNAL
+		return info
+	}
+
+	s := p.lookup(refererHost, strings.ToLower(u.Path))
+	if s == nil {
+		return info
+	}
+	info.Known = true
+	info.Medium = s.Medium
+	info.Source = s.Source
+	// The terms are in the fragment for some engines
+	query := u.Query()
+	if fragment, err := url.ParseQuery(u.Fragment); err == nil {
+		for k, v := range fragment {
+			if _, ok := query[k]; !ok {
+				query[k] = v
+			}
+		}
+	}
+	for _, param := range s.Parameters {
+		if term := strings.TrimSpace(query.Get(param)); term != "" {
+			info.SearchTerm = term
+			break
+		}
+	}
+	return info
+}
+
+// Medium of a source name of the database, like "Facebook" or "facebook",
+// empty if unknown
+func (p *RefererParser) SourceMedium(source string) string {
+	return p.sources[strings.ToLower(source)]
+}
+
+// Parser of the instance, updated from datastore every RefererDatabaseRefresh
+var refererParser = struct {
+	sync.RWMutex
+	parser   *RefererParser
+	loadTime time.Time
+}{}
+
+// Database stored by UpdateRefererDatabaseHandler, under the kind
+// "RefererDatabase" with the key "latest"
+type storedRefererDatabase struct {
+	Data    []byte `datastore:",noindex"`
+	URL     string
+	Updated time.Time
+}
+
+func defaultRefererParser() *RefererParser {
+	p, err := NewRefererParser([]byte(defaultRefererDatabase))
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// Parser of the latest database, the embedded one until a database was
+// stored by UpdateRefererDatabaseHandler
+func GetRefererParser(c context.Context) *RefererParser {
+	refererParser.RLock()
+	p := refererParser.parser
+	age := time.Since(refererParser.loadTime)
+	refererParser.RUnlock()
+	if (p != nil) && ((age < RefererDatabaseRefresh) || (RefererDatabaseURL == "")) {
+		return p
+	}
+
+	loaded := p
+	if loaded == nil {
+		loaded = defaultRefererParser()
+	}
+	if RefererDatabaseURL != "" {
+		var stored storedRefererDatabase
+		err := datastore.Get(c, datastore.NewKey(c, "RefererDatabase", "latest", 0, nil), &stored)
+		if err == nil {
+			if parsed, err := NewRefererParser(stored.Data); err == nil {
+				loaded = parsed
+			} else {
+				log.Errorf(c, "GetRefererParser: Error parsing stored database: %v", err)
+			}
+		} else if err != datastore.ErrNoSuchEntity {
+			log.Errorf(c, "GetRefererParser: Error getting database: %v", err)
+		}
+	}
+
+	refererParser.Lock()
+	refererParser.parser = loaded
+	refererParser.loadTime = time.Now()
+	refererParser.Unlock()
+	return loaded
+}
+
+// Source of a referer URL for a page of host, with the latest database
+func ParseReferer(c context.Context, referer, host string) RefererInfo {
+	return GetRefererParser(c).Parse(referer, host)
+}
+
+// Download the database of RefererDatabaseURL and store it for the
+// instances, for a daily cron
+func UpdateRefererDatabaseHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> UpdateRefererDatabaseHandler")
+
+	isAdmin := false
+	if user.Current(c) != nil {
+		isAdmin = user.Current(c).Admin
+	}
+
+	if (r.Header.Get("X-AppEngine-Cron") != "true") && (isAdmin == false) {
+		log.Errorf(c, "Handler called without admin/cron priviledge")
+		http.Error(w, "Handler called without admin/cron priviledge", http.StatusBadRequest)
+		return
+	}
+
+	if RefererDatabaseURL == "" {
+		http.Error(w, "No RefererDatabaseURL", http.StatusNotImplemented)
+		return
+	}
+
+	resp, err := urlfetch.Client(c).Get(RefererDatabaseURL)
+	if err != nil {
+		log.Errorf(c, "UpdateRefererDatabaseHandler: Error downloading database: %v", err)
+		http.Error(w, "Error downloading database: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if (err == nil) && (resp.StatusCode != http.StatusOK) {
+		err = fmt.Errorf("%v answered %v", RefererDatabaseURL, resp.Status)
+	}
+	if err != nil {
+		log.Errorf(c, "UpdateRefererDatabaseHandler: Error downloading database: %v", err)
+		http.Error(w, "Error downloading database: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A broken download must not replace a good database
+	parser, err := NewRefererParser(data)
+	if err != nil {
+		log.Errorf(c, "UpdateRefererDatabaseHandler: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stored := &storedRefererDatabase{Data: data, URL: RefererDatabaseURL, Updated: time.Now()}
+	if _, err := datastore.Put(c, datastore.NewKey(c, "RefererDatabase", "latest", 0, nil), stored); err != nil {
+		log.Errorf(c, "UpdateRefererDatabaseHandler: Error storing database: %v", err)
+		http.Error(w, "Error storing database: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	refererParser.Lock()
+	refererParser.parser = parser
+	refererParser.loadTime = time.Now()
+	refererParser.Unlock()
+
+	fmt.Fprintf(w, "Referer database updated, %v domains", len(parser.domains))
+}
+
+// Embedded database, a subset of the Snowplow referer-parser with TLD
+// wildcards for the engines that have a domain per country
+const defaultRefererDatabase = `{
+  "search": {
+    "Google": {"parameters": ["q", "query"], "domains": ["google.*", "encrypted.google.com", "googleusercontent.com"]},
+    "Bing": {"parameters": ["q", "Q"], "domains": ["bing.com", "cn.bing.com"]},
+    "Yahoo!": {"parameters": ["p", "q"], "domains": ["search.yahoo.com", "yahoo.*", "search.yahoo.co.jp"]},
+    "DuckDuckGo": {"parameters": ["q"], "domains": ["duckduckgo.com", "html.duckduckgo.com", "lite.duckduckgo.com"]},
+    "Baidu": {"parameters": ["wd", "word", "kw", "k"], "domains": ["baidu.com", "m.baidu.com"]},
+    "Yandex": {"parameters": ["text"], "domains": ["yandex.*", "ya.ru"]},
+    "Ecosia": {"parameters": ["q"], "domains": ["ecosia.org"]},
+    "Ask": {"parameters": ["q", "ask"], "domains": ["ask.com"]},
+    "AOL": {"parameters": ["q", "query"], "domains": ["search.aol.com", "aol.*"]},
+    "Naver": {"parameters": ["query"], "domains": ["search.naver.com"]},
+    "Seznam": {"parameters": ["q"], "domains": ["search.seznam.cz"]},
+    "Qwant": {"parameters": ["q"], "domains": ["qwant.com", "lite.qwant.com"]},
+    "Startpage": {"parameters": ["query", "q"], "domains": ["startpage.com"]},
+    "Brave": {"parameters": ["q"], "domains": ["search.brave.com"]},
+    "Sogou": {"parameters": ["query", "keyword"], "domains": ["sogou.com"]},
+    "Daum": {"parameters": ["q"], "domains": ["search.daum.net"]},
+    "Kagi": {"parameters": ["q"], "domains": ["kagi.com"]},
+    "Perplexity": {"parameters": ["q"], "domains": ["perplexity.ai"]},
+    "ChatGPT": {"domains": ["chatgpt.com", "chat.openai.com"]}
+  },
+  "social": {
+    "Facebook": {"domains": ["facebook.com", "fb.me", "m.facebook.com", "l.facebook.com", "lm.facebook.com"]},
+    "Instagram": {"domains": ["instagram.com", "l.instagram.com"]},
+    "Twitter": {"domains": ["twitter.com", "t.co", "x.com"]},
+    "LinkedIn": {"domains": ["linkedin.com", "lnkd.in"]},
+    "Reddit": {"domains": ["reddit.com", "old.reddit.com", "out.reddit.com"]},
+    "Pinterest": {"domains": ["pinterest.*", "pin.it"]},
+    "YouTube": {"domains": ["youtube.com", "youtu.be"]},
+    "TikTok": {"domains": ["tiktok.com"]},
+    "Hacker News": {"domains": ["news.ycombinator.com"]},
+    "Quora": {"domains": ["quora.com"]},
+    "Tumblr": {"domains": ["tumblr.com"]},
+    "VKontakte": {"domains": ["vk.com"]},
+    "Weibo": {"domains": ["weibo.com", "t.cn"]},
+    "WhatsApp": {"domains": ["whatsapp.com", "wa.me"]},
+    "Telegram": {"domains": ["t.me", "telegram.org"]},
+    "Mastodon": {"domains": ["mastodon.social"]},
+    "Threads": {"domains": ["threads.net"]},
+    "Bluesky": {"domains": ["bsky.app"]},
+    "Discord": {"domains": ["discord.com", "discord.gg"]},
+    "Medium": {"domains": ["medium.com"]},
+    "Xing": {"domains": ["xing.com"]}
+  },
+  "email": {
+    "Gmail": {"domains": ["mail.google.com"]},
+    "Outlook.com": {"domains": ["outlook.live.com", "mail.live.com"]},
+    "Office 365": {"domains": ["outlook.office.com", "outlook.office365.com"]},
+    "Yahoo! Mail": {"domains": ["mail.yahoo.com", "mail.yahoo.*"]},
+    "AOL Mail": {"domains": ["mail.aol.com"]},
+    "Proton Mail": {"domains": ["mail.proton.me"]},
+    "Zoho Mail": {"domains": ["mail.zoho.com"]}
+  },
+  "paid": {
+    "Google Ads": {"domains": ["googleadservices.com", "doubleclick.net", "googlesyndication.com"]},
+    "Microsoft Advertising": {"domains": ["bat.bing.com"]},
+    "Outbrain": {"domains": ["outbrain.com", "paid.outbrain.com"]},
+    "Taboola": {"domains": ["taboola.com", "trc.taboola.com"]}
+  }
+}`
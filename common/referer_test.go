@@ -0,0 +1,100 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestRefererLookup(t *testing.T) {
+	p := defaultRefererParser()
+
+	tests := []struct {
+		host   string
+		path   string
+		source string
+		medium string
+	}{
+		{"www.google.com", "/search", "Google", REFERER_SEARCH},
+		{"www.google.co.uk", "/", "Google", REFERER_SEARCH},
+		{"google.fr", "", "Google", REFERER_SEARCH},
+		{"mail.google.com", "/mail/u/0/", "Gmail", REFERER_EMAIL},
+		{"google.evil.com", "/", "", ""},
+		{"www.google.evil.co.uk", "/", "", ""},
+		{"yandex.ru", "/search/", "Yandex", REFERER_SEARCH},
+		{"yandex.com.tr", "/", "Yandex", REFERER_SEARCH},
+		{"duckduckgo.com", "/", "DuckDuckGo", REFERER_SEARCH},
+		{"l.facebook.com", "/l.php", "Facebook", REFERER_SOCIAL},
+		{"mail.yahoo.co.jp", "/", "Yahoo! Mail", REFERER_EMAIL},
+		{"example.com", "/", "", ""},
+		{"localhost", "", "", ""},
+	}
+	for _, test := range tests {
+		s := p.lookup(test.host, test.path)
+		if test.source == "" {
+			if s != nil {
+				t.Errorf("%v%v: %v, want no source", test.host, test.path, s.Source)
+			}
+			continue
+		}
+		if s == nil {
+			t.Errorf("%v%v: no source, want %v", test.host, test.path, test.source)
+			continue
+		}
+		if (s.Source != test.source) || (s.Medium != test.medium) {
+			t.Errorf("%v%v: %v (%v), want %v (%v)", test.host, test.path, s.Source, s.Medium, test.source, test.medium)
+		}
+	}
+}
+
+func TestRefererParse(t *testing.T) {
+	p := defaultRefererParser()
+
+	tests := []struct {
+		referer string
+		host    string
+		want    RefererInfo
+	}{
+		{"https://www.google.co.uk/search?q=red+shoes", "example.com",
+			RefererInfo{Known: true, Medium: REFERER_SEARCH, Source: "Google", SearchTerm: "red shoes", Host: "www.google.co.uk"}},
+		{"https://duckduckgo.com/#q=red+shoes", "example.com",
+			RefererInfo{Known: true, Medium: REFERER_SEARCH, Source: "DuckDuckGo", SearchTerm: "red shoes", Host: "duckduckgo.com"}},
+		{"https://duckduckgo.com/?q=blue#q=red", "example.com",
+			RefererInfo{Known: true, Medium: REFERER_SEARCH, Source: "DuckDuckGo", SearchTerm: "blue", Host: "duckduckgo.com"}},
+		{"https://yandex.ru/search/?text=%D0%BE%D0%B1%D1%83%D0%B2%D1%8C", "example.com",
+			RefererInfo{Known: true, Medium: REFERER_SEARCH, Source: "Yandex", SearchTerm: "обувь", Host: "yandex.ru"}},
+		{"https://mail.google.com/mail/u/0/", "example.com",
+			RefererInfo{Known: true, Medium: REFERER_EMAIL, Source: "Gmail", Host: "mail.google.com"}},
+		{"https://google.evil.com/?q=red", "example.com",
+			RefererInfo{Medium: REFERER_UNKNOWN, Host: "google.evil.com"}},
+		{"https://WWW.Example.com./page", "example.com:8080",
+			RefererInfo{Medium: REFERER_INTERNAL, Host: "www.example.com"}},
+		{"", "example.com", RefererInfo{Medium: REFERER_UNKNOWN}},
+		{"not a url", "example.com", RefererInfo{Medium: REFERER_UNKNOWN}},
+	}
+	for _, test := range tests {
+		if info := p.Parse(test.referer, test.host); info != test.want {
+			t.Errorf("%q: %+v, want %+v", test.referer, info, test.want)
+		}
+	}
+}
+
+func TestNewRefererParser(t *testing.T) {
+	for _, data := range []string{"", "[]", "{}", `{"search": {}}`} {
+		if _, err := NewRefererParser([]byte(data)); err == nil {
+			t.Errorf("%q: no error", data)
+		}
+	}
+
+	p, err := NewRefererParser([]byte(`{"social": {"Example": {"domains": ["Example.COM/Share"]}}}`))
+	if err != nil {
+		t.Fatalf("NewRefererParser: %v", err)
+	}
+	if s := p.lookup("www.example.com", "/share/123"); (s == nil) || (s.Source != "Example") {
+		t.Errorf("lookup by domain and path: %v", s)
+	}
+	if s := p.lookup("www.example.com", "/"); s != nil {
+		t.Errorf("lookup without the path: %v, want no source", s.Source)
+	}
+	if medium := p.SourceMedium("example"); medium != REFERER_SOCIAL {
+		t.Errorf("SourceMedium: %q, want %q", medium, REFERER_SOCIAL)
+	}
+}
@@ -0,0 +1,269 @@
+package track
+
+import (
+	"github.com/patdeg/go-appengine/common"
+	"golang.org/x/net/context"
+	bigquery "google.golang.org/api/bigquery/v2"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Marketing channels of the touches
+const (
+	CHANNEL_DIRECT         = "direct"
+	CHANNEL_ORGANIC_SEARCH = "organic_search"
+	CHANNEL_PAID_SEARCH    = "paid_search"
+	CHANNEL_SOCIAL         = "social"
+	CHANNEL_PAID_SOCIAL    = "paid_social"
+	CHANNEL_EMAIL          = "email"
+	CHANNEL_DISPLAY        = "display"
+	CHANNEL_AFFILIATE      = "affiliate"
+	CHANNEL_REFERRAL       = "referral"
+	CHANNEL_OTHER          = "other"
+)
+
+// Hours the attribution of a cookie stays in memcache
+const attributionCacheHours = 24
+
+// Source of a visit: a campaign, a click id or a referer
+type Touch struct {
+	Channel     string    `json:"channel,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	Medium      string    `json:"medium,omitempty"`
+	Campaign    string    `json:"campaign,omitempty"`
+	Term        string    `json:"term,omitempty"`
+	Content     string    `json:"content,omitempty"`
+	ClickId     string    `json:"clickId,omitempty" datastore:",noindex"`
+	ClickIdType string    `json:"clickIdType,omitempty" datastore:",noindex"`
+	Referer     string    `json:"referer,omitempty" datastore:",noindex"`
+	LandingPage string    `json:"landingPage,omitempty" datastore:",noindex"`
+	Time        time.Time `json:"time,omitempty"`
+}
+
+// First and last touch of a cookie, stored in the kind "Attributions" keyed
+// by cookie. Direct visits don't replace the last touch.
+type Attribution struct {
+	Cookie string `json:"cookie,omitempty"`
+	First  Touch  `json:"first"`
+	Last   Touch  `json:"last"`
+}
+
+// Source and medium of a referer, from the referer database: the name of
+// the search engine or social network, or the host for the other sites.
+// Empty for the referers of the site.
+func refererSourceMedium(info common.RefererInfo) (string, string) {
+	switch info.Medium {
+	case common.REFERER_INTERNAL:
+		return "", ""
+	case common.REFERER_SEARCH:
+		return strings.ToLower(info.Source), "organic"
+	case common.REFERER_SOCIAL:
+		return strings.ToLower(info.Source), "social"
+	case common.REFERER_EMAIL:
+		return strings.ToLower(info.Source), "email"
+	case common.REFERER_PAID:
+		return strings.ToLower(info.Source), "display"
+	}
+	if info.Host == "" {
+		return "", ""
+	}
+	return info.Host, "referral"
+}
+
+// Channel of a utm_medium, with whether the source is a social network to
+// tell paid search from paid social
+func mediumChannel(medium string, social bool) string {
+	switch strings.ToLower(medium) {
+	case "cpc", "ppc", "paid", "paidsearch", "paid_search", "paid-search":
+		if social {
+			return CHANNEL_PAID_SOCIAL
+		}
+		return CHANNEL_PAID_SEARCH
+	case "paidsocial", "paid_social", "paid-social", "social_paid":
+		return CHANNEL_PAID_SOCIAL
+	case "social", "social-network", "social_network", "social-media", "sm":
+		return CHANNEL_SOCIAL
+	case "email", "e-mail", "e_mail", "newsletter":
+		return CHANNEL_EMAIL
+	case "organic":
+		return CHANNEL_ORGANIC_SEARCH
+	case "display", "banner", "cpm":
+		return CHANNEL_DISPLAY
+	case "affiliate", "affiliates":
+		return CHANNEL_AFFILIATE
+	case "referral":
+		return CHANNEL_REFERRAL
+	}
+	return CHANNEL_OTHER
+}
+
+// Touch of a page request, from its utm_* and click id parameters or its
+// referer. Returns false for the navigation inside the site and the direct
+// visits, which are not new touches.
+func ParseTouch(r *http.Request) (Touch, bool) {
+	c := appengine.NewContext(r)
+	q := r.URL.Query()
+	t := Touch{
+		Source:      common.Trunc500(q.Get("utm_source")),
+		Medium:      common.Trunc500(q.Get("utm_medium")),
+		Campaign:    common.Trunc500(q.Get("utm_campaign")),
+		Term:        common.Trunc500(q.Get("utm_term")),
+		Content:     common.Trunc500(q.Get("utm_content")),
+		Referer:     common.Trunc500(r.Referer()),
+		LandingPage: common.Trunc500(r.URL.Path),
+		Time:        time.Now(),
+	}
+	for _, p := range []string{"gclid", "msclkid", "fbclid"} {
+		if id := q.Get(p); id != "" {
+			t.ClickId = common.Trunc500(id)
+			t.ClickIdType = p
+			break
+		}
+	}
+
+	parser := common.GetRefererParser(c)
+	referer := parser.Parse(r.Referer(), r.Host)
+	refSource, refMedium := refererSourceMedium(referer)
+
+	// Click ids are added by the ad platforms when there is no utm_*
+	if t.Source == "" {
+		switch t.ClickIdType {
+		case "gclid":
+			t.Source, t.Medium = "google", "cpc"
+		case "msclkid":
+			t.Source, t.Medium = "bing", "cpc"
+		case "fbclid":
+			// Also added to the links shared for free
+			t.Source, t.Medium = "facebook", "social"
+		}
+	}
+
+	switch {
+	case t.Source != "" || t.Medium != "" || t.Campaign != "":
+		if t.Medium == "" {
+			t.Medium = refMedium
+		}
+		t.Channel = mediumChannel(t.Medium, parser.SourceMedium(t.Source) == common.REFERER_SOCIAL)
+	case referer.Medium == common.REFERER_INTERNAL:
+		return t, false
+	case refSource != "":
+		t.Source, t.Medium = refSource, refMedium
+		t.Channel = mediumChannel(t.Medium, referer.Medium == common.REFERER_SOCIAL)
+	default:
+		t.Source, t.Medium, t.Channel = "(direct)", "(none)", CHANNEL_DIRECT
+		return t, false
+	}
+	if t.Term == "" {
+		t.Term = common.Trunc500(referer.SearchTerm)
+	}
+	return t, true
+}
+
+// Attribution of a cookie, nil if it has none
+func LoadAttribution(c context.Context, cookie string) *Attribution {
+	if cookie == "" {
+		return nil
+	}
+	var a Attribution
+	if common.GetObjMemCache(c, "attribution-"+cookie, &a) == nil {
+		return &a
+	}
+	err := datastore.Get(c, datastore.NewKey(c, "Attributions", cookie, 0, nil), &a)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
+		log.Errorf(c, "LoadAttribution: Error getting attribution: %v", err)
+		return nil
+	}
+	common.SetObjMemCache(c, "attribution-"+cookie, &a, attributionCacheHours)
+	return &a
+}
+
+// Update the attribution of a cookie with the touch of a page request: the
+// first touch is set once, the last touch by each campaign or external
+// referer
+func TouchAttribution(c context.Context, r *http.Request, cookie string) *Attribution {
+	log.Infof(c, ">>>> TouchAttribution")
+
+	if cookie == "" {
+		return nil
+	}
+	t, isTouch := ParseTouch(r)
+	return attributeTouch(c, cookie, t, isTouch)
+}
+
+// Update the attribution of a cookie with a touch parsed by ParseTouch
+func attributeTouch(c context.Context, cookie string, t Touch, isTouch bool) *Attribution {
+	if cookie == "" {
+		return nil
+	}
+	a := LoadAttribution(c, cookie)
+	if (a != nil) && !isTouch {
+		return a
+	}
+	if a == nil {
+		// The first visit is a touch, even direct
+		a = &Attribution{Cookie: cookie, First: t}
+	}
+	a.Last = t
+
+	if _, err := datastore.Put(c, datastore.NewKey(c, "Attributions", cookie, 0, nil), a); err != nil {
+		log.Errorf(c, "attributeTouch: Error storing attribution: %v", err)
+	}
+	common.SetObjMemCache(c, "attribution-"+cookie, a, attributionCacheHours)
+	return a
+}
+
+// Columns of the attribution in the visits and events tables
+func attributionFields() []*bigquery.TableFieldSchema {
+	return []*bigquery.TableFieldSchema{
+		{Name: "Channel", Type: "STRING", Description: "Last touch channel"},
+		{Name: "Source", Type: "STRING", Description: "Last touch source"},
+		{Name: "Medium", Type: "STRING", Description: "Last touch medium"},
+		{Name: "Campaign", Type: "STRING", Description: "Last touch campaign"},
+		{Name: "Term", Type: "STRING", Description: "Last touch term"},
+		{Name: "Content", Type: "STRING", Description: "Last touch content"},
+		{Name: "ClickId", Type: "STRING", Description: "Last touch gclid, msclkid or fbclid"},
+		{Name: "FirstChannel", Type: "STRING", Description: "First touch channel"},
+		{Name: "FirstSource", Type: "STRING", Description: "First touch source"},
+		{Name: "FirstMedium", Type: "STRING", Description: "First touch medium"},
+		{Name: "FirstCampaign", Type: "STRING", Description: "First touch campaign"},
+	}
+}
+
+// Stamp the attribution of the cookie on a visit or an event
+func (v *Visit) setAttribution(a *Attribution) {
+	if a == nil {
+		return
+	}
+	v.Channel = a.Last.Channel
+	v.Source = a.Last.Source
+	v.Medium = a.Last.Medium
+	v.Campaign = a.Last.Campaign
+	v.Term = a.Last.Term
+	v.Content = a.Last.Content
+	v.ClickId = a.Last.ClickId
+	v.FirstChannel = a.First.Channel
+	v.FirstSource = a.First.Source
+	v.FirstMedium = a.First.Medium
+	v.FirstCampaign = a.First.Campaign
+}
+
+// Attribution columns of a visit or event row
+func (v *Visit) attributionJson(row map[string]bigquery.JsonValue) {
+	row["Channel"] = v.Channel
+	row["Source"] = v.Source
+	row["Medium"] = v.Medium
+	row["Campaign"] = v.Campaign
+	row["Term"] = v.Term
+	row["Content"] = v.Content
+	row["ClickId"] = v.ClickId
+	row["FirstChannel"] = v.FirstChannel
+	row["FirstSource"] = v.FirstSource
+	row["FirstMedium"] = v.FirstMedium
+	row["FirstCampaign"] = v.FirstCampaign
+}
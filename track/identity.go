@@ -0,0 +1,199 @@
+package track
+
+import (
+	"errors"
+	"fmt"
+	"github.com/patdeg/go-appengine/common"
+	"golang.org/x/net/context"
+	bigquery "google.golang.org/api/bigquery/v2"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	// Dataset and view of the identity map, the latest user of each
+	// cookie. The view is not in the "identities" dataset, the wildcard
+	// queries on the daily tables would fail on it.
+	IdentityMapDataset = "views"
+	IdentityMapView    = "identity_map"
+
+	// How long a cookie identified as a user is not identified again
+	IdentifyExpiration = 24 * time.Hour
+)
+
+// Query of the identity map view. Join visits and events on Cookie to get
+// the UserId of the anonymous hits made before the login.
+const identityMapQuery = "SELECT Cookie, " +
+	"ARRAY_AGG(UserId ORDER BY Time DESC LIMIT 1)[OFFSET(0)] AS UserId, " +
+	"MIN(Time) AS FirstIdentified, MAX(Time) AS LastIdentified " +
+	"FROM `myproject.identities.*` GROUP BY Cookie"
+
+func createIdentitiesTableInBigQuery(c context.Context, d string) error {
+
+	log.Infof(c, ">>>> createIdentitiesTableInBigQuery")
+
+	if len(d) != 8 {
+		return errors.New("table name is badly formated - expected 8 characters")
+	}
+	newTable := &bigquery.Table{
+		TableReference: &bigquery.TableReference{
+			ProjectId: "myproject",
+			DatasetId: "identities",
+			TableId:   d,
+		},
+		FriendlyName: "Daily Identities table",
+		Description:  "This table is created automatically to store the cookies identified as users at login",
+		Schema: &bigquery.TableSchema{
+			Fields: []*bigquery.TableFieldSchema{
+				{Name: "Cookie", Type: "STRING", Description: "Cookie"},
+				{Name: "UserId", Type: "STRING", Description: "Global user id"},
+				{Name: "Provider", Type: "STRING", Description: "Login provider"},
+				{Name: "Time", Type: "TIMESTAMP", Description: "Time"},
+				{Name: "Host", Type: "STRING", Description: "Host"},
+			},
+		},
+	}
+
+	return common.CreateTableInBigQuery(c, newTable)
+}
+
+func createIdentityMapViewInBigQuery(c context.Context) error {
+	log.Infof(c, ">>>> createIdentityMapViewInBigQuery")
+	return common.CreateViewInBigQuery(c, "myproject", IdentityMapDataset, IdentityMapView, identityMapQuery)
+}
+
+func CreateTodayIdentitiesTableInBigQueryHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> CreateTodayIdentitiesTableInBigQueryHandler")
+
+	isAdmin := false
+	if user.Current(c) != nil {
+		isAdmin = user.Current(c).Admin
+	}
+
+	if (r.Header.Get("X-AppEngine-Cron") != "true") && (isAdmin == false) {
+		log.Errorf(c, "Handler called without admin/cron priviledge")
+		http.Error(w, "Handler called without admin/cron priviledge", http.StatusBadRequest)
+		return
+	}
+
+	today := time.Now().Format("20060102")
+	err := createIdentitiesTableInBigQuery(c, today)
+	if err != nil {
+		log.Errorf(c, "Error while creating table %v: %v", today, err)
+		http.Error(w, "Error while creating today table: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "Table %v created", today)
+
+}
+
+func CreateTomorrowIdentitiesTableInBigQueryHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> CreateTomorrowIdentitiesTableInBigQueryHandler")
+
+	isAdmin := false
+	if user.Current(c) != nil {
+		isAdmin = user.Current(c).Admin
+	}
+
+	if (r.Header.Get("X-AppEngine-Cron") != "true") && (isAdmin == false) {
+		log.Errorf(c, "Handler called without admin/cron priviledge")
+		http.Error(w, "Handler called without admin/cron priviledge", http.StatusBadRequest)
+		return
+	}
+
+	tomorrow := time.Now().Add(time.Hour * 24).Format("20060102")
+	err := createIdentitiesTableInBigQuery(c, tomorrow)
+	if err != nil {
+		log.Errorf(c, "Error while creating table %v: %v", tomorrow, err)
+		http.Error(w, "Error while creating tomorrow table: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "Table %v created", tomorrow)
+
+}
+
+// Create or update the identity map view, once at setup or after a change
+// of identityMapQuery
+func CreateIdentityMapViewInBigQueryHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> CreateIdentityMapViewInBigQueryHandler")
+
+	isAdmin := false
+	if user.Current(c) != nil {
+		isAdmin = user.Current(c).Admin
+	}
+
+	if (r.Header.Get("X-AppEngine-Cron") != "true") && (isAdmin == false) {
+		log.Errorf(c, "Handler called without admin/cron priviledge")
+		http.Error(w, "Handler called without admin/cron priviledge", http.StatusBadRequest)
+		return
+	}
+
+	err := createIdentityMapViewInBigQuery(c)
+	if err != nil {
+		log.Errorf(c, "Error while creating view %v: %v", IdentityMapView, err)
+		http.Error(w, "Error while creating view: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "View %v.%v created", IdentityMapDataset, IdentityMapView)
+
+}
+
+func StoreIdentityInBigQuery(c context.Context, cookie, userId, provider, host string, t time.Time) error {
+
+	log.Infof(c, ">>>> StoreIdentityInBigQuery")
+
+	req := &bigquery.TableDataInsertAllRequest{
+		Kind: "bigquery#tableDataInsertAllRequest",
+		Rows: []*bigquery.TableDataInsertAllRequestRows{
+			{
+				InsertId: strconv.FormatInt(t.UnixNano(), 10) + "-" + cookie,
+				Json: map[string]bigquery.JsonValue{
+					"Cookie":   cookie,
+					"UserId":   userId,
+					"Provider": provider,
+					"Time":     t,
+					"Host":     host,
+				},
+			},
+		},
+	}
+
+	return common.StreamDataInBigquery(c, "myproject", "identities", t.Format("20060102"), req)
+}
+
+// Link the anonymous cookie of the visitor to the global id of the user who
+// just logged in, in the identities tables and with an "Identity" event.
+// Called by auth at the end of a successful login. A cookie already linked
+// to the same user is not linked again before IdentifyExpiration.
+func TrackIdentify(w http.ResponseWriter, r *http.Request, cookie, userId, provider string) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>> TrackIdentify")
+
+	if (cookie == "") || (userId == "") {
+		return
+	}
+
+	var linked string
+	if (common.GetObjMemCache(c, "identity-"+cookie, &linked) == nil) && (linked == userId) {
+		log.Debugf(c, "TrackIdentify: Cookie already identified")
+		return
+	}
+
+	if err := StoreIdentityInBigQuery(c, cookie, userId, provider, r.Host, time.Now()); err != nil {
+		log.Errorf(c, "TrackIdentify: Error storing identity in BigQuery: %v", err)
+		return
+	}
+	common.SetObjMemCache(c, "identity-"+cookie, userId, int32(IdentifyExpiration/time.Hour))
+
+	TrackEventDetails(w, r, cookie, "Identity", "Identify", userId, 0.0)
+}
@@ -0,0 +1,125 @@
+package track
+
+import (
+	"fmt"
+	"github.com/patdeg/go-appengine/common"
+	"golang.org/x/net/context"
+	bigquery "google.golang.org/api/bigquery/v2"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+	"google.golang.org/appengine/user"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// De-duplication window of the pages whose path starts with Prefix
+type DedupWindow struct {
+	Prefix string
+	Window time.Duration
+}
+
+var (
+	// Every page view is recorded. A page view of the same URI by the same
+	// cookie within the window of its path is flagged IsDuplicate, like a
+	// reload. The longest matching prefix wins, no window by default.
+	PageViewDedupWindows = []DedupWindow{}
+
+	// Dataset and view of the daily page view counts
+	PageViewsDataset = "views"
+	PageViewsView    = "pageviews"
+)
+
+// Query of the page views view: hits count every row, page views the rows
+// not flagged as duplicates, and unique visitors the distinct cookies
+const pageViewsQuery = "SELECT DATE(Time) AS Day, Host, " +
+	"COUNT(*) AS Hits, " +
+	"COUNTIF(IsDuplicate IS NOT TRUE) AS PageViews, " +
+	"COUNT(DISTINCT Session) AS Sessions, " +
+	"COUNT(DISTINCT Cookie) AS UniqueVisitors " +
+	"FROM `myproject.visits.*` GROUP BY Day, Host"
+
+// De-duplication window of a path, 0 when page views are not de-duplicated
+func pageViewDedupWindow(path string) time.Duration {
+	window := time.Duration(0)
+	prefix := -1
+	for _, w := range PageViewDedupWindows {
+		if strings.HasPrefix(path, w.Prefix) && (len(w.Prefix) > prefix) {
+			window = w.Window
+			prefix = len(w.Prefix)
+		}
+	}
+	return window
+}
+
+// Whether the page view of the URI by the key repeats one seen within the
+// de-duplication window of the path
+func isDuplicatePageView(c context.Context, key, path, uri string) bool {
+	window := pageViewDedupWindow(path)
+	if window <= 0 {
+		return false
+	}
+	err := memcache.Add(c, &memcache.Item{
+		Key:        "pageview-" + key + "-" + common.MD5(uri),
+		Value:      []byte("1"),
+		Expiration: window,
+	})
+	if err == memcache.ErrNotStored {
+		return true
+	} else if err != nil {
+		log.Errorf(c, "isDuplicatePageView: Error adding item: %v", err)
+	}
+	return false
+}
+
+// Id of a page view, also the insert id of its row so that BigQuery drops
+// the retries of the same insert
+func newPageViewId(cookie string) string {
+	if id, err := common.NewUUID(); err == nil {
+		return id
+	}
+	return strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + cookie
+}
+
+func createPageViewsViewInBigQuery(c context.Context) error {
+	log.Infof(c, ">>>> createPageViewsViewInBigQuery")
+	return common.CreateViewInBigQuery(c, "myproject", PageViewsDataset, PageViewsView, pageViewsQuery)
+}
+
+// Create or update the page views view, once at setup or after a change of
+// pageViewsQuery
+func CreatePageViewsViewInBigQueryHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> CreatePageViewsViewInBigQueryHandler")
+
+	isAdmin := false
+	if user.Current(c) != nil {
+		isAdmin = user.Current(c).Admin
+	}
+
+	if (r.Header.Get("X-AppEngine-Cron") != "true") && (isAdmin == false) {
+		log.Errorf(c, "Handler called without admin/cron priviledge")
+		http.Error(w, "Handler called without admin/cron priviledge", http.StatusBadRequest)
+		return
+	}
+
+	err := createPageViewsViewInBigQuery(c)
+	if err != nil {
+		log.Errorf(c, "Error while creating view %v: %v", PageViewsView, err)
+		http.Error(w, "Error while creating view: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "View %v.%v created", PageViewsDataset, PageViewsView)
+
+}
+
+// Columns of the page view in the visits table
+func pageViewFields() []*bigquery.TableFieldSchema {
+	return []*bigquery.TableFieldSchema{
+		{Name: "PageViewId", Type: "STRING", Description: "Page view id"},
+		{Name: "IsDuplicate", Type: "BOOLEAN", Description: "Repeats a page view within its de-duplication window"},
+	}
+}
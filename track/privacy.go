@@ -0,0 +1,124 @@
+package track
+
+import (
+	"github.com/patdeg/go-appengine/common"
+	"golang.org/x/net/context"
+	bigquery "google.golang.org/api/bigquery/v2"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// BigQuery datasets with daily tables of rows keyed by cookie
+var CookieDatasets = []string{"visits", "events", "adwords", "identities"}
+
+// Rows of the cookies in the tables of a dataset
+func getCookieRows(c context.Context, dataset string, cookies []string) ([]map[string]interface{}, error) {
+	rows, _, err := common.RunQueryInBigQuery(c, "myproject",
+		"SELECT *, _TABLE_SUFFIX AS TableId FROM `myproject."+dataset+".*` WHERE Cookie IN UNNEST(@cookies) ORDER BY Time",
+		[]*bigquery.QueryParameter{common.StringArrayQueryParameter("cookies", cookies)})
+	if err != nil {
+		log.Errorf(c, "getCookieRows: Error querying %v: %v", dataset, err)
+		return nil, err
+	}
+	return rows, nil
+}
+
+// Gather what was tracked for these cookies: the BigQuery rows of each
+// dataset, the attributions and the sessions. Robot pages are not included,
+// they have no cookie and an IP can be shared with other people.
+func ExportCookieData(c context.Context, cookies []string) (map[string]interface{}, error) {
+	log.Infof(c, ">>>> ExportCookieData")
+
+	data := map[string]interface{}{}
+	if len(cookies) == 0 {
+		return data, nil
+	}
+
+	for _, dataset := range CookieDatasets {
+		rows, err := getCookieRows(c, dataset, cookies)
+		if err != nil {
+			return nil, err
+		}
+		data[dataset] = rows
+	}
+
+	var attributions []Attribution
+	for _, cookie := range cookies {
+		if a := LoadAttribution(c, cookie); a != nil {
+			attributions = append(attributions, *a)
+		}
+	}
+	data["attributions"] = attributions
+
+	var sessions []Session
+	for _, cookie := range cookies {
+		if s := LoadSession(c, cookie); s != nil {
+			sessions = append(sessions, *s)
+		}
+	}
+	data["sessions"] = sessions
+
+	return data, nil
+}
+
+// Delete what was tracked for these cookies: the memcache entries, the
+// attributions and sessions, and the BigQuery rows with DML deletes. Rows
+// still in the BigQuery streaming buffer can't be deleted, the call fails
+// and should be retried later.
+func EraseCookieData(c context.Context, cookies []string) error {
+	log.Infof(c, ">>>> EraseCookieData")
+
+	if len(cookies) == 0 {
+		return nil
+	}
+
+	for _, cookie := range cookies {
+		common.DeleteMemCache(c, "session-"+cookie)
+		common.DeleteMemCache(c, "identity-"+cookie)
+		common.DeleteMemCache(c, "attribution-"+cookie)
+	}
+
+	var attributionKeys []*datastore.Key
+	for _, cookie := range cookies {
+		attributionKeys = append(attributionKeys, datastore.NewKey(c, "Attributions", cookie, 0, nil))
+	}
+	if err := datastore.DeleteMulti(c, attributionKeys); err != nil {
+		log.Errorf(c, "EraseCookieData: Error deleting attributions: %v", err)
+		return err
+	}
+
+	var sessionKeys []*datastore.Key
+	for _, cookie := range cookies {
+		sessionKeys = append(sessionKeys, datastore.NewKey(c, "Sessions", cookie, 0, nil))
+	}
+	if err := datastore.DeleteMulti(c, sessionKeys); err != nil {
+		log.Errorf(c, "EraseCookieData: Error deleting sessions: %v", err)
+		return err
+	}
+
+	params := []*bigquery.QueryParameter{common.StringArrayQueryParameter("cookies", cookies)}
+	for _, dataset := range CookieDatasets {
+		rows, err := getCookieRows(c, dataset, cookies)
+		if err != nil {
+			return err
+		}
+
+		var tables []string
+		for _, row := range rows {
+			if t, ok := row["TableId"].(string); ok && !common.StringInSlice(t, tables) {
+				tables = append(tables, t)
+			}
+		}
+		for _, t := range tables {
+			_, n, err := common.RunQueryInBigQuery(c, "myproject",
+				"DELETE FROM `myproject."+dataset+"."+t+"` WHERE Cookie IN UNNEST(@cookies)", params)
+			if err != nil {
+				log.Errorf(c, "EraseCookieData: Error deleting from %v.%v: %v", dataset, t, err)
+				return err
+			}
+			log.Infof(c, "EraseCookieData: %v rows deleted from %v.%v", n, dataset, t)
+		}
+	}
+
+	return nil
+}
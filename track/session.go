@@ -0,0 +1,234 @@
+package track
+
+import (
+	"fmt"
+	"github.com/patdeg/go-appengine/common"
+	"golang.org/x/net/context"
+	bigquery "google.golang.org/api/bigquery/v2"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// Inactivity after which the next hit starts a new session. Each hit
+	// extends the session.
+	SessionTimeout = 30 * time.Minute
+
+	// Sessions end at midnight in this location
+	SessionLocation = time.UTC
+
+	// Dataset and view of the sessions, with their landing and exit pages
+	SessionsDataset = "views"
+	SessionsView    = "sessions"
+)
+
+// Hours a session stays in memcache, longer than SessionTimeout so that the
+// next session gets the sequence number of the cookie
+const sessionCacheHours = 24
+
+// Query of the sessions view, from the page views of the visits tables
+const sessionsQuery = "SELECT Session, ANY_VALUE(Cookie) AS Cookie, " +
+	"MAX(SessionNumber) AS SessionNumber, " +
+	"MIN(Time) AS Start, MAX(Time) AS End, COUNT(*) AS PageViews, " +
+	"ARRAY_AGG(URI ORDER BY Time LIMIT 1)[OFFSET(0)] AS LandingPage, " +
+	"ARRAY_AGG(URI ORDER BY Time DESC LIMIT 1)[OFFSET(0)] AS ExitPage " +
+	"FROM `myproject.visits.*` WHERE Session IS NOT NULL GROUP BY Session"
+
+// Session of a cookie, shared by its visits and events. A session ends after
+// SessionTimeout without hit, at midnight, or when the visitor comes back
+// from another campaign. The last session of a cookie is kept in the kind
+// "Sessions" keyed by cookie, updated on every hit, and cached in memcache.
+type Session struct {
+	Id     string `json:"id"`
+	Cookie string `json:"cookie,omitempty"`
+	// Sequence number of the session for the cookie, starting at 1
+	Number      int64     `json:"number"`
+	Start       time.Time `json:"start"`
+	LastSeen    time.Time `json:"lastSeen"`
+	Hits        int64     `json:"hits"`
+	PageViews   int64     `json:"pageViews"`
+	LandingPage string    `json:"landingPage,omitempty" datastore:",noindex"`
+	ExitPage    string    `json:"exitPage,omitempty" datastore:",noindex"`
+	// Touch that started the session, empty for a direct visit
+	Campaign string `json:"campaign,omitempty" datastore:",noindex"`
+}
+
+// Key of the session of a request: the cookie, or the IP and the user agent
+// when the request has no cookie
+func sessionKey(r *http.Request, cookie string) string {
+	if cookie != "" {
+		return cookie
+	}
+	return "anon-" + common.MD5(r.RemoteAddr+r.Header.Get("User-Agent"))
+}
+
+// Campaign of a touch, a different one starts a new session
+func touchCampaign(t *Touch) string {
+	return strings.Join([]string{t.Source, t.Medium, t.Campaign, t.Term, t.Content, t.ClickId}, "|")
+}
+
+// Whether a hit at now, coming from touch when not nil, is out of the session
+func (s *Session) ended(now time.Time, touch *Touch) bool {
+	if now.Sub(s.LastSeen) > SessionTimeout {
+		return true
+	}
+	y1, m1, d1 := s.LastSeen.In(SessionLocation).Date()
+	y2, m2, d2 := now.In(SessionLocation).Date()
+	if (y1 != y2) || (m1 != m2) || (d1 != d2) {
+		return true
+	}
+	return (touch != nil) && (touchCampaign(touch) != s.Campaign)
+}
+
+// Last session of a key, nil if it has none
+func LoadSession(c context.Context, key string) *Session {
+	if key == "" {
+		return nil
+	}
+	var s Session
+	if common.GetObjMemCache(c, "session-"+key, &s) == nil {
+		return &s
+	}
+	err := datastore.Get(c, datastore.NewKey(c, "Sessions", key, 0, nil), &s)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
+		log.Errorf(c, "LoadSession: Error getting session: %v", err)
+		return nil
+	}
+	return &s
+}
+
+// Record a hit in the session of a key, starting a new session when the
+// last one ended. page is the path of a page view, empty for an event, and
+// touch the new touch of the page view if any. The session is updated in a
+// datastore transaction so that parallel hits are all counted and that the
+// session survives a memcache eviction.
+func TouchSession(c context.Context, key, page string, touch *Touch) *Session {
+	log.Infof(c, ">>>> TouchSession")
+
+	now := time.Now()
+	var s *Session
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		dsKey := datastore.NewKey(tc, "Sessions", key, 0, nil)
+		var last Session
+		s = nil
+		if err := datastore.Get(tc, dsKey, &last); err == nil {
+			s = &last
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		s = nextSession(s, key, now, page, touch)
+		_, err := datastore.Put(tc, dsKey, s)
+		return err
+	}, nil)
+	if err != nil {
+		// The hit is still counted in the memcache copy of the session
+		log.Errorf(c, "TouchSession: Error storing session: %v", err)
+		s = nextSession(LoadSession(c, key), key, now, page, touch)
+	}
+	if s.Hits == 1 {
+		log.Infof(c, "TouchSession: New session %v", s.Id)
+	}
+
+	if err := common.SetObjMemCache(c, "session-"+key, s, sessionCacheHours); err != nil {
+		log.Errorf(c, "TouchSession: Error setting memcache: %v", err)
+	}
+	return s
+}
+
+// Session of a key after a hit at now, following s, the last session of the
+// key or nil if it has none
+func nextSession(s *Session, key string, now time.Time, page string, touch *Touch) *Session {
+	if (s == nil) || s.ended(now, touch) {
+		number := int64(1)
+		if s != nil {
+			number = s.Number + 1
+		}
+		s = &Session{
+			Id:     strconv.FormatInt(now.UnixNano(), 10) + "-" + key,
+			Cookie: key,
+			Number: number,
+			Start:  now,
+		}
+		if touch != nil {
+			s.Campaign = touchCampaign(touch)
+		}
+	}
+	s.LastSeen = now
+	s.Hits++
+	if page != "" {
+		if s.LandingPage == "" {
+			s.LandingPage = page
+		}
+		s.ExitPage = page
+		s.PageViews++
+	}
+	return s
+}
+
+func createSessionsViewInBigQuery(c context.Context) error {
+	log.Infof(c, ">>>> createSessionsViewInBigQuery")
+	return common.CreateViewInBigQuery(c, "myproject", SessionsDataset, SessionsView, sessionsQuery)
+}
+
+// Create or update the sessions view, once at setup or after a change of
+// sessionsQuery
+func CreateSessionsViewInBigQueryHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	log.Infof(c, ">>>>>>>> CreateSessionsViewInBigQueryHandler")
+
+	isAdmin := false
+	if user.Current(c) != nil {
+		isAdmin = user.Current(c).Admin
+	}
+
+	if (r.Header.Get("X-AppEngine-Cron") != "true") && (isAdmin == false) {
+		log.Errorf(c, "Handler called without admin/cron priviledge")
+		http.Error(w, "Handler called without admin/cron priviledge", http.StatusBadRequest)
+		return
+	}
+
+	err := createSessionsViewInBigQuery(c)
+	if err != nil {
+		log.Errorf(c, "Error while creating view %v: %v", SessionsView, err)
+		http.Error(w, "Error while creating view: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "View %v.%v created", SessionsDataset, SessionsView)
+
+}
+
+// Columns of the session in the visits and events tables
+func sessionFields() []*bigquery.TableFieldSchema {
+	return []*bigquery.TableFieldSchema{
+		{Name: "SessionNumber", Type: "INTEGER", Description: "Sequence number of the session for the cookie"},
+		{Name: "SessionHit", Type: "INTEGER", Description: "Sequence number of the hit in the session"},
+		{Name: "LandingPage", Type: "STRING", Description: "First page of the session"},
+		{Name: "IsEntrance", Type: "BOOLEAN", Description: "First page view of the session"},
+	}
+}
+
+// Stamp the session on a visit or an event
+func (v *Visit) setSession(s *Session, isPageView bool) {
+	v.Session = s.Id
+	v.SessionNumber = s.Number
+	v.SessionHit = s.Hits
+	v.LandingPage = s.LandingPage
+	v.IsEntrance = isPageView && (s.PageViews == 1)
+}
+
+// Session columns of a visit or event row
+func (v *Visit) sessionJson(row map[string]bigquery.JsonValue) {
+	row["SessionNumber"] = v.SessionNumber
+	row["SessionHit"] = v.SessionHit
+	row["LandingPage"] = v.LandingPage
+	row["IsEntrance"] = v.IsEntrance
+}